@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	purposeVerify = "verify"
+	purposeReset  = "reset"
+
+	verifyTokenTTL = 24 * time.Hour
+	resetTokenTTL  = 30 * time.Minute
+)
+
+var errInvalidEmailToken = errors.New("invalid or expired token")
+
+// normalizeEmail trims and validates a bare address like "a@b.org". An
+// empty address is allowed, since email is optional.
+func normalizeEmail(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", nil
+	}
+	addr, err := mail.ParseAddress(s)
+	if err != nil || addr.Address != s || len(s) > 254 {
+		return "", fmt.Errorf("invalid email")
+	}
+	return addr.Address, nil
+}
+
+// appURL is the frontend URL for path, under APP_BASE_URL.
+func appURL(path string) string {
+	base := os.Getenv("APP_BASE_URL")
+	if base == "" {
+		base = "http://localhost:5173"
+	}
+	return strings.TrimRight(base, "/") + path
+}
+
+// appLink builds a link into the frontend carrying token.
+func appLink(path, token string) string {
+	return appURL(path) + "?token=" + url.QueryEscape(token)
+}
+
+// createEmailToken stores a single-use token for purpose and returns it.
+// Creating one replaces any earlier unused token for the same purpose.
+func createEmailToken(ctx context.Context, db dbtx, uid int64, purpose, email string, ttl time.Duration) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	_, err = db.ExecContext(ctx, "UPDATE email_tokens SET UsedAt=NOW() WHERE UserID=? AND Purpose=? AND UsedAt IS NULL", uid, purpose)
+	if err != nil {
+		return "", fmt.Errorf("expire email tokens: %w", err)
+	}
+	_, err = db.ExecContext(ctx,
+		"INSERT INTO email_tokens (TokenHash, UserID, Purpose, Email, ExpiresAt) VALUES (?, ?, ?, ?, ?)",
+		hashToken(token), uid, purpose, email, time.Now().Add(ttl))
+	if err != nil {
+		return "", fmt.Errorf("insert email token: %w", err)
+	}
+	return token, nil
+}
+
+// useEmailToken marks token used and returns its user and email. It fails
+// for unknown, used, expired or wrong-purpose tokens.
+func useEmailToken(ctx context.Context, tx *sql.Tx, token, purpose string) (int64, string, error) {
+	var uid int64
+	var email, gotPurpose string
+	var expires time.Time
+	var used sql.NullTime
+	err := tx.QueryRowContext(ctx, "SELECT UserID, Email, Purpose, ExpiresAt, UsedAt FROM email_tokens WHERE TokenHash=? FOR UPDATE",
+		hashToken(token)).Scan(&uid, &email, &gotPurpose, &expires, &used)
+	if err == sql.ErrNoRows {
+		return 0, "", errInvalidEmailToken
+	}
+	if err != nil {
+		return 0, "", fmt.Errorf("select email token: %w", err)
+	}
+	if gotPurpose != purpose || used.Valid || time.Now().After(expires) {
+		return 0, "", errInvalidEmailToken
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE email_tokens SET UsedAt=NOW() WHERE TokenHash=?", hashToken(token)); err != nil {
+		return 0, "", fmt.Errorf("use email token: %w", err)
+	}
+	return uid, email, nil
+}
+
+// sendVerification mails a verification link for email. It runs after the
+// request, so failures are only logged.
+func (a *App) sendVerification(uid int64, username, email string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	token, err := createEmailToken(ctx, a.DB, uid, purposeVerify, email, verifyTokenTTL)
+	if err != nil {
+		log.Printf("verification token error: %v", err)
+		return
+	}
+	err = a.Mailer.Send(ctx, Mail{
+		To:      email,
+		Subject: "Confirm your email",
+		Body: fmt.Sprintf("Hi %s,\n\nConfirm this is your email address by opening the link below. It expires in 24 hours.\n\n%s\n\nIf you didn't sign up, you can ignore this email.\n",
+			username, appLink("/verify-email", token)),
+	})
+	if err != nil {
+		log.Printf("verification mail error: %v", err)
+	}
+}
+
+// SetEmail sets or changes the caller's email and sends a verification
+// link to it. The address counts as unverified until the link is used.
+func (a *App) SetEmail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	c, _ := ClaimsFromContext(ctx)
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	email, err := normalizeEmail(req.Email)
+	if err != nil || email == "" {
+		http.Error(w, "invalid email", http.StatusBadRequest)
+		return
+	}
+	child, consented, _, err := childStatus(ctx, a.DB, c.UserID)
+	if err != nil {
+		log.Printf("set email child status error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if child && !consented {
+		http.Error(w, "email needs a guardian's consent", http.StatusForbidden)
+		return
+	}
+	_, err = a.DB.ExecContext(ctx, "UPDATE users SET Email=?, EmailVerifiedAt=NULL WHERE ID=? AND (Email IS NULL OR Email<>?)", email, c.UserID, email)
+	if err != nil {
+		log.Printf("set email error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	go a.sendVerification(c.UserID, c.Username, email)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// SetGrade sets the caller's grade. Accounts created through an identity
+// provider start without one and can't generate questions until it is
+// set. The token carries the old grade until the next refresh.
+func (a *App) SetGrade(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	c, _ := ClaimsFromContext(ctx)
+	var req struct {
+		Grade string `json:"grade"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	grade, err := strconv.Atoi(req.Grade)
+	if err != nil || grade < 0 || grade > 12 {
+		http.Error(w, "grade out of bounds", http.StatusBadRequest)
+		return
+	}
+	if _, err := a.DB.ExecContext(ctx, "UPDATE users SET grade=? WHERE ID=?", grade, c.UserID); err != nil {
+		log.Printf("set grade error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// VerifyEmail confirms the address a verification token was sent to.
+func (a *App) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		http.Error(w, "missing token", http.StatusBadRequest)
+		return
+	}
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("verify email begin error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	uid, email, err := useEmailToken(ctx, tx, req.Token, purposeVerify)
+	if err == errInvalidEmailToken {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("verify email error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	// the address may have changed since the link was sent
+	res, err := tx.ExecContext(ctx, "UPDATE users SET EmailVerifiedAt=NOW() WHERE ID=? AND Email=?", uid, email)
+	if err != nil {
+		log.Printf("verify email update error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, errInvalidEmailToken.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("verify email commit error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ForgotPassword mails a reset link to the verified email of the account
+// named by username, or of every account using email (siblings often share
+// a parent's address). It answers the same whether or not anything was
+// sent, so it can't be used to find accounts.
+func (a *App) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+		Email    string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Username == "" && req.Email == "") {
+		http.Error(w, "missing username or email", http.StatusBadRequest)
+		return
+	}
+	go a.sendResets(req.Username, strings.TrimSpace(req.Email))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (a *App) sendResets(username, email string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	query := "SELECT ID, Username, Email FROM users WHERE Username=? AND EmailVerifiedAt IS NOT NULL"
+	arg := username
+	if username == "" {
+		query = "SELECT ID, Username, Email FROM users WHERE Email=? AND EmailVerifiedAt IS NOT NULL LIMIT 10"
+		arg = email
+	}
+	rows, err := a.DB.QueryContext(ctx, query, arg)
+	if err != nil {
+		log.Printf("password reset lookup error: %v", err)
+		return
+	}
+	type account struct {
+		id              int64
+		username, email string
+	}
+	var accounts []account
+	for rows.Next() {
+		var acct account
+		if err := rows.Scan(&acct.id, &acct.username, &acct.email); err != nil {
+			log.Printf("password reset scan error: %v", err)
+			rows.Close()
+			return
+		}
+		accounts = append(accounts, acct)
+	}
+	rows.Close()
+
+	for _, acct := range accounts {
+		token, err := createEmailToken(ctx, a.DB, acct.id, purposeReset, acct.email, resetTokenTTL)
+		if err != nil {
+			log.Printf("password reset token error: %v", err)
+			continue
+		}
+		err = a.Mailer.Send(ctx, Mail{
+			To:      acct.email,
+			Subject: "Reset your password",
+			Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password for your account. Open the link below to choose a new one. It works once and expires in 30 minutes.\n\n%s\n\nIf it wasn't you, ignore this email and your password won't change.\n",
+				acct.username, appLink("/reset-password", token)),
+		})
+		if err != nil {
+			log.Printf("password reset mail error: %v", err)
+		}
+	}
+}
+
+// ResetPassword sets a new password with a reset token. It signs the user
+// out everywhere and lifts any login lockout.
+func (a *App) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req struct {
+		Token string `json:"token"`
+		Pwd   string `json:"pwd"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" || req.Pwd == "" {
+		http.Error(w, "missing token or password", http.StatusBadRequest)
+		return
+	}
+	hashed, err := hashPassword(req.Pwd)
+	if err != nil {
+		log.Printf("reset hash error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("reset begin error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	uid, _, err := useEmailToken(ctx, tx, req.Token, purposeReset)
+	if err == errInvalidEmailToken {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("reset token error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	res, err := tx.ExecContext(ctx, "UPDATE auth SET Hash=? WHERE userID=?", hashed, uid)
+	if err != nil {
+		log.Printf("reset update hash error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	// accounts created through an identity provider have no password yet
+	if n, _ := res.RowsAffected(); n == 0 {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO auth (userID, Hash) VALUES (?, ?)", uid, hashed); err != nil {
+			log.Printf("reset insert hash error: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE refresh_tokens SET RevokedAt=NOW() WHERE UserID=? AND RevokedAt IS NULL", uid); err != nil {
+		log.Printf("reset revoke sessions error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	var username string
+	if err := tx.QueryRowContext(ctx, "SELECT Username FROM users WHERE ID=?", uid).Scan(&username); err != nil {
+		log.Printf("reset select user error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("reset commit error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	a.Limiter.loginSucceeded(ctx, username)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	answerNumeric    = "numeric"
+	answerExpression = "expression"
+	answerOther      = "other"
+)
+
+var answerKeyTask = OutputTask{
+	Name: "answer key",
+	Schema: &Schema{
+		Type:     "object",
+		Required: []string{"kind", "value", "unit", "expression"},
+		Properties: map[string]*Schema{
+			"kind":       {Type: "string", Enum: []string{answerNumeric, answerExpression, answerOther}},
+			"value":      {Type: "number"},
+			"unit":       {Type: "string"},
+			"expression": {Type: "string"},
+		},
+	},
+}
+
+// createAnswerKey asks the model once for the canonical answer to q and
+// stores it. It runs after the question is returned, so failures only mean
+// the question is graded by the model.
+func (a *App) createAnswerKey(q *Question) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	prompt := fmt.Sprintf(`
+Output a JSON only - no reasoning, no explanations, no commentary.
+You are an expert educator writing the answer key for this question on %s:
+%s
+
+Follow these rules strictly:
+- Output ONLY valid JSON with keys "kind", "value", "unit" and "expression".
+- If the final answer is a single number, set "kind" to "numeric", "value" to the
+  number and "unit" to its unit as a short symbol (e.g. "m/s", "kg", "%%"), or ""
+  if it has none.
+- If the final answer is an algebraic expression, set "kind" to "expression" and
+  "expression" to it in plain ASCII math, e.g. "(x+1)^2/(2*x)" or "sqrt(x)+sin(x)".
+- Otherwise set "kind" to "other".
+- Leave unused keys as 0 or "".
+
+Example output format:
+{
+	"kind": "numeric",
+	"value": 0.1606,
+	"unit": "",
+	"expression": ""
+}
+`, q.Topic, q.QuestionLatex)
+
+	var out struct {
+		Kind       string  `json:"kind"`
+		Value      float64 `json:"value"`
+		Unit       string  `json:"unit"`
+		Expression string  `json:"expression"`
+	}
+	if err := a.completeStructured(ctx, answerKeyTask, prompt, &out); err != nil {
+		log.Printf("answer key for question %d: %v", q.ID, err)
+		return
+	}
+	key := &AnswerKey{
+		QuestionID: q.ID,
+		Kind:       out.Kind,
+		Value:      out.Value,
+		Unit:       strings.TrimSpace(out.Unit),
+		Expr:       strings.TrimSpace(out.Expression),
+	}
+	if err := a.saveAnswerKey(ctx, key); err != nil {
+		log.Printf("answer key for question %d: %v", q.ID, err)
+	}
+}
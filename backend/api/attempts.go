@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Attempt is one answered question as stored in the attempts table.
+// Features and NextDifficulty are the student's stats after the answer and
+// the difficulty chosen from them, as in synthetic_user_data.csv. Points
+// are what the attempt added to the leaderboard score.
+type Attempt struct {
+	UserID         int64
+	QuestionID     int64
+	Topic          string
+	Correct        bool
+	Score          float64
+	TimeTaken      time.Duration
+	Features       DifficultyFeatures
+	NextDifficulty int
+	Points         int
+}
+
+func insertAttempt(ctx context.Context, tx *sql.Tx, at *Attempt) error {
+	f := at.Features
+	_, err := tx.ExecContext(ctx, `INSERT INTO attempts
+		(UserID, QuestionID, Topic, Difficulty, Correct, Score, TimeTaken, Streak, AccuracyRate, AvgTimePerQuestion, QuestionsAnswered, NextDifficulty, Points)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		at.UserID, at.QuestionID, f.Topic, f.CurrentDifficulty, at.Correct, at.Score, at.TimeTaken.Seconds(),
+		f.Streak, f.AccuracyRate, f.AvgTimePerQuestion, f.QuestionsAnswered, at.NextDifficulty, at.Points)
+	if err != nil {
+		return fmt.Errorf("insert attempt: %w", err)
+	}
+	return nil
+}
+
+// trainingColumns is the header of backend/ml/data/synthetic_user_data.csv.
+var trainingColumns = []string{
+	"user_id", "topic", "current_difficulty", "accuracy_rate", "streak",
+	"avg_time_per_question", "questions_answered", "next_difficulty",
+}
+
+// exportAttempts writes every attempt as training data. User IDs are
+// replaced by a keyed hash, so rows from one student stay grouped but can't
+// be traced back without the key.
+func exportAttempts(ctx context.Context, db *sql.DB, w io.Writer, key []byte) error {
+	rows, err := db.QueryContext(ctx, `SELECT UserID, Topic, Difficulty, AccuracyRate, Streak, AvgTimePerQuestion, QuestionsAnswered, NextDifficulty
+		FROM attempts ORDER BY UserID, ID`)
+	if err != nil {
+		return fmt.Errorf("select attempts: %w", err)
+	}
+	defer rows.Close()
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(trainingColumns); err != nil {
+		return err
+	}
+	for rows.Next() {
+		var uid int64
+		var f DifficultyFeatures
+		var next int
+		if err := rows.Scan(&uid, &f.Topic, &f.CurrentDifficulty, &f.AccuracyRate, &f.Streak, &f.AvgTimePerQuestion, &f.QuestionsAnswered, &next); err != nil {
+			return fmt.Errorf("scan attempt: %w", err)
+		}
+		err := cw.Write([]string{
+			strconv.FormatUint(pseudonym(key, uid), 10),
+			f.Topic,
+			strconv.Itoa(f.CurrentDifficulty),
+			strconv.FormatFloat(f.AccuracyRate, 'f', -1, 64),
+			strconv.Itoa(f.Streak),
+			strconv.FormatFloat(f.AvgTimePerQuestion, 'f', -1, 64),
+			strconv.Itoa(f.QuestionsAnswered),
+			strconv.Itoa(next),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("read attempts: %w", err)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// pseudonym is the first 48 bits of HMAC-SHA256(key, userID), which keeps
+// the export's user_id column an integer like the synthetic data's.
+func pseudonym(key []byte, userID int64) uint64 {
+	mac := hmac.New(sha256.New, key)
+	_ = binary.Write(mac, binary.BigEndian, userID)
+	sum := mac.Sum(nil)
+	return binary.BigEndian.Uint64(sum[:8]) >> 16
+}
+
+// runExportAttempts implements `api export-attempts [file]`, writing to
+// stdout when no file is given. EXPORT_PSEUDONYM_KEY keeps user IDs stable
+// across exports; without it a random key is used.
+func runExportAttempts(ctx context.Context, args []string) error {
+	key := []byte(os.Getenv("EXPORT_PSEUDONYM_KEY"))
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		log.Println("EXPORT_PSEUDONYM_KEY not set; user IDs will differ between exports")
+	}
+
+	db, err := InitDB(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot access db: %w", err)
+	}
+	defer db.Close()
+
+	out := io.Writer(os.Stdout)
+	if len(args) > 0 {
+		f, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	return exportAttempts(ctx, db, out, key)
+}
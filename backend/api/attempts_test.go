@@ -0,0 +1,25 @@
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"slices"
+	"testing"
+)
+
+// The trainer reads exports and the committed CSV alike, so their headers
+// must agree.
+func TestTrainingColumnsMatchCSV(t *testing.T) {
+	f, err := os.Open("../ml/data/synthetic_user_data.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	header, err := csv.NewReader(f).Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(header, trainingColumns) {
+		t.Errorf("export header %q, CSV header %q", trainingColumns, header)
+	}
+}
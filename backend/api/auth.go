@@ -2,17 +2,12 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
 	"database/sql"
-	"encoding/hex"
 	"encoding/json"
-	"fmt"
 	"log"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
@@ -25,6 +20,11 @@ type signInReq struct {
 	Username string `json:"username"`
 	Pwd      string `json:"pwd"`
 	Grade    string `json:"grade"`
+	// Email is optional; it is needed to reset a forgotten password.
+	Email string `json:"email"`
+	// Role is "student" (the default) or "guardian". Guardians have no
+	// grade and need an email, which they verify before linking students.
+	Role string `json:"role"`
 }
 
 func (a *App) Signup(w http.ResponseWriter, r *http.Request) {
@@ -40,21 +40,60 @@ func (a *App) Signup(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "username invalid", http.StatusBadRequest)
 		return
 	}
-	// grade := vars["grade"]
-	gradeInt, err := strconv.Atoi(req.Grade)
+	role := RoleStudent
+	var grade sql.NullInt64
+	switch req.Role {
+	case "", RoleStudent:
+		// grade := vars["grade"]
+		gradeInt, err := strconv.Atoi(req.Grade)
+		if err != nil {
+			http.Error(w, "atoi failure", http.StatusInternalServerError)
+			return
+		}
+		if gradeInt < 0 || gradeInt > 12 {
+			http.Error(w, "grade out of bounds", http.StatusBadRequest)
+			return
+		}
+		grade = sql.NullInt64{Int64: int64(gradeInt), Valid: true}
+	case RoleGuardian:
+		role = RoleGuardian
+	default:
+		http.Error(w, "role invalid", http.StatusBadRequest)
+		return
+	}
+	email, err := normalizeEmail(req.Email)
 	if err != nil {
-		http.Error(w, "atoi failure", http.StatusInternalServerError)
+		http.Error(w, "email invalid", http.StatusBadRequest)
+		return
+	}
+	if role == RoleGuardian && email == "" {
+		http.Error(w, "guardians need an email", http.StatusBadRequest)
 		return
 	}
-	if gradeInt < 0 || gradeInt > 12 {
-		http.Error(w, "grade out of bounds", http.StatusBadRequest)
+	// a child's email is only collected once a guardian consents
+	if role == RoleStudent && isChild(grade) && email != "" {
+		http.Error(w, "email needs a guardian's consent at this grade", http.StatusBadRequest)
 		return
 	}
 	// pwd := vars["pwd"]
-	h := sha256.Sum256([]byte(req.Pwd))
-	hashed := hex.EncodeToString(h[:])
+	hashed, err := hashPassword(req.Pwd)
+	if err != nil {
+		log.Printf("signup hash error: %v", err)
+		http.Error(w, "failed to create user", http.StatusInternalServerError)
+		return
+	}
 
-	res, err := a.DB.ExecContext(ctx, "INSERT INTO users (Username, Score, grade, questionsAnswered) VALUES (?, 100, ?, 0)", req.Username, req.Grade)
+	// the user, its password and its role are created together, so a failed
+	// insert never leaves an account that can't log in
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("signup begin error: %v", err)
+		http.Error(w, "failed to create user", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "INSERT INTO users (Username, Score, grade, questionsAnswered, Email) VALUES (?, 100, ?, 0, NULLIF(?, ''))", req.Username, grade, email)
 	if err != nil {
 		log.Printf("signup insert user error: %v", err)
 		http.Error(w, "failed to create user", http.StatusInternalServerError)
@@ -63,7 +102,7 @@ func (a *App) Signup(w http.ResponseWriter, r *http.Request) {
 	uid, err := res.LastInsertId()
 	if err != nil {
 		var id int64
-		err2 := a.DB.QueryRowContext(ctx, "SELECT ID FROM users WHERE username=? LIMIT 1", req.Username).Scan(&id)
+		err2 := tx.QueryRowContext(ctx, "SELECT ID FROM users WHERE username=? LIMIT 1", req.Username).Scan(&id)
 		if err2 != nil {
 			log.Printf("signup get id error: %v, %v", err, err2)
 			http.Error(w, "failed to create user", http.StatusInternalServerError)
@@ -72,12 +111,26 @@ func (a *App) Signup(w http.ResponseWriter, r *http.Request) {
 		uid = id
 	}
 
-	_, err = a.DB.ExecContext(ctx, "INSERT INTO auth (userID, Hash) VALUES (?, ?)", uid, hashed)
+	_, err = tx.ExecContext(ctx, "INSERT INTO auth (userID, Hash) VALUES (?, ?)", uid, hashed)
 	if err != nil {
 		log.Printf("signup insert auth error: %v", err)
 		http.Error(w, "failed to create auth record", http.StatusInternalServerError)
 		return
 	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO user_roles (UserID, Role) VALUES (?, ?)", uid, role)
+	if err != nil {
+		log.Printf("signup insert role error: %v", err)
+		http.Error(w, "failed to create user", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("signup commit error: %v", err)
+		http.Error(w, "failed to create user", http.StatusInternalServerError)
+		return
+	}
+	if email != "" {
+		go a.sendVerification(uid, req.Username, email)
+	}
 
 	w.WriteHeader(http.StatusCreated)
 	w.Write([]byte("created"))
@@ -100,13 +153,16 @@ func (a *App) Login(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "missing username or password", http.StatusBadRequest)
 		return
 	}
+	if !a.Limiter.checkLogin(w, r, req.Username) {
+		return
+	}
 
-	h := sha256.Sum256([]byte(req.Pwd))
-	hashed := hex.EncodeToString(h[:])
 	var id int64
 	err := a.DB.QueryRowContext(ctx, "SELECT ID FROM users WHERE Username=? LIMIT 1", req.Username).Scan(&id)
 	if err != nil {
 		if err == sql.ErrNoRows {
+			verifyPassword(req.Pwd, dummyHash())
+			a.Limiter.loginFailed(ctx, req.Username)
 			http.Error(w, "invalid credentials", http.StatusUnauthorized)
 			return
 		}
@@ -119,6 +175,8 @@ func (a *App) Login(w http.ResponseWriter, r *http.Request) {
 	err = a.DB.QueryRowContext(ctx, "SELECT Hash FROM auth WHERE userID=? LIMIT 1", id).Scan(&stored)
 	if err != nil {
 		if err == sql.ErrNoRows {
+			// accounts from an identity provider have no password
+			verifyPassword(req.Pwd, dummyHash())
 			http.Error(w, "invalid credentials", http.StatusUnauthorized)
 			return
 		}
@@ -127,63 +185,92 @@ func (a *App) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if len(hashed) < 32 || stored != hashed[:32] {
-		http.Error(w, "login failed", http.StatusUnauthorized)
-		return
+	ok, rehash, err := verifyPassword(req.Pwd, stored)
+	if err != nil {
+		log.Printf("verify password error for user %d: %v", id, err)
 	}
-
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		secret = "dev-secret"
+	if !ok {
+		a.Limiter.loginFailed(ctx, req.Username)
+		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		return
 	}
-	claims := jwt.MapClaims{
-		"sub": id,
-		"exp": time.Now().Add(24 * time.Hour).Unix(),
+	a.Limiter.loginSucceeded(ctx, req.Username)
+	if rehash {
+		a.upgradeHash(ctx, id, req.Pwd, stored)
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	signed, err := token.SignedString([]byte(secret))
+
+	resp, err := a.issueTokens(ctx, a.DB, id, "")
 	if err != nil {
-		log.Printf("token sign error: %v", err)
+		log.Printf("token issue error: %v", err)
 		http.Error(w, "failed to create token", http.StatusInternalServerError)
 		return
 	}
+	writeJSON(w, http.StatusOK, resp)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	_ = json.NewEncoder(w).Encode(map[string]string{"token": signed})
+// upgradeHash replaces a legacy or outdated hash after a successful login.
+// It only logs failures, since the old hash still works.
+func (a *App) upgradeHash(ctx context.Context, id int64, pwd, old string) {
+	hashed, err := hashPassword(pwd)
+	if err != nil {
+		log.Printf("rehash error: %v", err)
+		return
+	}
+	// only replace the hash that was verified, in case it changed meanwhile
+	_, err = a.DB.ExecContext(ctx, "UPDATE auth SET Hash=? WHERE userID=? AND Hash=?", hashed, id, old)
+	if err != nil {
+		log.Printf("update hash error: %v", err)
+	}
 }
 
-func Auth(next http.Handler) http.Handler {
+// Auth checks the bearer access token and that it hasn't been revoked.
+func (a *App) Auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		auth := r.Header.Get("Authorization")
-		if auth == "" {
-			http.Error(w, "missing Authorization header", http.StatusUnauthorized)
-			return
-		}
-		parts := strings.SplitN(auth, " ", 2)
-		if len(parts) != 2 || parts[0] != "Bearer" {
-			http.Error(w, "invalid Authorization header", http.StatusUnauthorized)
-			return
-		}
-		tokenStr := parts[1]
-
-		secret := os.Getenv("JWT_SECRET")
-		if secret == "" {
-			secret = "dev-secret"
-		}
-
-		parsed, err := jwt.Parse(tokenStr, func(t *jwt.Token) (any, error) {
-			if t.Method.Alg() != jwt.SigningMethodHS256.Alg() {
-				return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
-			}
-			return []byte(secret), nil
-		})
-		if err != nil || !parsed.Valid {
-			http.Error(w, "invalid token", http.StatusUnauthorized)
+		claims, ok := a.authenticate(w, r)
+		if !ok {
 			return
 		}
-
-		ctx := context.WithValue(r.Context(), claimsKey, parsed.Claims)
+		ctx := context.WithValue(r.Context(), claimsKey, claims)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// authenticate returns the claims of r's bearer token, or writes the error
+// and returns false.
+func (a *App) authenticate(w http.ResponseWriter, r *http.Request) (*Claims, bool) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		http.Error(w, "missing Authorization header", http.StatusUnauthorized)
+		return nil, false
+	}
+	parts := strings.SplitN(auth, " ", 2)
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		http.Error(w, "invalid Authorization header", http.StatusUnauthorized)
+		return nil, false
+	}
+	tokenStr := parts[1]
+
+	claims := &Claims{}
+	parsed, err := jwt.ParseWithClaims(tokenStr, claims, a.Keys.keyFunc)
+	if err != nil || !parsed.Valid {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return nil, false
+	}
+	uid, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || claims.ID == "" {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return nil, false
+	}
+	claims.UserID = uid
+	revoked, err := a.Revoked.IsRevoked(r.Context(), claims.ID)
+	if err != nil {
+		log.Printf("revocation check error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if revoked {
+		http.Error(w, "token revoked", http.StatusUnauthorized)
+		return nil, false
+	}
+	return claims, true
+}
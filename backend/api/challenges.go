@@ -0,0 +1,778 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Challenge statuses. A challenge is generating until its questions exist,
+// then pending until the opponent accepts; the challenger may play while
+// it is pending. It finishes once both have answered everything, or at
+// expiry when only one has.
+const (
+	challengeGenerating = "generating"
+	challengePending    = "pending"
+	challengeActive     = "active"
+	challengeFinished   = "finished"
+	challengeDeclined   = "declined"
+	challengeCancelled  = "cancelled"
+	challengeExpired    = "expired"
+	challengeFailed     = "failed"
+
+	openChallengeStatuses = "('" + challengeGenerating + "', '" + challengePending + "', '" + challengeActive + "')"
+
+	defaultChallengeQuestions = 5
+	maxChallengeQuestions     = 10
+	// challengeGenTimeout bounds generating all of a challenge's questions.
+	challengeGenTimeout = 5 * time.Minute
+)
+
+var (
+	// challengeTTL is how long both players have to finish, so a friend
+	// who is offline can still answer later.
+	challengeTTL = time.Duration(envFloat("CHALLENGE_TTL_HOURS", 48) * float64(time.Hour))
+	// challengeWinPoints is added to the winner's leaderboard score; a draw
+	// splits it.
+	challengeWinPoints = int(envFloat("CHALLENGE_WIN_POINTS", 50))
+)
+
+var (
+	errChallengeNotFound   = errors.New("challenge not found")
+	errChallengeClosed     = errors.New("challenge is not open")
+	errChallengeNotStarted = errors.New("start the challenge first")
+	errNotInChallenge      = errors.New("question is not part of this challenge")
+	errAlreadyAnswered     = errors.New("question already answered")
+)
+
+// writeChallengeError answers a failed challenge action.
+func writeChallengeError(w http.ResponseWriter, err error) {
+	switch err {
+	case errChallengeNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errNotInChallenge:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errChallengeClosed, errChallengeNotStarted, errAlreadyAnswered:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Printf("challenge error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	}
+}
+
+// CreateChallenge challenges a friend, by user_id or username, to answer
+// the same questions on a topic. The questions are generated in the
+// background at the lower of the two players' difficulties on the topic,
+// so the response only has the challenge ID; it is pending once they are
+// ready.
+func (a *App) CreateChallenge(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	c, _ := ClaimsFromContext(ctx)
+	var req struct {
+		UserID    int64  `json:"user_id"`
+		Username  string `json:"username"`
+		Topic     string `json:"topic"`
+		Questions int    `json:"questions"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	req.Topic = strings.TrimSpace(req.Topic)
+	if req.Topic == "" || len(req.Topic) > 255 {
+		http.Error(w, "Missing input field", http.StatusBadRequest)
+		return
+	}
+	if req.Questions == 0 {
+		req.Questions = defaultChallengeQuestions
+	}
+	if req.Questions < 1 || req.Questions > maxChallengeQuestions {
+		http.Error(w, "questions must be 1-"+strconv.Itoa(maxChallengeQuestions), http.StatusBadRequest)
+		return
+	}
+	if req.UserID == 0 && req.Username != "" {
+		id, err := findVisibleUser(ctx, a.DB, c.UserID, req.Username)
+		if err != nil {
+			writeFriendError(w, err)
+			return
+		}
+		req.UserID = id
+	}
+	if req.UserID == 0 || req.UserID == c.UserID {
+		http.Error(w, "invalid user ID", http.StatusBadRequest)
+		return
+	}
+	if err := befriendable(ctx, a.DB, c.UserID, req.UserID); err != nil {
+		writeFriendError(w, err)
+		return
+	}
+	var friends int
+	err := a.DB.QueryRowContext(ctx, "SELECT 1 FROM friends WHERE ID1=? AND ID2=?", c.UserID, req.UserID).Scan(&friends)
+	if err == sql.ErrNoRows {
+		http.Error(w, "you can only challenge friends", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Printf("challenge select friend error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	grade, err := a.userGrade(ctx, c.UserID)
+	if err == errNoGrade {
+		http.Error(w, "set your grade first", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("challenge grade lookup error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	difficulty, err := a.Difficulty.Current(ctx, c.UserID, req.Topic)
+	if err != nil {
+		log.Printf("challenge difficulty lookup error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	theirs, err := a.Difficulty.Current(ctx, req.UserID, req.Topic)
+	if err != nil {
+		log.Printf("challenge difficulty lookup error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	id, err := a.insertChallenge(ctx, c.UserID, req.UserID, req.Topic, req.Questions)
+	if err != nil {
+		log.Printf("create challenge error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	go a.generateChallenge(id, req.Questions, Question{
+		UserID:        c.UserID,
+		Topic:         req.Topic,
+		Grade:         grade,
+		Difficulty:    min(difficulty, theirs),
+		PromptVersion: genPromptVersion,
+		Model:         a.Model.ModelID(),
+	})
+	writeJSON(w, http.StatusAccepted, map[string]any{"id": id, "status": challengeGenerating})
+}
+
+func (a *App) insertChallenge(ctx context.Context, challenger, opponent int64, topic string, n int) (int64, error) {
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx,
+		"INSERT INTO challenges (ChallengerID, OpponentID, Topic, QuestionCount, Status, ExpiresAt) VALUES (?, ?, ?, ?, ?, ?)",
+		challenger, opponent, topic, n, challengeGenerating, time.Now().Add(challengeTTL))
+	if err != nil {
+		return 0, fmt.Errorf("insert challenge: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("challenge id: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO challenge_players (ChallengeID, UserID) VALUES (?, ?), (?, ?)", id, challenger, id, opponent)
+	if err != nil {
+		return 0, fmt.Errorf("insert players: %w", err)
+	}
+	return id, tx.Commit()
+}
+
+// generateChallenge generates a challenge's questions from tmpl as Gen
+// would and opens it. A challenge that can't be generated fails; one left
+// generating by a restart fails when it expires.
+func (a *App) generateChallenge(id int64, n int, tmpl Question) {
+	ctx, cancel := context.WithTimeout(context.Background(), challengeGenTimeout)
+	defer cancel()
+
+	status := challengePending
+	for i := range n {
+		q := tmpl
+		if err := a.generateQuestion(ctx, &q); err != nil {
+			log.Printf("challenge %d generate error: %v", id, err)
+			status = challengeFailed
+			break
+		}
+		if _, err := a.DB.ExecContext(ctx, "INSERT INTO challenge_questions (ChallengeID, Position, QuestionID) VALUES (?, ?, ?)",
+			id, i, q.ID); err != nil {
+			log.Printf("challenge %d insert question error: %v", id, err)
+			status = challengeFailed
+			break
+		}
+	}
+	// it may have been declined or cancelled meanwhile, and ctx may have
+	// run out
+	_, err := a.DB.ExecContext(context.Background(), "UPDATE challenges SET Status=? WHERE ID=? AND Status=?", status, id, challengeGenerating)
+	if err != nil {
+		log.Printf("challenge %d update status error: %v", id, err)
+	}
+}
+
+// challengeAction moves challenge {id} from one of the from statuses to
+// to, when the caller is the player in column who. Otherwise it answers
+// 404, or 409 when the challenge is the caller's but not in a from status.
+func (a *App) challengeAction(w http.ResponseWriter, r *http.Request, who, to string, from ...string) {
+	ctx := r.Context()
+	c, _ := ClaimsFromContext(ctx)
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid challenge ID", http.StatusBadRequest)
+		return
+	}
+	query := "UPDATE challenges SET Status=? WHERE ID=? AND " + who + "=? AND ExpiresAt > NOW() AND Status IN (?" + strings.Repeat(", ?", len(from)-1) + ")"
+	args := []any{to, id, c.UserID}
+	for _, s := range from {
+		args = append(args, s)
+	}
+	res, err := a.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		log.Printf("challenge %s error: %v", to, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		var exists int
+		err := a.DB.QueryRowContext(ctx, "SELECT 1 FROM challenges WHERE ID=? AND "+who+"=?", id, c.UserID).Scan(&exists)
+		if err == sql.ErrNoRows {
+			writeChallengeError(w, errChallengeNotFound)
+			return
+		}
+		writeChallengeError(w, errChallengeClosed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AcceptChallenge accepts challenge {id}, letting the caller play it.
+func (a *App) AcceptChallenge(w http.ResponseWriter, r *http.Request) {
+	a.challengeAction(w, r, "OpponentID", challengeActive, challengePending)
+}
+
+// DeclineChallenge declines challenge {id}.
+func (a *App) DeclineChallenge(w http.ResponseWriter, r *http.Request) {
+	a.challengeAction(w, r, "OpponentID", challengeDeclined, challengeGenerating, challengePending)
+}
+
+// CancelChallenge withdraws the caller's challenge {id} before it is
+// accepted.
+func (a *App) CancelChallenge(w http.ResponseWriter, r *http.Request) {
+	a.challengeAction(w, r, "ChallengerID", challengeCancelled, challengeGenerating, challengePending)
+}
+
+// playable reports whether uid may answer a challenge: the challenger
+// once it is generated, the opponent once they accept, until it expires.
+func playable(status string, challenger, uid int64, expires time.Time) bool {
+	if time.Now().After(expires) {
+		return false
+	}
+	return status == challengeActive || (status == challengePending && uid == challenger)
+}
+
+type challengeQuestion struct {
+	*Question
+	Answered bool `json:"answered"`
+}
+
+// StartChallenge starts the caller's clock on challenge {id}, if it isn't
+// running already, and returns its questions. Answers go to /eval with the
+// challenge_id.
+func (a *App) StartChallenge(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	c, _ := ClaimsFromContext(ctx)
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid challenge ID", http.StatusBadRequest)
+		return
+	}
+	var status string
+	var challenger int64
+	var expires time.Time
+	err = a.DB.QueryRowContext(ctx, `SELECT c.Status, c.ChallengerID, c.ExpiresAt FROM challenges c
+		JOIN challenge_players p ON p.ChallengeID = c.ID AND p.UserID=? WHERE c.ID=?`, c.UserID, id).Scan(&status, &challenger, &expires)
+	if err == sql.ErrNoRows {
+		writeChallengeError(w, errChallengeNotFound)
+		return
+	}
+	if err != nil {
+		writeChallengeError(w, err)
+		return
+	}
+	if !playable(status, challenger, c.UserID, expires) {
+		writeChallengeError(w, errChallengeClosed)
+		return
+	}
+	_, err = a.DB.ExecContext(ctx, "UPDATE challenge_players SET StartedAt=NOW() WHERE ChallengeID=? AND UserID=? AND StartedAt IS NULL", id, c.UserID)
+	if err != nil {
+		writeChallengeError(w, err)
+		return
+	}
+
+	rows, err := a.DB.QueryContext(ctx, `SELECT q.ID, q.Topic, q.Grade, q.Difficulty, q.QuestionLatex,
+		EXISTS (SELECT 1 FROM challenge_answers ca WHERE ca.ChallengeID = cq.ChallengeID AND ca.UserID=? AND ca.QuestionID = q.ID)
+		FROM challenge_questions cq JOIN questions q ON q.ID = cq.QuestionID
+		WHERE cq.ChallengeID=? ORDER BY cq.Position`, c.UserID, id)
+	if err != nil {
+		writeChallengeError(w, err)
+		return
+	}
+	defer rows.Close()
+	questions := []challengeQuestion{}
+	for rows.Next() {
+		cq := challengeQuestion{Question: &Question{}}
+		if err := rows.Scan(&cq.ID, &cq.Topic, &cq.Grade, &cq.Difficulty, &cq.QuestionLatex, &cq.Answered); err != nil {
+			writeChallengeError(w, err)
+			return
+		}
+		questions = append(questions, cq)
+	}
+	if err := rows.Err(); err != nil {
+		writeChallengeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"id": id, "questions": questions})
+}
+
+// playsChallengeWith reports whether uid plays a challenge that includes
+// question qid; with open set, only a challenge still open counts.
+func playsChallengeWith(ctx context.Context, db dbtx, uid, qid int64, open bool) (bool, error) {
+	query := `SELECT 1 FROM challenge_questions cq
+		JOIN challenge_players p ON p.ChallengeID = cq.ChallengeID AND p.UserID=?
+		JOIN challenges c ON c.ID = cq.ChallengeID WHERE cq.QuestionID=?`
+	if open {
+		query += " AND c.Status IN " + openChallengeStatuses
+	}
+	var ok int
+	err := db.QueryRowContext(ctx, query+" LIMIT 1", uid, qid).Scan(&ok)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("select challenge question: %w", err)
+	}
+	return true, nil
+}
+
+// checkChallengeAnswer returns nil when uid may answer question qid in
+// challenge id now. lock locks the challenge for recording the answer.
+func checkChallengeAnswer(ctx context.Context, db dbtx, id, uid, qid int64, lock bool) error {
+	query := `SELECT c.Status, c.ChallengerID, c.ExpiresAt, p.StartedAt IS NOT NULL,
+		EXISTS (SELECT 1 FROM challenge_questions cq WHERE cq.ChallengeID = c.ID AND cq.QuestionID=?),
+		EXISTS (SELECT 1 FROM challenge_answers ca WHERE ca.ChallengeID = c.ID AND ca.UserID = p.UserID AND ca.QuestionID=?)
+		FROM challenges c JOIN challenge_players p ON p.ChallengeID = c.ID AND p.UserID=? WHERE c.ID=?`
+	if lock {
+		query += " FOR UPDATE"
+	}
+	var status string
+	var challenger int64
+	var expires time.Time
+	var started, inChallenge, answered bool
+	err := db.QueryRowContext(ctx, query, qid, qid, uid, id).Scan(&status, &challenger, &expires, &started, &inChallenge, &answered)
+	if err == sql.ErrNoRows {
+		return errChallengeNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("select challenge: %w", err)
+	}
+	switch {
+	case !playable(status, challenger, uid, expires):
+		return errChallengeClosed
+	case !started:
+		return errChallengeNotStarted
+	case !inChallenge:
+		return errNotInChallenge
+	case answered:
+		return errAlreadyAnswered
+	}
+	return nil
+}
+
+// recordChallengeAnswer adds a graded answer to uid's challenge score and
+// settles the challenge once both players have answered everything.
+func (a *App) recordChallengeAnswer(ctx context.Context, id, uid, qid int64, result *EvalResult) error {
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+	// grading took a while; the challenge may have closed since
+	if err := checkChallengeAnswer(ctx, tx, id, uid, qid, true); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO challenge_answers (ChallengeID, UserID, QuestionID, Correct, Score) VALUES (?, ?, ?, ?, ?)",
+		id, uid, qid, result.Correct, result.Score)
+	if err != nil {
+		return fmt.Errorf("insert answer: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE challenge_players SET Answered = Answered + 1, Score = Score + ?, LastAnswerAt=NOW()
+		WHERE ChallengeID=? AND UserID=?`, result.Score, id, uid)
+	if err != nil {
+		return fmt.Errorf("update player: %w", err)
+	}
+	var remaining int
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM challenge_players p JOIN challenges c ON c.ID = p.ChallengeID
+		WHERE p.ChallengeID=? AND p.Answered < c.QuestionCount`, id).Scan(&remaining)
+	if err != nil {
+		return fmt.Errorf("count unfinished players: %w", err)
+	}
+	var awards map[int64]int
+	if remaining == 0 {
+		if awards, err = settleChallenge(ctx, tx, id); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	a.publishAwards(awards)
+	return nil
+}
+
+func (a *App) publishAwards(awards map[int64]int) {
+	for uid, points := range awards {
+		if points > 0 {
+			a.Hub.Publish(uid, points)
+		}
+	}
+}
+
+// challengePlayer is one player's progress in a challenge.
+type challengePlayer struct {
+	UserID    int64
+	Answered  int
+	Score     float64
+	TimeTaken time.Duration
+}
+
+// challengeWinner decides a challenge between players who answered n
+// questions each: the higher score wins, then the faster time. Someone who
+// didn't answer everything loses to someone who did. decided is false when
+// neither finished; a draw is decided with no winner.
+func challengeWinner(players []challengePlayer, n int) (winner int64, decided bool) {
+	var done []challengePlayer
+	for _, p := range players {
+		if p.Answered >= n {
+			done = append(done, p)
+		}
+	}
+	switch len(done) {
+	case 0:
+		return 0, false
+	case 1:
+		return done[0].UserID, true
+	}
+	x, y := done[0], done[1]
+	// scores are sums of fractional criterion points, so nearly equal
+	// ones are a tie
+	switch diff := x.Score - y.Score; {
+	case diff >= 0.005:
+		return x.UserID, true
+	case diff <= -0.005:
+		return y.UserID, true
+	case x.TimeTaken < y.TimeTaken:
+		return x.UserID, true
+	case y.TimeTaken < x.TimeTaken:
+		return y.UserID, true
+	}
+	return 0, true
+}
+
+// settleChallenge decides challenge id, which the caller has locked, and
+// awards the winner's points, or half each for a draw. A challenge nobody
+// finished just expires. It returns the points awarded by user.
+func settleChallenge(ctx context.Context, tx *sql.Tx, id int64) (map[int64]int, error) {
+	var n int
+	if err := tx.QueryRowContext(ctx, "SELECT QuestionCount FROM challenges WHERE ID=?", id).Scan(&n); err != nil {
+		return nil, fmt.Errorf("select challenge: %w", err)
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT UserID, Answered, Score,
+		COALESCE(TIMESTAMPDIFF(SECOND, StartedAt, LastAnswerAt), 0) FROM challenge_players WHERE ChallengeID=?`, id)
+	if err != nil {
+		return nil, fmt.Errorf("select players: %w", err)
+	}
+	var players []challengePlayer
+	for rows.Next() {
+		var p challengePlayer
+		var secs int64
+		if err := rows.Scan(&p.UserID, &p.Answered, &p.Score, &secs); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan player: %w", err)
+		}
+		p.TimeTaken = time.Duration(secs) * time.Second
+		players = append(players, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("select players: %w", err)
+	}
+
+	winner, decided := challengeWinner(players, n)
+	if !decided {
+		_, err := tx.ExecContext(ctx, "UPDATE challenges SET Status=?, FinishedAt=NOW() WHERE ID=?", challengeExpired, id)
+		if err != nil {
+			return nil, fmt.Errorf("expire challenge: %w", err)
+		}
+		return nil, nil
+	}
+	awards := map[int64]int{}
+	for _, p := range players {
+		switch {
+		case winner == p.UserID:
+			awards[p.UserID] = challengeWinPoints
+		case winner == 0:
+			awards[p.UserID] = challengeWinPoints / 2
+		}
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE challenges SET Status=?, FinishedAt=NOW(), WinnerID=? WHERE ID=?",
+		challengeFinished, sql.NullInt64{Int64: winner, Valid: winner != 0}, id)
+	if err != nil {
+		return nil, fmt.Errorf("finish challenge: %w", err)
+	}
+	for uid, points := range awards {
+		if _, err := tx.ExecContext(ctx, "UPDATE challenge_players SET Points=? WHERE ChallengeID=? AND UserID=?", points, id, uid); err != nil {
+			return nil, fmt.Errorf("update player points: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE users SET Score = Score + ? WHERE ID=?", points, uid); err != nil {
+			return nil, fmt.Errorf("update score: %w", err)
+		}
+	}
+	return awards, nil
+}
+
+// runChallengeExpiry closes expired challenges every interval. Accepted
+// ones are settled on what was answered; the rest just expire, or fail if
+// their questions never finished generating.
+func (a *App) runChallengeExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for status, to := range map[string]string{challengePending: challengeExpired, challengeGenerating: challengeFailed} {
+				_, err := a.DB.ExecContext(ctx, "UPDATE challenges SET Status=? WHERE Status=? AND ExpiresAt <= NOW()", to, status)
+				if err != nil {
+					log.Printf("expire %s challenges error: %v", status, err)
+				}
+			}
+			rows, err := a.DB.QueryContext(ctx, "SELECT ID FROM challenges WHERE Status=? AND ExpiresAt <= NOW() LIMIT 100", challengeActive)
+			if err != nil {
+				log.Printf("select expired challenges error: %v", err)
+				continue
+			}
+			var due []int64
+			for rows.Next() {
+				var id int64
+				if err := rows.Scan(&id); err == nil {
+					due = append(due, id)
+				}
+			}
+			rows.Close()
+			for _, id := range due {
+				if err := a.expireChallenge(ctx, id); err != nil {
+					log.Printf("expire challenge %d error: %v", id, err)
+				}
+			}
+		}
+	}
+}
+
+func (a *App) expireChallenge(ctx context.Context, id int64) error {
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+	var status string
+	if err := tx.QueryRowContext(ctx, "SELECT Status FROM challenges WHERE ID=? FOR UPDATE", id).Scan(&status); err != nil {
+		return fmt.Errorf("select challenge: %w", err)
+	}
+	// the last answer may have settled it meanwhile
+	if status != challengeActive {
+		return nil
+	}
+	awards, err := settleChallenge(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	a.publishAwards(awards)
+	return nil
+}
+
+// challengeView is a challenge as its players see it. The other player's
+// score and time stay hidden until it is over.
+type challengeView struct {
+	ID         int64                 `json:"id"`
+	Topic      string                `json:"topic"`
+	Questions  int                   `json:"questions"`
+	Status     string                `json:"status"`
+	Challenger challengeUser         `json:"challenger"`
+	Opponent   challengeUser         `json:"opponent"`
+	CreatedAt  time.Time             `json:"created_at"`
+	ExpiresAt  time.Time             `json:"expires_at"`
+	FinishedAt *time.Time            `json:"finished_at"`
+	WinnerID   *int64                `json:"winner_id"`
+	Players    []challengePlayerView `json:"players"`
+}
+
+type challengeUser struct {
+	UserID   int64  `json:"user_id"`
+	Username string `json:"username"`
+}
+
+type challengePlayerView struct {
+	UserID    int64    `json:"user_id"`
+	Started   bool     `json:"started"`
+	Answered  int      `json:"answered"`
+	Score     *float64 `json:"score"`
+	TimeTaken *int64   `json:"time_taken"`
+	Points    int      `json:"points"`
+}
+
+// listChallenges returns up to limit of uid's challenges matching cond,
+// newest first, with players filled in. Challenges between users who have
+// since blocked one another are left out.
+func listChallenges(ctx context.Context, db dbtx, uid int64, limit int, cond string, args ...any) ([]challengeView, error) {
+	rows, err := db.QueryContext(ctx, `SELECT c.ID, c.Topic, c.QuestionCount, c.Status, c.ChallengerID, cu.Username,
+		c.OpponentID, ou.Username, c.CreatedAt, c.ExpiresAt, c.FinishedAt, c.WinnerID
+		FROM challenges c JOIN users cu ON cu.ID = c.ChallengerID JOIN users ou ON ou.ID = c.OpponentID
+		WHERE (c.ChallengerID=? OR c.OpponentID=?)
+		AND NOT EXISTS (SELECT 1 FROM blocks b WHERE (b.BlockerID = c.ChallengerID AND b.BlockedID = c.OpponentID)
+			OR (b.BlockerID = c.OpponentID AND b.BlockedID = c.ChallengerID))
+		AND `+cond+` ORDER BY c.ID DESC LIMIT ?`, append(append([]any{uid, uid}, args...), limit)...)
+	if err != nil {
+		return nil, fmt.Errorf("select challenges: %w", err)
+	}
+	defer rows.Close()
+	views := []challengeView{}
+	byID := map[int64]int{}
+	for rows.Next() {
+		var v challengeView
+		var finished sql.NullTime
+		var winner sql.NullInt64
+		if err := rows.Scan(&v.ID, &v.Topic, &v.Questions, &v.Status, &v.Challenger.UserID, &v.Challenger.Username,
+			&v.Opponent.UserID, &v.Opponent.Username, &v.CreatedAt, &v.ExpiresAt, &finished, &winner); err != nil {
+			return nil, fmt.Errorf("scan challenge: %w", err)
+		}
+		if finished.Valid {
+			v.FinishedAt = &finished.Time
+		}
+		if winner.Valid {
+			v.WinnerID = &winner.Int64
+		}
+		v.Players = []challengePlayerView{}
+		byID[v.ID] = len(views)
+		views = append(views, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("select challenges: %w", err)
+	}
+	if len(views) == 0 {
+		return views, nil
+	}
+
+	ids := make([]any, 0, len(views))
+	for _, v := range views {
+		ids = append(ids, v.ID)
+	}
+	prows, err := db.QueryContext(ctx, `SELECT ChallengeID, UserID, StartedAt IS NOT NULL, Answered, Score,
+		COALESCE(TIMESTAMPDIFF(SECOND, StartedAt, LastAnswerAt), 0), Points
+		FROM challenge_players WHERE ChallengeID IN (?`+strings.Repeat(", ?", len(ids)-1)+`) ORDER BY ChallengeID, UserID`, ids...)
+	if err != nil {
+		return nil, fmt.Errorf("select challenge players: %w", err)
+	}
+	defer prows.Close()
+	for prows.Next() {
+		var id, secs int64
+		var score float64
+		var p challengePlayerView
+		if err := prows.Scan(&id, &p.UserID, &p.Started, &p.Answered, &score, &secs, &p.Points); err != nil {
+			return nil, fmt.Errorf("scan challenge player: %w", err)
+		}
+		v := &views[byID[id]]
+		if p.UserID == uid || v.Status == challengeFinished || v.Status == challengeExpired {
+			p.Score, p.TimeTaken = &score, &secs
+		}
+		v.Players = append(v.Players, p)
+	}
+	return views, prows.Err()
+}
+
+// Challenges lists the caller's challenges, route:
+// challenges?status=&limit=&cursor=. status is open (still being played
+// or waiting on someone), closed or all (the default). cursor is the
+// next_cursor of the previous page.
+func (a *App) Challenges(w http.ResponseWriter, r *http.Request) {
+	c, _ := ClaimsFromContext(r.Context())
+	params := r.URL.Query()
+	cond, args := "TRUE", []any{}
+	switch params.Get("status") {
+	case "", "all":
+	case "open":
+		cond = "c.Status IN " + openChallengeStatuses
+	case "closed":
+		cond = "c.Status NOT IN " + openChallengeStatuses
+	default:
+		http.Error(w, "status must be open, closed or all", http.StatusBadRequest)
+		return
+	}
+	limit, _, ok := pageParams(w, params.Get("limit"), "")
+	if !ok {
+		return
+	}
+	if raw := params.Get("cursor"); raw != "" {
+		before, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+		cond += " AND c.ID < ?"
+		args = append(args, before)
+	}
+	views, err := listChallenges(r.Context(), a.DB, c.UserID, limit+1, cond, args...)
+	if err != nil {
+		log.Printf("list challenges error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	resp := map[string]any{"challenges": views, "next_cursor": nil}
+	if len(views) > limit {
+		resp["challenges"] = views[:limit]
+		resp["next_cursor"] = strconv.FormatInt(views[limit-1].ID, 10)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Challenge returns one of the caller's challenges.
+func (a *App) Challenge(w http.ResponseWriter, r *http.Request) {
+	c, _ := ClaimsFromContext(r.Context())
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid challenge ID", http.StatusBadRequest)
+		return
+	}
+	views, err := listChallenges(r.Context(), a.DB, c.UserID, 1, "c.ID=?", id)
+	if err != nil {
+		log.Printf("get challenge error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if len(views) == 0 {
+		writeChallengeError(w, errChallengeNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, views[0])
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChallengeWinner(t *testing.T) {
+	player := func(uid int64, answered int, score float64, secs int) challengePlayer {
+		return challengePlayer{UserID: uid, Answered: answered, Score: score, TimeTaken: time.Duration(secs) * time.Second}
+	}
+	tests := []struct {
+		name        string
+		players     []challengePlayer
+		wantWinner  int64
+		wantDecided bool
+	}{
+		{"higher score wins", []challengePlayer{player(1, 3, 180, 60), player(2, 3, 250, 300)}, 2, true},
+		{"faster wins a tie", []challengePlayer{player(1, 3, 200, 90), player(2, 3, 200, 60)}, 2, true},
+		{"near-equal scores tie", []challengePlayer{player(1, 3, 200.001, 90), player(2, 3, 200, 60)}, 2, true},
+		{"same score and time draw", []challengePlayer{player(1, 3, 200, 60), player(2, 3, 200, 60)}, 0, true},
+		{"finishing beats a better partial score", []challengePlayer{player(1, 3, 10, 60), player(2, 2, 200, 30)}, 1, true},
+		{"nobody finished", []challengePlayer{player(1, 2, 150, 60), player(2, 0, 0, 0)}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			winner, decided := challengeWinner(tt.players, 3)
+			if winner != tt.wantWinner || decided != tt.wantDecided {
+				t.Errorf("challengeWinner = %d, %v; want %d, %v", winner, decided, tt.wantWinner, tt.wantDecided)
+			}
+		})
+	}
+}
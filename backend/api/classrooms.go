@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// userAccess is what a caller wants to do with another user's data.
+type userAccess int
+
+const (
+	// readUser is viewing their data, which teachers and guardians may do
+	// for their students.
+	readUser userAccess = iota
+	// actAsUser is changing it on their behalf, which only admins may do.
+	actAsUser
+)
+
+// canAccessUser reports whether the caller may access target's data. Anyone
+// may access their own and admins anyone's. Everyone else is decided
+// without a DB lookup except teachers and guardians reading their
+// students' data.
+func (a *App) canAccessUser(ctx context.Context, c *Claims, target int64, access userAccess) (bool, error) {
+	if c.UserID == target || c.HasRole(RoleAdmin) {
+		return true, nil
+	}
+	if access != readUser {
+		return false, nil
+	}
+	if c.HasRole(RoleGuardian) {
+		ok, err := isGuardianOf(ctx, a.DB, c.UserID, target)
+		if ok || err != nil {
+			return ok, err
+		}
+	}
+	if !c.HasRole(RoleTeacher) {
+		return false, nil
+	}
+	var ok int
+	err := a.DB.QueryRowContext(ctx, `SELECT 1 FROM classrooms c
+		JOIN classroom_members m ON m.ClassroomID = c.ID
+		WHERE c.TeacherID=? AND m.UserID=? LIMIT 1`, c.UserID, target).Scan(&ok)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("select classroom member: %w", err)
+	}
+	return true, nil
+}
+
+// authorizeUser resolves a user ID from a request ("me" is the caller) and
+// writes 403 when the caller may not access that user. Handlers scoped to a
+// user go through here rather than trusting IDs from the request.
+func (a *App) authorizeUser(w http.ResponseWriter, r *http.Request, raw string, access userAccess) (*Claims, int64, bool) {
+	c, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return nil, 0, false
+	}
+	if raw == "" || raw == "me" {
+		return c, c.UserID, true
+	}
+	target, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		http.Error(w, "invalid user ID", http.StatusBadRequest)
+		return nil, 0, false
+	}
+	allowed, err := a.canAccessUser(r.Context(), c, target, access)
+	if err != nil {
+		log.Printf("authorize user error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return nil, 0, false
+	}
+	if !allowed {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return nil, 0, false
+	}
+	return c, target, true
+}
+
+type classroom struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	TeacherID int64  `json:"teacher_id"`
+}
+
+// CreateClassroom creates a classroom taught by the caller.
+func (a *App) CreateClassroom(w http.ResponseWriter, r *http.Request) {
+	c, _ := ClaimsFromContext(r.Context())
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" || len(req.Name) > 100 {
+		http.Error(w, "name invalid", http.StatusBadRequest)
+		return
+	}
+	res, err := a.DB.ExecContext(r.Context(), "INSERT INTO classrooms (TeacherID, Name) VALUES (?, ?)", c.UserID, req.Name)
+	if err != nil {
+		log.Printf("create classroom error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	id, _ := res.LastInsertId()
+	writeJSON(w, http.StatusCreated, classroom{ID: id, Name: req.Name, TeacherID: c.UserID})
+}
+
+// classroomFor loads classroom id and checks the caller teaches it (or is
+// an admin).
+func (a *App) classroomFor(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	c, _ := ClaimsFromContext(r.Context())
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid classroom ID", http.StatusBadRequest)
+		return 0, false
+	}
+	var teacher int64
+	err = a.DB.QueryRowContext(r.Context(), "SELECT TeacherID FROM classrooms WHERE ID=?", id).Scan(&teacher)
+	if err == sql.ErrNoRows {
+		http.Error(w, "classroom not found", http.StatusNotFound)
+		return 0, false
+	}
+	if err != nil {
+		log.Printf("select classroom error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return 0, false
+	}
+	if teacher != c.UserID && !c.HasRole(RoleAdmin) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return 0, false
+	}
+	return id, true
+}
+
+// classroomInviteTTL is how long a classroom's join code works. One code
+// is shared with the whole class.
+const classroomInviteTTL = 14 * 24 * time.Hour
+
+// CreateClassroomInvite gives the caller a join code for one of their
+// classrooms. Students join by redeeming it, so nobody is enrolled without
+// taking part.
+func (a *App) CreateClassroomInvite(w http.ResponseWriter, r *http.Request) {
+	id, ok := a.classroomFor(w, r)
+	if !ok {
+		return
+	}
+	code, err := newInviteCode()
+	if err != nil {
+		log.Printf("classroom invite code error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	expires := time.Now().Add(classroomInviteTTL)
+	_, err = a.DB.ExecContext(r.Context(), "INSERT INTO classroom_invites (CodeHash, ClassroomID, ExpiresAt) VALUES (?, ?, ?)",
+		hashToken(code), id, expires)
+	if err != nil {
+		log.Printf("insert classroom invite error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]any{"code": code, "expires_at": expires.UTC().Format(time.RFC3339)})
+}
+
+// JoinClassroom adds the caller to the classroom whose join code they give.
+func (a *App) JoinClassroom(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	c, _ := ClaimsFromContext(ctx)
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, "missing code", http.StatusBadRequest)
+		return
+	}
+	var cl classroom
+	var expires time.Time
+	err := a.DB.QueryRowContext(ctx, `SELECT c.ID, c.Name, c.TeacherID, i.ExpiresAt FROM classroom_invites i
+		JOIN classrooms c ON c.ID = i.ClassroomID WHERE i.CodeHash=?`, hashToken(normalizeInviteCode(req.Code))).
+		Scan(&cl.ID, &cl.Name, &cl.TeacherID, &expires)
+	if err == sql.ErrNoRows || (err == nil && time.Now().After(expires)) {
+		http.Error(w, "invalid or expired code", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("select classroom invite error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	_, err = a.DB.ExecContext(ctx, "INSERT IGNORE INTO classroom_members (ClassroomID, UserID) VALUES (?, ?)", cl.ID, c.UserID)
+	if err != nil {
+		log.Printf("join classroom error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, cl)
+}
+
+// ClassroomMembers lists the students in one of the caller's classrooms.
+func (a *App) ClassroomMembers(w http.ResponseWriter, r *http.Request) {
+	id, ok := a.classroomFor(w, r)
+	if !ok {
+		return
+	}
+	rows, err := a.DB.QueryContext(r.Context(), `SELECT u.ID, u.Username, u.Score FROM classroom_members m
+		JOIN users u ON u.ID = m.UserID WHERE m.ClassroomID=? ORDER BY u.Username`, id)
+	if err != nil {
+		log.Printf("select classroom members error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	type member struct {
+		ID       int64  `json:"id"`
+		Username string `json:"username"`
+		Score    int    `json:"score"`
+	}
+	members := []member{}
+	for rows.Next() {
+		var m member
+		if err := rows.Scan(&m.ID, &m.Username, &m.Score); err != nil {
+			log.Printf("scan classroom member error: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		members = append(members, m)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("read classroom members error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, members)
+}
@@ -21,6 +21,7 @@ func InitDB(ctx context.Context) (*sql.DB, error) {
 	cfg.Net = "tcp"
 	cfg.Addr = "usersandfriends.cluster-csbvaawkysob.us-east-1.rds.amazonaws.com:3306"
 	cfg.DBName = "usersandfriends"
+	cfg.ParseTime = true
 	// fmt.Printf(cfg.FormatDSN())
 
     var err error
@@ -41,6 +42,11 @@ func InitDB(ctx context.Context) (*sql.DB, error) {
 	}
 	defer rows.Close()
 
+	if err := migrate(ctx, db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrate db: %w", err)
+	}
+
 	return db, nil
 }
 
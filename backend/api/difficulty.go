@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	minDifficulty     = 1
+	maxDifficulty     = 3
+	initialDifficulty = 1
+)
+
+// knownTopics are the topics in backend/ml/generate_data.py. Free-text topics
+// that mention one of them are tracked under it.
+var knownTopics = []string{"Algebra", "Computer Science", "Biology", "English", "History"}
+
+func canonicalTopic(topic string) string {
+	topic = strings.TrimSpace(topic)
+	lower := strings.ToLower(topic)
+	for _, t := range knownTopics {
+		if strings.Contains(lower, strings.ToLower(t)) {
+			return t
+		}
+	}
+	if len(topic) > 255 {
+		topic = topic[:255]
+	}
+	return topic
+}
+
+// DifficultyFeatures mirrors a row of synthetic_user_data.csv, minus the
+// user ID and label.
+type DifficultyFeatures struct {
+	Topic              string
+	CurrentDifficulty  int
+	AccuracyRate       float64
+	Streak             int
+	AvgTimePerQuestion float64
+	QuestionsAnswered  int
+}
+
+// DifficultyPolicy decides the difficulty of a student's next question.
+type DifficultyPolicy interface {
+	NextDifficulty(f DifficultyFeatures) int
+}
+
+// rulesPolicy is the policy generate_data.py labels its data with.
+type rulesPolicy struct{}
+
+func (rulesPolicy) NextDifficulty(f DifficultyFeatures) int {
+	switch {
+	case f.AccuracyRate > 0.85 && f.Streak >= 2 && f.CurrentDifficulty < maxDifficulty:
+		return f.CurrentDifficulty + 1
+	case f.AccuracyRate < 0.5 && f.CurrentDifficulty > minDifficulty:
+		return f.CurrentDifficulty - 1
+	default:
+		return f.CurrentDifficulty
+	}
+}
+
+// DifficultyService tracks each student's record per topic in
+// user_topic_stats and moves their difficulty as they answer.
+type DifficultyService struct {
+	db     *sql.DB
+	policy DifficultyPolicy
+}
+
+func NewDifficultyService(db *sql.DB, policy DifficultyPolicy) *DifficultyService {
+	return &DifficultyService{db: db, policy: policy}
+}
+
+// Current returns the difficulty the student's next question on topic
+// should have.
+func (s *DifficultyService) Current(ctx context.Context, userID int64, topic string) (int, error) {
+	var d int
+	err := s.db.QueryRowContext(ctx,
+		"SELECT CurrentDifficulty FROM user_topic_stats WHERE UserID=? AND Topic=?", userID, canonicalTopic(topic)).Scan(&d)
+	if err == sql.ErrNoRows {
+		return initialDifficulty, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("select difficulty: %w", err)
+	}
+	return d, nil
+}
+
+// Record adds an answered question to the student's stats, stores the
+// policy's next difficulty, awards leaderboard points and logs the attempt.
+// It fills in at's features, next difficulty and points. Only the first
+// attempt at a question counts toward stats and points; later ones are
+// logged against the stats as they stand, so answering the same question
+// again can't farm either.
+func (s *DifficultyService) Record(ctx context.Context, at *Attempt) error {
+	f := DifficultyFeatures{Topic: canonicalTopic(at.Topic), CurrentDifficulty: initialDifficulty}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	var correctAnswers int
+	var totalTime float64
+	err = tx.QueryRowContext(ctx,
+		"SELECT CurrentDifficulty, QuestionsAnswered, CorrectAnswers, Streak, TotalTime FROM user_topic_stats WHERE UserID=? AND Topic=? FOR UPDATE",
+		at.UserID, f.Topic).Scan(&f.CurrentDifficulty, &f.QuestionsAnswered, &correctAnswers, &f.Streak, &totalTime)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("select stats: %w", err)
+	}
+	first, err := firstAttempt(ctx, tx, at)
+	if err != nil {
+		return err
+	}
+
+	if first {
+		f.QuestionsAnswered++
+		totalTime += at.TimeTaken.Seconds()
+		if at.Correct {
+			correctAnswers++
+			f.Streak++
+		} else {
+			f.Streak = 0
+		}
+	}
+	if f.QuestionsAnswered > 0 {
+		f.AccuracyRate = float64(correctAnswers) / float64(f.QuestionsAnswered)
+		f.AvgTimePerQuestion = totalTime / float64(f.QuestionsAnswered)
+	}
+
+	next := f.CurrentDifficulty
+	if first {
+		next = clampDifficulty(s.policy.NextDifficulty(f))
+		_, err = tx.ExecContext(ctx, `INSERT INTO user_topic_stats
+			(UserID, Topic, CurrentDifficulty, QuestionsAnswered, CorrectAnswers, Streak, TotalTime)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE CurrentDifficulty=VALUES(CurrentDifficulty), QuestionsAnswered=VALUES(QuestionsAnswered),
+				CorrectAnswers=VALUES(CorrectAnswers), Streak=VALUES(Streak), TotalTime=VALUES(TotalTime)`,
+			at.UserID, f.Topic, next, f.QuestionsAnswered, correctAnswers, f.Streak, totalTime)
+		if err != nil {
+			return fmt.Errorf("upsert stats: %w", err)
+		}
+		if at.Points, err = awardPoints(ctx, tx, at); err != nil {
+			return err
+		}
+	}
+
+	at.Features, at.NextDifficulty = f, next
+	if err := insertAttempt(ctx, tx, at); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+// firstAttempt reports whether at is the user's first attempt at its
+// question.
+func firstAttempt(ctx context.Context, tx *sql.Tx, at *Attempt) (bool, error) {
+	var seen int
+	err := tx.QueryRowContext(ctx, "SELECT 1 FROM attempts WHERE UserID=? AND QuestionID=? LIMIT 1", at.UserID, at.QuestionID).Scan(&seen)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("select earlier attempt: %w", err)
+	}
+	return false, nil
+}
+
+// awardPoints adds a first attempt's score to the user's leaderboard score
+// and answer count.
+func awardPoints(ctx context.Context, tx *sql.Tx, at *Attempt) (int, error) {
+	points := int(math.Round(at.Score))
+	_, err := tx.ExecContext(ctx, "UPDATE users SET Score = Score + ?, questionsAnswered = questionsAnswered + 1 WHERE ID=?", points, at.UserID)
+	if err != nil {
+		return 0, fmt.Errorf("update score: %w", err)
+	}
+	return points, nil
+}
+
+func clampDifficulty(d int) int {
+	if d < minDifficulty {
+		return minDifficulty
+	}
+	if d > maxDifficulty {
+		return maxDifficulty
+	}
+	return d
+}
+
+var difficultyLevels = map[int]string{
+	1: "introductory - a single-step application of one concept",
+	2: "intermediate - a multi-step problem combining two ideas",
+	3: "advanced - a multi-step problem that needs analysis or synthesis",
+}
@@ -4,165 +4,283 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"log"
+	"math"
 	"net/http"
-
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"strings"
+	"time"
 )
 
-// generates a problem
-func Eval(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion("us-east-1"))
-	if err != nil {
-		http.Error(w, "failed to load aws config: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
+type CriterionScore struct {
+	Name   string  `json:"name"`
+	Points float64 `json:"points"`
+	Max    float64 `json:"max"`
+}
 
-	client := bedrockruntime.NewFromConfig(cfg)
-	modelID := "openai.gpt-oss-120b-1:0"
+// EvalResult is what /eval returns. Score is out of 100 and is the sum of
+// the criterion points scaled to the rubric total.
+type EvalResult struct {
+	QuestionID int64            `json:"question_id"`
+	Criteria   []CriterionScore `json:"criteria"`
+	Score      float64          `json:"score"`
+	Feedback   string           `json:"feedback"`
+	Error      string           `json:"error,omitempty"`
+	Correct    bool             `json:"correct"`
+	// Grader is "numeric" or "symbolic" when the answer was checked against
+	// the answer key and "llm" when the model marked it.
+	Grader string `json:"grader"`
+	// NextDifficulty is the difficulty of the student's next question on
+	// this topic.
+	NextDifficulty int `json:"next_difficulty,omitempty"`
+}
 
+// maxAnswerTime caps the time counted for one answer, so a question left
+// open overnight doesn't skew the student's average.
+const maxAnswerTime = 30 * time.Minute
+
+const (
+	maxEvalBody = 16 << 10
+	// maxAnswerLen bounds what the graders parse; no answer a student
+	// types comes close.
+	maxAnswerLen = 1024
+)
+
+// scores an answer to a problem
+func (a *App) Eval(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	var req struct {
-		Answer   string `json:"answer"`
-		Question string `json:"question`
+		QuestionID int64  `json:"question_id"`
+		Answer     string `json:"answer"`
+		// ChallengeID answers the question as part of a challenge
+		// instead of practice.
+		ChallengeID int64 `json:"challenge_id"`
 	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxEvalBody)
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	if req.Answer == "" {
+	if req.Answer == "" || req.QuestionID == 0 {
 		http.Error(w, "Missing input field", http.StatusBadRequest)
 		return
 	}
-
-	prompt := fmt.Sprintf(`
-Output a JSON only - no reasoning, no explanations, no commentary.
-You are an expert educator assessing answers to assessment questions.
-Your student answered %s to the problem: %s
-
-Follow these rules strictly:
-- Output ONLY valid JSON.
-- The JSON must have exactly one key: "score"
-- The value must be out of 100.
-- Do NOT include any commentary, explanations, or extra text.
-
-
-Example output format:
-{
-	"score":"90.5"
-}
-`, req.Answer, req.Question)
-
-	bodyBytes, _ := json.Marshal(map[string]interface{}{
-		"model": modelID,
-		"messages": []map[string]string{
-			{"role": "user", "content": prompt},
-		},
-		"max_completion_tokens": 512,
-	})
-
-	input := &bedrockruntime.InvokeModelInput{
-		ModelId:     aws.String(modelID),
-		ContentType: aws.String("application/json"),
-		Body:        bodyBytes,
+	if len(req.Answer) > maxAnswerLen {
+		http.Error(w, "answer too long", http.StatusBadRequest)
+		return
 	}
 
-	resp, err := client.InvokeModel(ctx, input)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("invoke model failed: %v", err), http.StatusInternalServerError)
+	q, err := a.getQuestion(ctx, req.QuestionID)
+	if err == errQuestionNotFound {
+		http.Error(w, "question not found", http.StatusNotFound)
 		return
 	}
-	if resp == nil || len(resp.Body) == 0 {
-		http.Error(w, "empty response from model", http.StatusInternalServerError)
+	if err != nil {
+		log.Printf("eval question lookup error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
 
-	var modelResp struct {
-		OutputText string `json:"output_text"`
+	uid, signedIn := userIDFromContext(ctx)
+	if !signedIn {
+		http.Error(w, "invalid token subject", http.StatusUnauthorized)
+		return
 	}
-	if err := json.Unmarshal(resp.Body, &modelResp); err == nil && modelResp.OutputText != "" {
-		var latexObj struct {
-			QuestionLatex string `json:"question_latex"`
+	// grading reveals the expected answer, so only the student the
+	// question was generated for, or a player in a challenge using it,
+	// may answer it
+	if q.UserID != uid {
+		playing, err := playsChallengeWith(ctx, a.DB, uid, q.ID, false)
+		if err != nil {
+			log.Printf("eval challenge lookup error: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
 		}
-		cleaned := RemoveReasoningBlock(modelResp.OutputText)
-		if err := json.Unmarshal([]byte(cleaned), &latexObj); err == nil && latexObj.QuestionLatex != "" {
-			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-			w.Write([]byte(latexObj.QuestionLatex))
+		if !playing {
+			http.Error(w, "question not found", http.StatusNotFound)
 			return
 		}
-		var openAIResp struct {
-			Choices []struct {
-				Message struct {
-					Content string `json:"content"`
-				} `json:"message"`
-			} `json:"choices"`
+	}
+	if req.ChallengeID != 0 {
+		// checked before grading so a closed challenge costs no model call
+		if err := checkChallengeAnswer(ctx, a.DB, req.ChallengeID, uid, q.ID, false); err != nil {
+			writeChallengeError(w, err)
+			return
 		}
-		if err := json.Unmarshal([]byte(modelResp.OutputText), &openAIResp); err == nil && len(openAIResp.Choices) > 0 {
-			content := openAIResp.Choices[0].Message.Content
-			contentClean := RemoveReasoningBlock(content)
-			start := -1
-			end := -1
-			for i := 0; i < len(contentClean); i++ {
-				if contentClean[i] == '{' && start == -1 {
-					start = i
-				}
-				if contentClean[i] == '}' {
-					end = i
-				}
-			}
-			if start != -1 && end != -1 && end > start {
-				jsonStr := contentClean[start : end+1]
-				if err := json.Unmarshal([]byte(jsonStr), &latexObj); err == nil && latexObj.QuestionLatex != "" {
-					w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-					w.Write([]byte(latexObj.QuestionLatex))
-					return
-				}
-			}
-			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-			w.Write([]byte(contentClean))
+	} else {
+		// practising a challenge's question would reveal its answer
+		// before it is answered in the challenge
+		if q.UserID != uid {
+			http.Error(w, "question not found", http.StatusNotFound)
 			return
 		}
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.Write([]byte(modelResp.OutputText))
+		open, err := playsChallengeWith(ctx, a.DB, uid, q.ID, true)
+		if err != nil {
+			log.Printf("eval challenge lookup error: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if open {
+			http.Error(w, "answer this question in its challenge", http.StatusConflict)
+			return
+		}
+	}
+
+	result, err := a.grade(ctx, q, req.Answer)
+	if err != nil {
+		modelError(w, err)
 		return
 	}
 
-	var openAIResp struct {
-		Choices []struct {
-			Message struct {
-				Content string `json:"content"`
-			} `json:"message"`
-		} `json:"choices"`
+	// challenge answers count towards the challenge, not practice stats
+	if req.ChallengeID != 0 {
+		if err := a.recordChallengeAnswer(ctx, req.ChallengeID, uid, q.ID, result); err != nil {
+			writeChallengeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+		return
 	}
-	if err := json.Unmarshal(resp.Body, &openAIResp); err == nil && len(openAIResp.Choices) > 0 {
-		content := openAIResp.Choices[0].Message.Content
-		var latexObj struct {
-			QuestionLatex string `json:"score"`
+
+	elapsed := time.Since(q.CreatedAt)
+	if elapsed < 0 || elapsed > maxAnswerTime {
+		elapsed = maxAnswerTime
+	}
+	at := &Attempt{
+		UserID:     uid,
+		QuestionID: q.ID,
+		Topic:      q.Topic,
+		Correct:    result.Correct,
+		Score:      result.Score,
+		TimeTaken:  elapsed,
+	}
+	if err := a.Difficulty.Record(ctx, at); err != nil {
+		log.Printf("eval record attempt error: %v", err)
+	} else {
+		result.NextDifficulty = at.NextDifficulty
+		if at.Points > 0 {
+			a.Hub.Publish(uid, at.Points)
 		}
-		contentClean := RemoveReasoningBlock(content)
-		start := -1
-		end := -1
-		for i := 0; i < len(contentClean); i++ {
-			if contentClean[i] == '{' && start == -1 {
-				start = i
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// grade checks answer against q's answer key when there is one and the
+// answer can be read deterministically, and asks the model otherwise.
+func (a *App) grade(ctx context.Context, q *Question, answer string) (*EvalResult, error) {
+	key, err := a.getAnswerKey(ctx, q.ID)
+	if err != nil {
+		log.Printf("eval answer key lookup error: %v", err)
+	}
+	if key != nil {
+		rubric := a.Rubrics.For(q.Topic)
+		switch key.Kind {
+		case answerNumeric:
+			if result, err := gradeNumeric(q, key, rubric, answer); err == nil {
+				return result, nil
 			}
-			if contentClean[i] == '}' {
-				end = i
+		case answerExpression:
+			if result, ok := gradeSymbolic(q, key, rubric, answer); ok {
+				return result, nil
 			}
 		}
-		if start != -1 && end != -1 && end > start {
-			jsonStr := contentClean[start : end+1]
-			if err := json.Unmarshal([]byte(jsonStr), &latexObj); err == nil && latexObj.QuestionLatex != "" {
-				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-				w.Write([]byte(latexObj.QuestionLatex))
-				return
-			}
+	}
+	return a.gradeWithModel(ctx, q, answer)
+}
+
+// gradeSymbolic reports ok only when both the key and the answer parse and
+// sampling could decide whether they are equivalent.
+func gradeSymbolic(q *Question, key *AnswerKey, rubric Rubric, answer string) (*EvalResult, bool) {
+	want, err := parseExpr(key.Expr)
+	if err != nil {
+		return nil, false
+	}
+	got, err := parseExpr(answer)
+	if err != nil {
+		return nil, false
+	}
+	same, decided := equivalent(got, want)
+	if !decided {
+		return nil, false
+	}
+	return keyedResult(q, rubric, "symbolic", same, key.Expr, answer), true
+}
+
+// keyedResult is the result for an answer checked against the answer key:
+// full marks on every criterion when correct and none otherwise.
+func keyedResult(q *Question, rubric Rubric, grader string, correct bool, expected, answer string) *EvalResult {
+	result := &EvalResult{QuestionID: q.ID, Correct: correct, Grader: grader}
+	for _, c := range rubric.Criteria {
+		points := 0.0
+		if correct {
+			points = c.Weight
 		}
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.Write([]byte(contentClean))
-		return
+		result.Criteria = append(result.Criteria, CriterionScore{Name: c.Name, Points: points, Max: c.Weight})
 	}
+	if correct {
+		result.Score = 100
+		result.Feedback = fmt.Sprintf("Correct! Your answer matches the expected %s.", expected)
+	} else {
+		result.Feedback = fmt.Sprintf("Not quite. The expected answer is %s; check your working and try a similar question.", expected)
+		result.Error = fmt.Sprintf("expected %s, got %s", expected, strings.TrimSpace(answer))
+	}
+	return result
+}
+
+// gradeWithModel has the model mark answer against the rubric for q's topic.
+func (a *App) gradeWithModel(ctx context.Context, q *Question, answer string) (*EvalResult, error) {
+	rubric := a.Rubrics.For(q.Topic)
+	prompt := fmt.Sprintf(`
+Output a JSON only - no reasoning, no explanations, no commentary.
+You are an expert educator assessing answers to assessment questions on: %s
+Your student answered %s to the problem: %s
+
+Mark the answer against this rubric. Give each criterion a mark from 0 to 100,
+where 100 means the criterion is fully met:
+%s
+Follow these rules strictly:
+- Output ONLY valid JSON.
+- "scores" maps every criterion name to its mark.
+- "feedback" is a short paragraph addressed to the student explaining the marks.
+- "error" names the first mistake in the answer, or is "" if there is none.
+- "correct" is true only if the final answer is right.
+
+Example output format:
+{
+	"scores": {"correctness": 100, "method": 80, "communication": 70},
+	"feedback": "Your final answer is right. You skipped the step where the rate is doubled for the 2-minute window; show it next time.",
+	"error": "",
+	"correct": true
+}
+`, q.Topic, answer, q.QuestionLatex, rubric.describe())
+
+	var out struct {
+		Scores   map[string]float64 `json:"scores"`
+		Feedback string             `json:"feedback"`
+		Error    string             `json:"error"`
+		Correct  bool               `json:"correct"`
+	}
+	if err := a.completeStructured(ctx, rubric.task(), prompt, &out); err != nil {
+		return nil, err
+	}
+
+	result := &EvalResult{
+		QuestionID: q.ID,
+		Feedback:   out.Feedback,
+		Error:      out.Error,
+		Correct:    out.Correct,
+		Grader:     "llm",
+	}
+	var earned float64
+	for _, c := range rubric.Criteria {
+		points := round1(c.Weight * out.Scores[c.Name] / 100)
+		earned += points
+		result.Criteria = append(result.Criteria, CriterionScore{Name: c.Name, Points: points, Max: c.Weight})
+	}
+	result.Score = round1(earned * 100 / rubric.total())
+	return result, nil
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(resp.Body)
+func round1(f float64) float64 {
+	return math.Round(f*10) / 10
 }
@@ -0,0 +1,711 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expressions cover the LaTeX/ASCII subset students type for algebra
+// answers: + - * / ^, implicit multiplication, \frac, \sqrt, roots, trig,
+// log/ln and exp, with single-letter variables.
+
+type expr interface {
+	eval(env map[string]float64) float64
+	String() string
+}
+
+type numExpr float64
+
+type varExpr string
+
+type negExpr struct{ x expr }
+
+type binExpr struct {
+	op   byte // + - * / ^
+	l, r expr
+}
+
+type callExpr struct {
+	fn  string
+	arg expr
+}
+
+func (n numExpr) eval(map[string]float64) float64 { return float64(n) }
+func (v varExpr) eval(env map[string]float64) float64 {
+	return env[string(v)]
+}
+func (n negExpr) eval(env map[string]float64) float64 { return -n.x.eval(env) }
+
+func (b binExpr) eval(env map[string]float64) float64 {
+	l, r := b.l.eval(env), b.r.eval(env)
+	switch b.op {
+	case '+':
+		return l + r
+	case '-':
+		return l - r
+	case '*':
+		return l * r
+	case '/':
+		return l / r
+	default:
+		return math.Pow(l, r)
+	}
+}
+
+var exprFuncs = map[string]func(float64) float64{
+	"sin": math.Sin, "cos": math.Cos, "tan": math.Tan,
+	"sec":    func(x float64) float64 { return 1 / math.Cos(x) },
+	"csc":    func(x float64) float64 { return 1 / math.Sin(x) },
+	"cot":    func(x float64) float64 { return 1 / math.Tan(x) },
+	"arcsin": math.Asin, "arccos": math.Acos, "arctan": math.Atan,
+	"sinh": math.Sinh, "cosh": math.Cosh, "tanh": math.Tanh,
+	"ln": math.Log, "log": math.Log10, "exp": math.Exp,
+	"sqrt": math.Sqrt, "abs": math.Abs,
+}
+
+func (c callExpr) eval(env map[string]float64) float64 {
+	return exprFuncs[c.fn](c.arg.eval(env))
+}
+
+func (n numExpr) String() string { return strconv.FormatFloat(float64(n), 'g', 12, 64) }
+func (v varExpr) String() string { return string(v) }
+func (n negExpr) String() string { return "(-" + n.x.String() + ")" }
+func (c callExpr) String() string {
+	return c.fn + "(" + c.arg.String() + ")"
+}
+
+// String prints sums and products with their operands sorted so that
+// reordered but otherwise identical expressions print the same.
+func (b binExpr) String() string {
+	switch b.op {
+	case '+', '*':
+		var parts []string
+		collect(b, b.op, &parts)
+		sort.Strings(parts)
+		return "(" + strings.Join(parts, string(b.op)) + ")"
+	default:
+		return "(" + b.l.String() + string(b.op) + b.r.String() + ")"
+	}
+}
+
+func collect(e expr, op byte, parts *[]string) {
+	if b, ok := e.(binExpr); ok && b.op == op {
+		collect(b.l, op, parts)
+		collect(b.r, op, parts)
+		return
+	}
+	*parts = append(*parts, e.String())
+}
+
+// simplify folds constants and drops identity operations.
+func simplify(e expr) expr {
+	switch e := e.(type) {
+	case negExpr:
+		x := simplify(e.x)
+		if n, ok := x.(numExpr); ok {
+			return -n
+		}
+		if inner, ok := x.(negExpr); ok {
+			return inner.x
+		}
+		return negExpr{x}
+	case callExpr:
+		arg := simplify(e.arg)
+		if n, ok := arg.(numExpr); ok {
+			if v := exprFuncs[e.fn](float64(n)); !math.IsNaN(v) && !math.IsInf(v, 0) {
+				return numExpr(v)
+			}
+		}
+		return callExpr{e.fn, arg}
+	case binExpr:
+		l, r := simplify(e.l), simplify(e.r)
+		ln, lok := l.(numExpr)
+		rn, rok := r.(numExpr)
+		if lok && rok {
+			if v := (binExpr{e.op, l, r}).eval(nil); !math.IsNaN(v) && !math.IsInf(v, 0) {
+				return numExpr(v)
+			}
+		}
+		switch e.op {
+		case '+':
+			if lok && ln == 0 {
+				return r
+			}
+			if rok && rn == 0 {
+				return l
+			}
+		case '-':
+			if rok && rn == 0 {
+				return l
+			}
+			if lok && ln == 0 {
+				return simplify(negExpr{r})
+			}
+			return binExpr{'+', l, simplify(negExpr{r})}
+		case '*':
+			if (lok && ln == 0) || (rok && rn == 0) {
+				return numExpr(0)
+			}
+			if lok && ln == 1 {
+				return r
+			}
+			if rok && rn == 1 {
+				return l
+			}
+		case '/':
+			if rok && rn == 1 {
+				return l
+			}
+		case '^':
+			if rok && rn == 1 {
+				return l
+			}
+			if rok && rn == 0 {
+				return numExpr(1)
+			}
+		}
+		return binExpr{e.op, l, r}
+	}
+	return e
+}
+
+func exprVars(e expr, vars map[string]bool) {
+	switch e := e.(type) {
+	case varExpr:
+		vars[string(e)] = true
+	case negExpr:
+		exprVars(e.x, vars)
+	case callExpr:
+		exprVars(e.arg, vars)
+	case binExpr:
+		exprVars(e.l, vars)
+		exprVars(e.r, vars)
+	}
+}
+
+const (
+	equivSamples    = 24
+	equivMinSamples = 6
+	equivTol        = 1e-7
+)
+
+// equivalent decides whether a, the answer, and b, the key, denote the same
+// function. It first compares simplified forms and otherwise evaluates both
+// at random points. Constants are compared with the numeric grader's
+// tolerance instead, so a rounded 0.333 matches 1/3 there too. decided is
+// false when too few points were defined for both to tell.
+func equivalent(a, b expr) (same, decided bool) {
+	a, b = simplify(a), simplify(b)
+	if a.String() == b.String() {
+		return true, true
+	}
+
+	vars := map[string]bool{}
+	exprVars(a, vars)
+	exprVars(b, vars)
+	names := make([]string, 0, len(vars))
+	for v := range vars {
+		names = append(names, v)
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		fa, fb := a.eval(nil), b.eval(nil)
+		if !finite(fa) || !finite(fb) {
+			return false, false
+		}
+		return closeEnough(fa, fb), true
+	}
+
+	// Seed from the expressions so the same pair always grades the same.
+	h := fnv.New64a()
+	h.Write([]byte(a.String() + "\x00" + b.String()))
+	rng := rand.New(rand.NewPCG(h.Sum64(), 0x9e3779b97f4a7c15))
+
+	valid := 0
+	for i := 0; i < equivSamples; i++ {
+		env := make(map[string]float64, len(names))
+		for _, v := range names {
+			x := 0.1 + rng.Float64()*4.9
+			// Alternate between positive-only points, which keep roots
+			// and logs defined, and points of either sign.
+			if i%2 == 1 && rng.IntN(2) == 0 {
+				x = -x
+			}
+			env[v] = x
+		}
+		fa, fb := a.eval(env), b.eval(env)
+		if !finite(fa) || !finite(fb) {
+			continue
+		}
+		valid++
+		if math.Abs(fa-fb) > equivTol*math.Max(1, math.Max(math.Abs(fa), math.Abs(fb))) {
+			return false, true
+		}
+	}
+	return valid >= equivMinSamples, valid >= equivMinSamples
+}
+
+func finite(f float64) bool { return !math.IsNaN(f) && !math.IsInf(f, 0) }
+
+var errExprSyntax = errors.New("not an expression")
+
+// parseExpr parses a student answer or key. A leading "y =" or "f(x) =" is
+// ignored.
+func parseExpr(s string) (expr, error) {
+	toks, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	toks = dropLHS(toks)
+	if len(toks) == 0 {
+		return nil, errExprSyntax
+	}
+	p := &exprParser{toks: toks}
+	e, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.toks) {
+		return nil, fmt.Errorf("%w: unexpected %q", errExprSyntax, p.toks[p.pos].text)
+	}
+	return e, nil
+}
+
+type tokKind int
+
+const (
+	tokNum tokKind = iota
+	tokIdent
+	tokFunc
+	tokCmd
+	tokOp
+)
+
+type token struct {
+	kind tokKind
+	text string
+}
+
+var latexIgnored = map[string]bool{"left": true, "right": true, "displaystyle": true, ",": true, ";": true, "!": true, " ": true, ":": true}
+
+var latexVars = map[string]bool{
+	"alpha": true, "beta": true, "gamma": true, "theta": true, "phi": true, "lambda": true, "mu": true, "omega": true,
+}
+
+// funcNames are matched greedily inside runs of plain letters, so "sinx" is
+// sin(x) and "xy" is x*y.
+var funcNames = []string{"arcsin", "arccos", "arctan", "sinh", "cosh", "tanh", "sqrt", "sin", "cos", "tan", "sec", "csc", "cot", "abs", "exp", "log", "ln"}
+
+func tokenize(s string) ([]token, error) {
+	s = strings.NewReplacer("**", "^", "−", "-", "×", "*", "·", "*", "÷", "/", "²", "^2", "³", "^3", "π", `\pi`, "√", `\sqrt`, "$", "").Replace(s)
+	var toks []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c >= '0' && c <= '9' || c == '.':
+			j := i
+			for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == '.') {
+				j++
+			}
+			toks = append(toks, token{tokNum, s[i:j]})
+			i = j
+		case c == '\\':
+			j := i + 1
+			for j < len(s) && unicode.IsLetter(rune(s[j])) {
+				j++
+			}
+			if j == i+1 && j < len(s) {
+				j++
+			}
+			name := s[i+1 : j]
+			i = j
+			switch {
+			case latexIgnored[name]:
+			case name == "cdot" || name == "times":
+				toks = append(toks, token{tokOp, "*"})
+			case name == "div":
+				toks = append(toks, token{tokOp, "/"})
+			case name == "{" || name == "}":
+				// \{ \} used as brackets.
+				toks = append(toks, token{tokOp, map[string]string{"{": "(", "}": ")"}[name]})
+			case name == "pi":
+				toks = append(toks, token{tokIdent, "pi"})
+			case latexVars[name]:
+				toks = append(toks, token{tokIdent, name})
+			case exprFuncs[name] != nil:
+				toks = append(toks, token{tokFunc, name})
+			case name == "frac" || name == "dfrac" || name == "tfrac":
+				toks = append(toks, token{tokCmd, "frac"})
+			default:
+				return nil, fmt.Errorf("%w: unknown command \\%s", errExprSyntax, name)
+			}
+		case unicode.IsLetter(rune(c)):
+			j := i
+			for j < len(s) && unicode.IsLetter(rune(s[j])) {
+				j++
+			}
+			word := s[i:j]
+			i = j
+			for len(word) > 0 {
+				matched := false
+				for _, fn := range funcNames {
+					if strings.HasPrefix(word, fn) {
+						toks = append(toks, token{tokFunc, fn})
+						word = word[len(fn):]
+						matched = true
+						break
+					}
+				}
+				if matched {
+					continue
+				}
+				if strings.HasPrefix(word, "pi") {
+					toks = append(toks, token{tokIdent, "pi"})
+					word = word[2:]
+					continue
+				}
+				toks = append(toks, token{tokIdent, word[:1]})
+				word = word[1:]
+			}
+		case strings.IndexByte("+-*/^()[]{}_=,|", c) >= 0:
+			toks = append(toks, token{tokOp, string(c)})
+			i++
+		default:
+			return nil, fmt.Errorf("%w: unexpected %q", errExprSyntax, c)
+		}
+	}
+	return toks, nil
+}
+
+// dropLHS removes "y =" or "f(x) =" from the front of an answer.
+func dropLHS(toks []token) []token {
+	for i, t := range toks {
+		if t.kind == tokOp && t.text == "=" {
+			if i <= 4 {
+				return toks[i+1:]
+			}
+			return toks
+		}
+	}
+	return toks
+}
+
+// maxExprDepth bounds the parser's recursion, so a long run of brackets
+// or signs is a syntax error rather than a stack overflow.
+const maxExprDepth = 64
+
+type exprParser struct {
+	toks  []token
+	pos   int
+	depth int
+}
+
+// enter counts one level of recursion; callers undo it with leave.
+func (p *exprParser) enter() error {
+	p.depth++
+	if p.depth > maxExprDepth {
+		return fmt.Errorf("%w: nested too deeply", errExprSyntax)
+	}
+	return nil
+}
+
+func (p *exprParser) leave() { p.depth-- }
+
+func (p *exprParser) peek() (token, bool) {
+	if p.pos >= len(p.toks) {
+		return token{}, false
+	}
+	return p.toks[p.pos], true
+}
+
+func (p *exprParser) isOp(ops string) (string, bool) {
+	t, ok := p.peek()
+	if !ok || t.kind != tokOp || !strings.Contains(ops, t.text) {
+		return "", false
+	}
+	return t.text, true
+}
+
+func (p *exprParser) expect(op string) error {
+	if _, ok := p.isOp(op); !ok {
+		return fmt.Errorf("%w: expected %q", errExprSyntax, op)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *exprParser) parseSum() (expr, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.isOp("+-")
+		if !ok {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = binExpr{op[0], left, right}
+	}
+}
+
+// startsFactor reports whether the next token can begin an implicitly
+// multiplied factor, as in 2x or (x+1)(x-1).
+func (p *exprParser) startsFactor() bool {
+	t, ok := p.peek()
+	if !ok {
+		return false
+	}
+	switch t.kind {
+	case tokNum, tokIdent, tokFunc, tokCmd:
+		return true
+	}
+	return t.text == "(" || t.text == "[" || t.text == "{"
+}
+
+func (p *exprParser) parseProduct() (expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := byte('*')
+		if o, ok := p.isOp("*/"); ok {
+			op = o[0]
+			p.pos++
+		} else if !p.startsFactor() {
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = binExpr{op, left, right}
+	}
+}
+
+func (p *exprParser) parseUnary() (expr, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+	if op, ok := p.isOp("+-"); ok {
+		p.pos++
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if op == "-" {
+			return negExpr{x}, nil
+		}
+		return x, nil
+	}
+	return p.parsePower()
+}
+
+func (p *exprParser) parsePower() (expr, error) {
+	base, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := p.isOp("^"); !ok {
+		return base, nil
+	}
+	p.pos++
+	exp, err := p.parseExponent()
+	if err != nil {
+		return nil, err
+	}
+	return binExpr{'^', base, exp}, nil
+}
+
+func (p *exprParser) parseExponent() (expr, error) {
+	if _, ok := p.isOp("{"); ok {
+		return p.parseGroup()
+	}
+	return p.parseUnary()
+}
+
+// parseGroup parses a bracketed subexpression: (..), [..] or {..}.
+func (p *exprParser) parseGroup() (expr, error) {
+	open, ok := p.isOp("([{")
+	if !ok {
+		return nil, fmt.Errorf("%w: expected group", errExprSyntax)
+	}
+	p.pos++
+	e, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	closing := map[string]string{"(": ")", "[": "]", "{": "}"}[open]
+	if err := p.expect(closing); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (p *exprParser) parsePrimary() (expr, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+	t, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("%w: unexpected end", errExprSyntax)
+	}
+	switch t.kind {
+	case tokNum:
+		p.pos++
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad number %q", errExprSyntax, t.text)
+		}
+		return numExpr(f), nil
+	case tokIdent:
+		p.pos++
+		switch t.text {
+		case "pi":
+			return numExpr(math.Pi), nil
+		case "e":
+			return numExpr(math.E), nil
+		}
+		name := t.text
+		if _, ok := p.isOp("_"); ok {
+			p.pos++
+			sub, ok := p.peek()
+			if !ok {
+				return nil, fmt.Errorf("%w: empty subscript", errExprSyntax)
+			}
+			if sub.text == "{" {
+				start := p.pos
+				if _, err := p.parseGroup(); err != nil {
+					return nil, err
+				}
+				name += "_"
+				for _, st := range p.toks[start+1 : p.pos-1] {
+					name += st.text
+				}
+			} else {
+				p.pos++
+				name += "_" + sub.text
+			}
+		}
+		return varExpr(name), nil
+	case tokFunc:
+		p.pos++
+		return p.parseCall(t.text)
+	case tokCmd:
+		p.pos++
+		num, err := p.parseGroup()
+		if err != nil {
+			return nil, err
+		}
+		den, err := p.parseGroup()
+		if err != nil {
+			return nil, err
+		}
+		return binExpr{'/', num, den}, nil
+	}
+	if _, ok := p.isOp("|"); ok {
+		p.pos++
+		e, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("|"); err != nil {
+			return nil, err
+		}
+		return callExpr{"abs", e}, nil
+	}
+	return p.parseGroup()
+}
+
+// parseCall parses the argument of fn, including \sqrt[n]{x}, log_b x and
+// sin^2 x forms. An argument without brackets takes in the numbers and
+// variables multiplied onto it, so sin 2x is sin(2x), but stops at the next
+// function or bracket, so sin x cos x is sin(x)cos(x). \sqrt takes a single
+// factor as in LaTeX, where \sqrt 2x is \sqrt{2} x.
+func (p *exprParser) parseCall(fn string) (expr, error) {
+	var root, base, power expr
+	var err error
+	if _, ok := p.isOp("["); ok && fn == "sqrt" {
+		if root, err = p.parseGroup(); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := p.isOp("_"); ok && fn == "log" {
+		p.pos++
+		if _, ok := p.isOp("{("); ok {
+			base, err = p.parseGroup()
+		} else {
+			base, err = p.parsePrimary()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := p.isOp("^"); ok {
+		p.pos++
+		if power, err = p.parseExponent(); err != nil {
+			return nil, err
+		}
+	}
+
+	var arg expr
+	switch _, ok := p.isOp("({["); {
+	case ok:
+		arg, err = p.parseGroup()
+	case fn == "sqrt":
+		arg, err = p.parsePower()
+	default:
+		arg, err = p.parseBareArg()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var call expr = callExpr{fn, arg}
+	switch {
+	case root != nil:
+		call = binExpr{'^', arg, binExpr{'/', numExpr(1), root}}
+	case base != nil:
+		call = binExpr{'/', callExpr{"ln", arg}, callExpr{"ln", base}}
+	}
+	if power != nil {
+		call = binExpr{'^', call, power}
+	}
+	return call, nil
+}
+
+// parseBareArg parses a function argument written without brackets: powers
+// of numbers and variables multiplied together without an operator.
+func (p *exprParser) parseBareArg() (expr, error) {
+	arg, err := p.parsePower()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t, ok := p.peek()
+		if !ok || (t.kind != tokNum && t.kind != tokIdent) {
+			return arg, nil
+		}
+		factor, err := p.parsePower()
+		if err != nil {
+			return nil, err
+		}
+		arg = binExpr{'*', arg, factor}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseExpr(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"2x + 1", "((2*x)+1)"},
+		{"y = 2x + 1", "((2*x)+1)"},
+		{"(x+1)(x-1)", "((1+x)*(x-1))"},
+		{"sin 2x", "sin((2*x))"},
+		{`\sin 2x`, "sin((2*x))"},
+		{"sin2x", "sin((2*x))"},
+		{"sin(2)x", "(sin(2)*x)"},
+		{`\sin 2\pi x`, "sin((2*3.14159265359*x))"},
+		{"sin x cos x", "(cos(x)*sin(x))"},
+		{"sin x + 1", "(1+sin(x))"},
+		{"sin^2 x", "(sin(x)^2)"},
+		{`\ln 3x^2`, "ln(((x^2)*3))"},
+		{`\log_2 8x`, "(ln((8*x))/ln(2))"},
+		{`\sqrt 2x`, "(sqrt(2)*x)"},
+		{`\sqrt[3]{x}`, "(x^(1/3))"},
+		{`\frac{1}{2}x`, "((1/2)*x)"},
+		{"|x-1|", "abs((x-1))"},
+		{"x_1 + x_{2}", "(x_1+x_2)"},
+	}
+	for _, tt := range tests {
+		e, err := parseExpr(tt.in)
+		if err != nil {
+			t.Errorf("parseExpr(%q): %v", tt.in, err)
+			continue
+		}
+		if got := e.String(); got != tt.want {
+			t.Errorf("parseExpr(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseExprErrors(t *testing.T) {
+	for _, in := range []string{"", "2+", "(x", `\foo x`, "x)", "y ="} {
+		if e, err := parseExpr(in); err == nil {
+			t.Errorf("parseExpr(%q) = %s, want an error", in, e)
+		}
+	}
+}
+
+func TestParseExprDepth(t *testing.T) {
+	nested := func(n int) string { return strings.Repeat("(", n) + "x" + strings.Repeat(")", n) }
+	for _, in := range []string{nested(20), strings.Repeat("-", 30) + "x", "sin sin sin x"} {
+		if _, err := parseExpr(in); err != nil {
+			t.Errorf("parseExpr(%.20q): %v", in, err)
+		}
+	}
+	for name, in := range map[string]string{
+		"brackets":  nested(1 << 20),
+		"unclosed":  strings.Repeat("(", 1<<20),
+		"signs":     strings.Repeat("-", 1<<20) + "x",
+		"function":  strings.Repeat("sin ", 1<<16) + "x",
+		"exponents": "x" + strings.Repeat("^{x", 1<<16),
+	} {
+		if _, err := parseExpr(in); err == nil {
+			t.Errorf("%s: parsed, want an error", name)
+		}
+	}
+}
+
+func TestEvalRejectsLongAnswers(t *testing.T) {
+	a := &App{}
+	for name, body := range map[string]string{
+		"long answer": `{"question_id": 1, "answer": "` + strings.Repeat("(", maxAnswerLen+1) + `"}`,
+		"long body":   `{"question_id": 1, "answer": "x", "pad": "` + strings.Repeat("x", maxEvalBody) + `"}`,
+	} {
+		rec := httptest.NewRecorder()
+		req := withClaims(httptest.NewRequest("POST", "/eval", strings.NewReader(body)), 1, RoleStudent)
+		a.Eval(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d %q, want 400", name, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestEquivalent(t *testing.T) {
+	tests := []struct {
+		answer, key   string
+		same, decided bool
+	}{
+		{"(x-1)(x+1)", "x^2 - 1", true, true},
+		{"2 sin x cos x", `\sin 2x`, true, true},
+		{"x^2", "x^3", false, true},
+		{`\sin(2)x`, `\sin 2x`, false, true},
+		// constants are compared with the numeric tolerance
+		{"0.333", `\frac{1}{3}`, true, true},
+		{"0.3", `\frac{1}{3}`, false, true},
+		{`\sqrt{-1}`, "1", false, false},
+	}
+	for _, tt := range tests {
+		a, err := parseExpr(tt.answer)
+		if err != nil {
+			t.Fatalf("parseExpr(%q): %v", tt.answer, err)
+		}
+		b, err := parseExpr(tt.key)
+		if err != nil {
+			t.Fatalf("parseExpr(%q): %v", tt.key, err)
+		}
+		same, decided := equivalent(a, b)
+		if same != tt.same || decided != tt.decided {
+			t.Errorf("equivalent(%q, %q) = %v, %v; want %v, %v", tt.answer, tt.key, same, decided, tt.same, tt.decided)
+		}
+	}
+}
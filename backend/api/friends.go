@@ -1,20 +1,149 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"strconv"
-
-	"github.com/gorilla/mux"
+	"time"
 )
 
 type friend struct {
+	ID       int64  `json:"id"`
 	Username string `json:"username"`
 	Score    int    `json:"score"`
 }
 
-// adds a friendship to the friends DB
+var (
+	errFriendNotFound = errors.New("user not found")
+	errYouBlocked     = errors.New("unblock this user first")
+	errAlreadyFriends = errors.New("already friends")
+	// errAmbiguousUsername is returned when a username names more than
+	// one visible user.
+	errAmbiguousUsername = errors.New("ambiguous username, use user_id")
+)
+
+// notBlockedWith is a condition that hides users who blocked, or were
+// blocked by, the viewer. col is the other user's ID column; the condition
+// takes the viewer's ID twice. Every query listing other users applies it.
+func notBlockedWith(col string) string {
+	return "NOT EXISTS (SELECT 1 FROM blocks b WHERE (b.BlockerID=? AND b.BlockedID=" + col + ") OR (b.BlockerID=" + col + " AND b.BlockedID=?))"
+}
+
+// blockedBetween reports whether a blocked b and whether b blocked a.
+func blockedBetween(ctx context.Context, db dbtx, a, b int64) (aBlocked, bBlocked bool, err error) {
+	err = db.QueryRowContext(ctx, `SELECT
+			EXISTS(SELECT 1 FROM blocks WHERE BlockerID=? AND BlockedID=?),
+			EXISTS(SELECT 1 FROM blocks WHERE BlockerID=? AND BlockedID=?)`, a, b, b, a).Scan(&aBlocked, &bBlocked)
+	if err != nil {
+		return false, false, fmt.Errorf("select blocks: %w", err)
+	}
+	return aBlocked, bBlocked, nil
+}
+
+// befriendable returns errFriendNotFound unless to is an active account
+// that from may befriend: not a guardian, able to use social features and
+// not blocking from. A block by from is errYouBlocked.
+func befriendable(ctx context.Context, db dbtx, from, to int64) error {
+	var exists int
+	err := db.QueryRowContext(ctx, `SELECT 1 FROM users u WHERE u.ID=? AND u.DeletedAt IS NULL
+		AND NOT EXISTS (SELECT 1 FROM user_roles r WHERE r.UserID = u.ID AND r.Role = ?)`, to, RoleGuardian).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return errFriendNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("select user: %w", err)
+	}
+	// children without a guardian's approval can't be befriended either
+	social, err := socialAllowed(ctx, db, to)
+	if err != nil {
+		return err
+	}
+	if !social {
+		return errFriendNotFound
+	}
+	youBlocked, theyBlocked, err := blockedBetween(ctx, db, from, to)
+	if err != nil {
+		return err
+	}
+	if theyBlocked {
+		// don't tell them they were blocked
+		return errFriendNotFound
+	}
+	if youBlocked {
+		return errYouBlocked
+	}
+	return nil
+}
+
+// requestFriend sends a friend request from one user to another. When
+// the other user has already asked, the two become friends instead. It
+// reports whether they are now friends.
+func (a *App) requestFriend(ctx context.Context, from, to int64) (bool, error) {
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := befriendable(ctx, tx, from, to); err != nil {
+		return false, err
+	}
+	var exists int
+	err = tx.QueryRowContext(ctx, "SELECT 1 FROM friends WHERE ID1=? AND ID2=?", from, to).Scan(&exists)
+	if err == nil {
+		return false, errAlreadyFriends
+	}
+	if err != sql.ErrNoRows {
+		return false, fmt.Errorf("select friend: %w", err)
+	}
+	res, err := tx.ExecContext(ctx, "DELETE FROM friend_requests WHERE FromID=? AND ToID=?", to, from)
+	if err != nil {
+		return false, fmt.Errorf("delete reverse request: %w", err)
+	}
+	friends := false
+	if n, _ := res.RowsAffected(); n > 0 {
+		if err := addFriendship(ctx, tx, from, to); err != nil {
+			return false, err
+		}
+		friends = true
+	} else if _, err := tx.ExecContext(ctx, "INSERT IGNORE INTO friend_requests (FromID, ToID) VALUES (?, ?)", from, to); err != nil {
+		return false, fmt.Errorf("insert request: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("commit: %w", err)
+	}
+	return friends, nil
+}
+
+func addFriendship(ctx context.Context, tx *sql.Tx, a, b int64) error {
+	_, err := tx.ExecContext(ctx, "INSERT IGNORE INTO friends (ID1, ID2) VALUES (?, ?), (?, ?)", a, b, b, a)
+	if err != nil {
+		return fmt.Errorf("insert friends: %w", err)
+	}
+	return nil
+}
+
+// writeFriendError answers a failed friend request.
+func writeFriendError(w http.ResponseWriter, err error) {
+	switch err {
+	case errFriendNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errYouBlocked, errAlreadyFriends, errAmbiguousUsername:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Printf("friend request error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	}
+}
+
+// sends a friend request, route: addfriend?user2=. user2 is a user ID or
+// a username. user1 is the caller; only admins may send requests for
+// someone else. Kept for older clients; POST /friends/requests is the same.
 func (a *App) addFriend(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		w.WriteHeader(http.StatusBadRequest)
@@ -23,59 +152,70 @@ func (a *App) addFriend(w http.ResponseWriter, r *http.Request) {
 	}
 	queryParams := r.URL.Query()
 
-	user1_string := queryParams.Get("user1")
-	user2_string := queryParams.Get("user2")
-
-	user1, err1 := strconv.Atoi(user1_string)
-	user2, err2 := strconv.Atoi(user2_string)
-	if err1 != nil || err2 != nil {
+	_, user1, ok := a.authorizeUser(w, r, queryParams.Get("user1"), actAsUser)
+	if !ok {
+		return
+	}
+	user2, err := strconv.ParseInt(queryParams.Get("user2"), 10, 64)
+	if err != nil && queryParams.Get("user2") != "" {
+		user2, err = findVisibleUser(r.Context(), a.DB, user1, queryParams.Get("user2"))
+		if err != nil {
+			writeFriendError(w, err)
+			return
+		}
+	}
+	if err != nil || user2 == user1 {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("Invalid user IDs"))
 		return
 	}
-	_, err := a.DB.ExecContext(r.Context(), "INSERT INTO friends (ID1, ID2) VALUES (?, ?), (?, ?)", user1, user2, user2, user1)
+	friends, err := a.requestFriend(r.Context(), user1, user2)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("Error updating DB: %v", err)))
+		writeFriendError(w, err)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
+	writeJSON(w, http.StatusOK, map[string]bool{"friends": friends})
 }
 
-// get all friends of a user, route: getallfriends/{user}
+// get all friends of a user, route: getallfriends/{user}. {user} may be
+// "me"; other users' lists need a policy allowing it, like a teacher
+// viewing a student's.
 func (a *App) getAllFriends(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("Invalid request method"))
 		return
 	}
-	vars := mux.Vars(r)
-	userID, ok := vars["user"]
+	_, userID, ok := a.authorizeUser(w, r, r.PathValue("user"), readUser)
 	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Missing user var"))
 		return
 	}
-	rows, err := a.DB.QueryContext(r.Context(), "SELECT Username, Score FROM users LEFT JOIN friends ON friends.ID2 = users.ID WHERE friends.ID1 = ?", userID)
-	defer rows.Close()
-
+	rows, err := a.DB.QueryContext(r.Context(), "SELECT users.ID, Username, Score FROM users JOIN friends ON friends.ID2 = users.ID WHERE friends.ID1 = ? AND "+notBlockedWith("users.ID"),
+		userID, userID, userID)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("Failed to query DB: %v", err)))
+		log.Printf("get friends query error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
+	defer rows.Close()
 
 	friendList := []friend{}
 
 	for rows.Next() {
+		var id int64
 		var username string
 		var score int
-		if err := rows.Scan(&username, &score); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(fmt.Sprintf("Error scanning SQL row: %v", err)))
+		if err := rows.Scan(&id, &username, &score); err != nil {
+			log.Printf("get friends scan error: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
 			return
 		}
-		friendList = append(friendList, friend{Username: username, Score: score})
+		friendList = append(friendList, friend{ID: id, Username: username, Score: score})
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("get friends rows error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
 	}
 
 	jsonData, err := json.Marshal(friendList)
@@ -84,8 +224,308 @@ func (a *App) getAllFriends(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(fmt.Sprintf("Error parsing to JSON: %v", err)))
 		return
 	}
-	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
 	fmt.Fprintln(w, string(jsonData))
 	// w.Write(jsonData)
 }
+
+// friendParam parses the {id} path value, the other user in a friend
+// action.
+func friendParam(w http.ResponseWriter, r *http.Request) (int64, int64, bool) {
+	c, _ := ClaimsFromContext(r.Context())
+	other, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || other == c.UserID {
+		http.Error(w, "invalid user ID", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	return c.UserID, other, true
+}
+
+// SendFriendRequest asks another user, by user_id or username, to be
+// friends. If they already asked the caller, the two become friends
+// straight away. A username only finds users the caller could find by
+// searching.
+func (a *App) SendFriendRequest(w http.ResponseWriter, r *http.Request) {
+	c, _ := ClaimsFromContext(r.Context())
+	var req struct {
+		UserID   int64  `json:"user_id"`
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == 0 && req.Username != "" {
+		id, err := findVisibleUser(r.Context(), a.DB, c.UserID, req.Username)
+		if err != nil {
+			writeFriendError(w, err)
+			return
+		}
+		req.UserID = id
+	}
+	if req.UserID == 0 || req.UserID == c.UserID {
+		http.Error(w, "invalid user ID", http.StatusBadRequest)
+		return
+	}
+	friends, err := a.requestFriend(r.Context(), c.UserID, req.UserID)
+	if err != nil {
+		writeFriendError(w, err)
+		return
+	}
+	status := http.StatusCreated
+	if friends {
+		status = http.StatusOK
+	}
+	writeJSON(w, status, map[string]bool{"friends": friends})
+}
+
+// relatedUser is another user in a request or block, and when it was
+// made.
+type relatedUser struct {
+	UserID    int64  `json:"user_id"`
+	Username  string `json:"username"`
+	CreatedAt string `json:"created_at"`
+}
+
+// listFriendRequests lists requests to the caller (incoming) or from them.
+func (a *App) listFriendRequests(w http.ResponseWriter, r *http.Request, incoming bool) {
+	c, _ := ClaimsFromContext(r.Context())
+	mine, other := "r.FromID", "r.ToID"
+	if incoming {
+		mine, other = other, mine
+	}
+	rows, err := a.DB.QueryContext(r.Context(), `SELECT u.ID, u.Username, r.CreatedAt FROM friend_requests r
+		JOIN users u ON u.ID = `+other+` WHERE `+mine+`=? ORDER BY r.CreatedAt DESC`, c.UserID)
+	if err != nil {
+		log.Printf("list friend requests error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	requests := []relatedUser{}
+	for rows.Next() {
+		var fr relatedUser
+		var created time.Time
+		if err := rows.Scan(&fr.UserID, &fr.Username, &created); err != nil {
+			log.Printf("scan friend request error: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		fr.CreatedAt = created.UTC().Format(time.RFC3339)
+		requests = append(requests, fr)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("list friend requests rows error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, requests)
+}
+
+func (a *App) IncomingFriendRequests(w http.ResponseWriter, r *http.Request) {
+	a.listFriendRequests(w, r, true)
+}
+
+func (a *App) OutgoingFriendRequests(w http.ResponseWriter, r *http.Request) {
+	a.listFriendRequests(w, r, false)
+}
+
+// AcceptFriendRequest accepts the request from user {id}.
+func (a *App) AcceptFriendRequest(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	me, other, ok := friendParam(w, r)
+	if !ok {
+		return
+	}
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("accept friend begin error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, "DELETE FROM friend_requests WHERE FromID=? AND ToID=?", other, me)
+	if err != nil {
+		log.Printf("accept friend delete error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "no such request", http.StatusNotFound)
+		return
+	}
+	// the requester may have lost social features since asking
+	if err := befriendable(ctx, tx, me, other); err != nil {
+		writeFriendError(w, err)
+		return
+	}
+	if err := addFriendship(ctx, tx, me, other); err != nil {
+		log.Printf("accept friend error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("accept friend commit error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteFriendRequest removes the request from one user to another, for
+// declining and cancelling.
+func (a *App) deleteFriendRequest(w http.ResponseWriter, r *http.Request, from, to int64) {
+	res, err := a.DB.ExecContext(r.Context(), "DELETE FROM friend_requests WHERE FromID=? AND ToID=?", from, to)
+	if err != nil {
+		log.Printf("delete friend request error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "no such request", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeclineFriendRequest declines the request from user {id}. They aren't
+// told, and may ask again.
+func (a *App) DeclineFriendRequest(w http.ResponseWriter, r *http.Request) {
+	me, other, ok := friendParam(w, r)
+	if ok {
+		a.deleteFriendRequest(w, r, other, me)
+	}
+}
+
+// CancelFriendRequest withdraws the caller's request to user {id}.
+func (a *App) CancelFriendRequest(w http.ResponseWriter, r *http.Request) {
+	me, other, ok := friendParam(w, r)
+	if ok {
+		a.deleteFriendRequest(w, r, me, other)
+	}
+}
+
+// Unfriend ends the caller's friendship with user {id}.
+func (a *App) Unfriend(w http.ResponseWriter, r *http.Request) {
+	me, other, ok := friendParam(w, r)
+	if !ok {
+		return
+	}
+	res, err := a.DB.ExecContext(r.Context(), "DELETE FROM friends WHERE (ID1=? AND ID2=?) OR (ID1=? AND ID2=?)", me, other, other, me)
+	if err != nil {
+		log.Printf("unfriend error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "not friends", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// BlockUser blocks another user. It ends any friendship, pending requests
+// and open challenges between the two, and from then on each is hidden
+// from the other and can't send the other requests.
+func (a *App) BlockUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	c, _ := ClaimsFromContext(ctx)
+	var req struct {
+		UserID int64 `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == 0 || req.UserID == c.UserID {
+		http.Error(w, "invalid user ID", http.StatusBadRequest)
+		return
+	}
+	me, other := c.UserID, req.UserID
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("block begin error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, "INSERT IGNORE INTO blocks (BlockerID, BlockedID) SELECT ?, ID FROM users WHERE ID=?", me, other)
+	if err != nil {
+		log.Printf("block insert error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		var exists int
+		if err := tx.QueryRowContext(ctx, "SELECT 1 FROM users WHERE ID=?", other).Scan(&exists); err == sql.ErrNoRows {
+			http.Error(w, "user not found", http.StatusNotFound)
+			return
+		}
+	}
+	for _, q := range []string{
+		"DELETE FROM friends WHERE (ID1=? AND ID2=?) OR (ID1=? AND ID2=?)",
+		"DELETE FROM friend_requests WHERE (FromID=? AND ToID=?) OR (FromID=? AND ToID=?)",
+		"UPDATE challenges SET Status='" + challengeCancelled + "' WHERE Status IN " + openChallengeStatuses +
+			" AND ((ChallengerID=? AND OpponentID=?) OR (ChallengerID=? AND OpponentID=?))",
+	} {
+		if _, err := tx.ExecContext(ctx, q, me, other, other, me); err != nil {
+			log.Printf("block cleanup error: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("block commit error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UnblockUser lifts the caller's block on user {id}. Friendship isn't
+// restored.
+func (a *App) UnblockUser(w http.ResponseWriter, r *http.Request) {
+	me, other, ok := friendParam(w, r)
+	if !ok {
+		return
+	}
+	res, err := a.DB.ExecContext(r.Context(), "DELETE FROM blocks WHERE BlockerID=? AND BlockedID=?", me, other)
+	if err != nil {
+		log.Printf("unblock error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "not blocked", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// BlockedUsers lists the users the caller has blocked.
+func (a *App) BlockedUsers(w http.ResponseWriter, r *http.Request) {
+	c, _ := ClaimsFromContext(r.Context())
+	rows, err := a.DB.QueryContext(r.Context(), `SELECT u.ID, u.Username, b.CreatedAt FROM blocks b
+		JOIN users u ON u.ID = b.BlockedID WHERE b.BlockerID=? ORDER BY b.CreatedAt DESC`, c.UserID)
+	if err != nil {
+		log.Printf("list blocks error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	blocked := []relatedUser{}
+	for rows.Next() {
+		var b relatedUser
+		var created time.Time
+		if err := rows.Scan(&b.UserID, &b.Username, &created); err != nil {
+			log.Printf("scan block error: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		b.CreatedAt = created.UTC().Format(time.RFC3339)
+		blocked = append(blocked, b)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("list blocks rows error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, blocked)
+}
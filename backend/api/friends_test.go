@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// withClaims returns r as Auth would pass it on for user uid.
+func withClaims(r *http.Request, uid int64, roles ...string) *http.Request {
+	c := &Claims{UserID: uid, Roles: roles}
+	return r.WithContext(context.WithValue(r.Context(), claimsKey, c))
+}
+
+// These requests are all refused before any DB access: the App has no DB,
+// so reaching one would panic.
+func TestUserScopedEndpointsRejectOtherUsers(t *testing.T) {
+	a := &App{}
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		req     *http.Request
+		want    int
+	}{
+		{
+			name:    "student reads another user's friends",
+			handler: a.getAllFriends,
+			req:     withClaims(getAllFriendsRequest("7"), 5, RoleStudent),
+			want:    http.StatusForbidden,
+		},
+		{
+			name:    "student adds a friendship for another user",
+			handler: a.addFriend,
+			req:     withClaims(httptest.NewRequest("POST", "/addfriend?user1=7&user2=5", nil), 5, RoleStudent),
+			want:    http.StatusForbidden,
+		},
+		{
+			name:    "student adds a friendship between two other users",
+			handler: a.addFriend,
+			req:     withClaims(httptest.NewRequest("POST", "/addfriend?user1=7&user2=8", nil), 5, RoleStudent),
+			want:    http.StatusForbidden,
+		},
+		{
+			name:    "teacher adds a friendship for a student",
+			handler: a.addFriend,
+			req:     withClaims(httptest.NewRequest("POST", "/addfriend?user1=7&user2=8", nil), 5, RoleTeacher),
+			want:    http.StatusForbidden,
+		},
+		{
+			name:    "non-numeric user",
+			handler: a.getAllFriends,
+			req:     withClaims(getAllFriendsRequest("bob"), 5, RoleStudent),
+			want:    http.StatusBadRequest,
+		},
+		{
+			name:    "befriending yourself",
+			handler: a.addFriend,
+			req:     withClaims(httptest.NewRequest("POST", "/addfriend?user2=5", nil), 5, RoleStudent),
+			want:    http.StatusBadRequest,
+		},
+		{
+			name:    "requesting yourself",
+			handler: a.SendFriendRequest,
+			req:     withClaims(httptest.NewRequest("POST", "/friends/requests", strings.NewReader(`{"user_id":5}`)), 5, RoleStudent),
+			want:    http.StatusBadRequest,
+		},
+		{
+			name:    "accepting your own request",
+			handler: a.AcceptFriendRequest,
+			req:     withClaims(pathRequest("POST", "/friends/requests/5/accept", "id", "5"), 5, RoleStudent),
+			want:    http.StatusBadRequest,
+		},
+		{
+			name:    "blocking yourself",
+			handler: a.BlockUser,
+			req:     withClaims(httptest.NewRequest("POST", "/blocks", strings.NewReader(`{"user_id":5}`)), 5, RoleStudent),
+			want:    http.StatusBadRequest,
+		},
+		{
+			name:    "non-numeric unfriend",
+			handler: a.Unfriend,
+			req:     withClaims(pathRequest("DELETE", "/friends/bob", "id", "bob"), 5, RoleStudent),
+			want:    http.StatusBadRequest,
+		},
+		{
+			name:    "no claims",
+			handler: a.getAllFriends,
+			req:     getAllFriendsRequest("me"),
+			want:    http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			tt.handler(rec, tt.req)
+			if rec.Code != tt.want {
+				t.Errorf("got %d %q, want %d", rec.Code, rec.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestRoutePolicyRejectsMissingRole(t *testing.T) {
+	reached := false
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached = true })
+	for _, pattern := range []string{"POST /admin/roles", "POST /classrooms", "GET /classrooms/{id}/members", "POST /classrooms/{id}/invites", "POST /guardian/students"} {
+		rec := httptest.NewRecorder()
+		req := withClaims(httptest.NewRequest("POST", "/", nil), 5, RoleStudent)
+		requireRole(routePolicy[pattern], h).ServeHTTP(rec, req)
+		if rec.Code != http.StatusForbidden || reached {
+			t.Errorf("%s: student got %d, reached handler %v", pattern, rec.Code, reached)
+		}
+	}
+}
+
+func TestCanAccessUser(t *testing.T) {
+	a := &App{}
+	tests := []struct {
+		name   string
+		claims *Claims
+		target int64
+		access userAccess
+		want   bool
+	}{
+		{"self read", &Claims{UserID: 5, Roles: []string{RoleStudent}}, 5, readUser, true},
+		{"self act", &Claims{UserID: 5, Roles: []string{RoleStudent}}, 5, actAsUser, true},
+		{"student reads other", &Claims{UserID: 5, Roles: []string{RoleStudent}}, 7, readUser, false},
+		{"admin acts as other", &Claims{UserID: 1, Roles: []string{RoleAdmin}}, 7, actAsUser, true},
+		{"teacher acts as other", &Claims{UserID: 2, Roles: []string{RoleTeacher}}, 7, actAsUser, false},
+		{"guardian acts as other", &Claims{UserID: 3, Roles: []string{RoleGuardian}}, 7, actAsUser, false},
+	}
+	for _, tt := range tests {
+		got, err := a.canAccessUser(context.Background(), tt.claims, tt.target, tt.access)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %v, %v; want %v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func getAllFriendsRequest(user string) *http.Request {
+	return pathRequest("GET", "/getallfriends/"+user, "user", user)
+}
+
+func pathRequest(method, target, name, value string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	r.SetPathValue(name, value)
+	return r
+}
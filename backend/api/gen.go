@@ -3,47 +3,36 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
-
-	"regexp"
-
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"strings"
 )
 
-func RemoveReasoningBlock(s string) string {
-	re := regexp.MustCompile(`(?s)<reasoning>.*?</reasoning>`)
-	return re.ReplaceAllString(s, "")
-}
+const questionGuidelines = `
+QUALITY REQUIREMENTS:
+1. Cognitive Depth: higher-order thinking (application, analysis, synthesis)
+2. Specificity: clear, unambiguous focus
+3. Practical Relevance: connected to real-world applications
+4. Progressive Difficulty: include conceptual and advanced reasoning
 
-// generates a problem
-func Gen(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion("us-east-1"))
-	if err != nil {
-		http.Error(w, "failed to load aws config: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
+Avoid fluff (definitions, lists, yes/no questions).
+`
 
-	client := bedrockruntime.NewFromConfig(cfg)
-	modelID := "openai.gpt-oss-120b-1:0"
+const exampleQuestion = `\\text{A call center receives an average of 3 calls per minute. Using the Poisson distribution, calculate the probability of receiving exactly 5 calls in a 2-minute window. Show your derivation of the rate parameter.}`
 
-	var req struct {
-		Input string `json:"input"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
-		return
-	}
-	if req.Input == "" {
-		http.Error(w, "Missing input field", http.StatusBadRequest)
-		return
-	}
+// questionLevel describes who the question is for.
+func questionLevel(grade, difficulty int) string {
+	return fmt.Sprintf("The student is in grade %d. Target difficulty %d of %d: %s.",
+		grade, difficulty, maxDifficulty, difficultyLevels[difficulty])
+}
 
-	prompt := fmt.Sprintf(`
+func questionPrompt(q *Question) string {
+	return fmt.Sprintf(`
 Output a JSON only - no reasoning, no explanations, no commentary.
 You are an expert educator creating high-quality assessment questions on: %s
+%s
 
 Follow these rules strictly:
 - Generate ONE question only.
@@ -51,131 +40,255 @@ Follow these rules strictly:
 - The JSON must have exactly one key: "question_latex"
 - The value must be the LaTeX-formatted question as a single string.
 - Do NOT include any commentary, explanations, or extra text.
-
-QUALITY REQUIREMENTS:
-1. Cognitive Depth: higher-order thinking (application, analysis, synthesis)
-2. Specificity: clear, unambiguous focus
-3. Practical Relevance: connected to real-world applications
-4. Progressive Difficulty: include conceptual and advanced reasoning
-
-Avoid fluff (definitions, lists, yes/no questions).
-
+%s
 Example output format:
 {
-	"question_latex": "\\text{A call center receives an average of 3 calls per minute. Using the Poisson distribution, calculate the probability of receiving exactly 5 calls in a 2-minute window. Show your derivation of the rate parameter.}"
+	"question_latex": "%s"
+}
+`, q.Topic, questionLevel(q.Grade, q.Difficulty), questionGuidelines, exampleQuestion)
+}
+
+// questionStreamPrompt asks for bare LaTeX so tokens can be shown as they
+// arrive; the finished text is validated against questionTask afterwards.
+func questionStreamPrompt(q *Question) string {
+	return fmt.Sprintf(`
+Output the question only - no reasoning, no explanations, no commentary, no JSON.
+You are an expert educator creating high-quality assessment questions on: %s
+%s
+
+Follow these rules strictly:
+- Generate ONE question only.
+- Output ONLY the LaTeX-formatted question text.
+%s
+Example output:
+%s
+`, q.Topic, questionLevel(q.Grade, q.Difficulty), questionGuidelines, strings.ReplaceAll(exampleQuestion, `\\`, `\`))
 }
-`, req.Input)
 
-	bodyBytes, _ := json.Marshal(map[string]interface{}{
-		"model": modelID,
-		"messages": []map[string]string{
-			{"role": "user", "content": prompt},
-		},
-		"max_completion_tokens": 512,
-	})
+type genReq struct {
+	Input string `json:"input"`
+}
 
-	input := &bedrockruntime.InvokeModelInput{
-		ModelId:     aws.String(modelID),
-		ContentType: aws.String("application/json"),
-		Body:        bodyBytes,
+func decodeGenReq(w http.ResponseWriter, r *http.Request) (genReq, bool) {
+	var req genReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return req, false
 	}
+	if req.Input == "" {
+		http.Error(w, "Missing input field", http.StatusBadRequest)
+		return req, false
+	}
+	return req, true
+}
 
-	resp, err := client.InvokeModel(ctx, input)
+type genResp struct {
+	QuestionLatex string `json:"question_latex"`
+}
+
+// newQuestion fills in everything about a question except its text. The
+// difficulty comes from the student's record on the topic.
+func (a *App) newQuestion(w http.ResponseWriter, r *http.Request, req genReq, promptVersion string) (*Question, bool) {
+	uid, ok := userIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "invalid token subject", http.StatusUnauthorized)
+		return nil, false
+	}
+	grade, err := a.userGrade(r.Context(), uid)
+	if err == errNoGrade {
+		http.Error(w, "set your grade first", http.StatusConflict)
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("gen grade lookup error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return nil, false
+	}
+	difficulty, err := a.Difficulty.Current(r.Context(), uid, req.Input)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("invoke model failed: %v", err), http.StatusInternalServerError)
+		log.Printf("gen difficulty lookup error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return nil, false
+	}
+	return &Question{
+		UserID:        uid,
+		Topic:         req.Input,
+		Grade:         grade,
+		Difficulty:    difficulty,
+		PromptVersion: promptVersion,
+		Model:         a.Model.ModelID(),
+	}, true
+}
+
+// generates a problem
+func (a *App) Gen(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req, ok := decodeGenReq(w, r)
+	if !ok {
 		return
 	}
-	if resp == nil || len(resp.Body) == 0 {
-		http.Error(w, "empty response from model", http.StatusInternalServerError)
+	q, ok := a.newQuestion(w, r, req, genPromptVersion)
+	if !ok {
 		return
 	}
 
-	var modelResp struct {
-		OutputText string `json:"output_text"`
+	err := a.generateQuestion(ctx, q)
+	if errors.Is(err, errStoreQuestion) {
+		log.Printf("gen save error: %v", err)
+		http.Error(w, "failed to store question", http.StatusInternalServerError)
+		return
 	}
-	if err := json.Unmarshal(resp.Body, &modelResp); err == nil && modelResp.OutputText != "" {
-		var latexObj struct {
-			QuestionLatex string `json:"question_latex"`
-		}
-		cleaned := RemoveReasoningBlock(modelResp.OutputText)
-		if err := json.Unmarshal([]byte(cleaned), &latexObj); err == nil && latexObj.QuestionLatex != "" {
-			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-			w.Write([]byte(latexObj.QuestionLatex))
-			return
-		}
-		var openAIResp struct {
-			Choices []struct {
-				Message struct {
-					Content string `json:"content"`
-				} `json:"message"`
-			} `json:"choices"`
-		}
-		if err := json.Unmarshal([]byte(modelResp.OutputText), &openAIResp); err == nil && len(openAIResp.Choices) > 0 {
-			content := openAIResp.Choices[0].Message.Content
-			contentClean := RemoveReasoningBlock(content)
-			start := -1
-			end := -1
-			for i := 0; i < len(contentClean); i++ {
-				if contentClean[i] == '{' && start == -1 {
-					start = i
-				}
-				if contentClean[i] == '}' {
-					end = i
-				}
-			}
-			if start != -1 && end != -1 && end > start {
-				jsonStr := contentClean[start : end+1]
-				if err := json.Unmarshal([]byte(jsonStr), &latexObj); err == nil && latexObj.QuestionLatex != "" {
-					w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-					w.Write([]byte(latexObj.QuestionLatex))
-					return
-				}
-			}
-			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-			w.Write([]byte(contentClean))
-			return
-		}
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.Write([]byte(modelResp.OutputText))
+	if err != nil {
+		modelError(w, err)
 		return
 	}
 
-	var openAIResp struct {
-		Choices []struct {
-			Message struct {
-				Content string `json:"content"`
-			} `json:"message"`
-		} `json:"choices"`
+	writeJSON(w, http.StatusOK, q)
+}
+
+// errStoreQuestion wraps failures to store a question the model wrote.
+var errStoreQuestion = errors.New("store question")
+
+// generateQuestion has the model write q and stores it, as Gen does.
+func (a *App) generateQuestion(ctx context.Context, q *Question) error {
+	var out genResp
+	if err := a.completeStructured(ctx, questionTask, questionPrompt(q), &out); err != nil {
+		return err
 	}
-	if err := json.Unmarshal(resp.Body, &openAIResp); err == nil && len(openAIResp.Choices) > 0 {
-		content := openAIResp.Choices[0].Message.Content
-		var latexObj struct {
-			QuestionLatex string `json:"question_latex"`
-		}
-		contentClean := RemoveReasoningBlock(content)
-		start := -1
-		end := -1
-		for i := 0; i < len(contentClean); i++ {
-			if contentClean[i] == '{' && start == -1 {
-				start = i
+	q.QuestionLatex = out.QuestionLatex
+	if err := a.storeQuestion(ctx, q); err != nil {
+		return fmt.Errorf("%w: %w", errStoreQuestion, err)
+	}
+	return nil
+}
+
+// storeQuestion saves a generated question and starts on its answer key.
+func (a *App) storeQuestion(ctx context.Context, q *Question) error {
+	if err := a.saveQuestion(ctx, q); err != nil {
+		return err
+	}
+	go a.createAnswerKey(q)
+	return nil
+}
+
+// GenStream generates a problem like Gen but sends the LaTeX to the client as
+// Server-Sent Events while the model produces it:
+//
+//	event: token  data: {"text": "..."}
+//	event: reset  data: {}
+//	event: done   data: {"id": 1, "question_latex": "...", ...}
+//	event: error  data: {"error": "..."}
+//
+// The done event always carries a question that passed validation, and the
+// tokens the client keeps always spell it out. When the stored question
+// isn't the streamed text, because the stream failed, didn't validate or
+// wrapped the question in JSON or a code fence, a reset event tells the
+// client to discard the tokens so far and the question follows as a single
+// token.
+func (a *App) GenStream(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req, ok := decodeGenReq(w, r)
+	if !ok {
+		return
+	}
+	q, ok := a.newQuestion(w, r, req, genStreamPromptVersion)
+	if !ok {
+		return
+	}
+	sse, ok := newSSEWriter(w)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	var streamed strings.Builder
+	sent := false
+	if streamer, ok := a.Model.(StreamingModelClient); ok {
+		filter := &reasoningFilter{}
+		send := func(text string) error {
+			if text == "" {
+				return nil
 			}
-			if contentClean[i] == '}' {
-				end = i
+			streamed.WriteString(text)
+			sent = true
+			return sse.Send("token", map[string]string{"text": text})
+		}
+		err := streamer.Stream(ctx, ModelRequest{
+			Messages: []ChatMessage{{Role: "user", Content: questionStreamPrompt(q)}},
+		}, func(delta string) error {
+			return send(filter.Write(delta))
+		})
+		if err == nil {
+			err = send(filter.Flush())
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
 			}
+			log.Printf("gen stream error: %v", err)
+			streamed.Reset()
+		}
+	}
+
+	out, err := streamedQuestion(streamed.String())
+	if err != nil {
+		// Nothing usable was streamed; fall back to the validated,
+		// non-streaming path so the client still ends with a question.
+		q.PromptVersion = genPromptVersion
+		if err := a.completeStructured(ctx, questionTask, questionPrompt(q), &out); err != nil {
+			log.Printf("gen stream fallback error: %v", err)
+			_ = sse.Send("error", map[string]string{"error": "failed to generate question"})
+			return
 		}
-		if start != -1 && end != -1 && end > start {
-			jsonStr := contentClean[start : end+1]
-			if err := json.Unmarshal([]byte(jsonStr), &latexObj); err == nil && latexObj.QuestionLatex != "" {
-				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-				w.Write([]byte(latexObj.QuestionLatex))
+	}
+	if out.QuestionLatex != strings.TrimSpace(streamed.String()) {
+		if sent {
+			if err := sse.Send("reset", struct{}{}); err != nil {
 				return
 			}
 		}
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.Write([]byte(contentClean))
+		if err := sse.Send("token", map[string]string{"text": out.QuestionLatex}); err != nil {
+			return
+		}
+	}
+
+	q.QuestionLatex = out.QuestionLatex
+	if err := a.storeQuestion(ctx, q); err != nil {
+		log.Printf("gen stream save error: %v", err)
+		_ = sse.Send("error", map[string]string{"error": "failed to store question"})
 		return
 	}
+	_ = sse.Send("done", q)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(resp.Body)
+// streamedQuestion validates the accumulated stream text as a question,
+// through the same schema as Gen's output. A model that ignored the prompt
+// and answered with JSON, or fenced its answer, is accepted too.
+func streamedQuestion(text string) (genResp, error) {
+	var out genResp
+	text = strings.TrimSpace(text)
+	if fenced, ok := strings.CutPrefix(text, "```"); ok {
+		// the opening fence may carry a language tag
+		if _, body, ok := strings.Cut(fenced, "\n"); ok {
+			text = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(body), "```"))
+		}
+	}
+	raw, err := decodeOutput(questionTask, text)
+	if err != nil && json.Valid([]byte(text)) {
+		return out, err
+	}
+	if !strings.HasPrefix(text, "{") || err != nil {
+		if strings.Contains(text, "```") {
+			return out, errors.New("question has stray code fences")
+		}
+		plain, _ := json.Marshal(map[string]string{"question_latex": text})
+		if raw, err = decodeOutput(questionTask, string(plain)); err != nil {
+			return out, err
+		}
+	}
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return out, err
+	}
+	out.QuestionLatex = strings.TrimSpace(out.QuestionLatex)
+	return out, nil
 }
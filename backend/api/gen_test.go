@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStreamedQuestion(t *testing.T) {
+	const q = `Solve $x^2 - 4 = 0$ for $x$.`
+	tests := []struct {
+		name, in, want string
+	}{
+		{"plain", "\n" + q + "\n", q},
+		{"JSON", `{"question_latex": "Solve $x^2 - 4 = 0$ for $x$."}`, q},
+		{"fenced JSON", "```json\n{\"question_latex\": \"Solve $x^2 - 4 = 0$ for $x$.\"}\n```", q},
+		{"fenced LaTeX", "```latex\n" + q + "\n```", q},
+		{"starts with a brace", `{x \mid x > 2} is a set; list three members.`, `{x \mid x > 2} is a set; list three members.`},
+	}
+	for _, tt := range tests {
+		out, err := streamedQuestion(tt.in)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if out.QuestionLatex != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, out.QuestionLatex, tt.want)
+		}
+	}
+
+	for name, in := range map[string]string{
+		"empty":        "",
+		"too short":    "x = ?",
+		"too long":     strings.Repeat("x", 4001),
+		"empty JSON":   `{"question_latex": ""}`,
+		"wrong keys":   `{"question": "Solve $x^2 - 4 = 0$ for $x$."}`,
+		"stray fences": "Solve ```x^2 - 4 = 0``` for x.",
+	} {
+		if out, err := streamedQuestion(in); err == nil {
+			t.Errorf("%s: accepted %q", name, out.QuestionLatex)
+		}
+	}
+}
@@ -1,4 +1,4 @@
-module main
+module github.com/awsinrixhack-renamelater/hack_renamelater/backend/api
 
 go 1.24.5
 
@@ -27,4 +27,6 @@ require (
 	github.com/golang-jwt/jwt/v5 v5.3.0 // indirect
 	github.com/gorilla/mux v1.8.1 // indirect
 	github.com/rs/cors v1.11.1 // indirect
+	golang.org/x/crypto v0.45.0 // indirect
+	golang.org/x/sys v0.38.0 // indirect
 )
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	guardianInviteTTL = 7 * 24 * time.Hour
+	// inviteAlphabet leaves out characters that are easy to misread, like
+	// 0/O and 1/I.
+	inviteAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+)
+
+var (
+	errGuardianUnverified = errors.New("verify your email before linking a student")
+	errGuardianSameEmail  = errors.New("use an email that isn't the student's")
+)
+
+// consentMaxGrade is the highest grade that needs a guardian's consent.
+// Students up to grade 7 are mostly under 13.
+var consentMaxGrade = int(envFloat("CONSENT_MAX_GRADE", 7))
+
+// isChild reports whether a student in grade needs guardian consent. A
+// missing grade counts, so accounts can't skip consent by not setting one.
+func isChild(grade sql.NullInt64) bool {
+	return !grade.Valid || grade.Int64 <= int64(consentMaxGrade)
+}
+
+// childStatus says whether uid is a child and, if so, whether a guardian
+// has consented and whether one has approved social features. Only
+// students can be children.
+func childStatus(ctx context.Context, db dbtx, uid int64) (child, consented, social bool, err error) {
+	var grade sql.NullInt64
+	var staff bool
+	err = db.QueryRowContext(ctx, `SELECT u.grade,
+			EXISTS(SELECT 1 FROM user_roles r WHERE r.UserID = u.ID AND r.Role <> ?),
+			EXISTS(SELECT 1 FROM guardian_links g WHERE g.StudentID = u.ID),
+			EXISTS(SELECT 1 FROM guardian_links g WHERE g.StudentID = u.ID AND g.SocialApproved)
+		FROM users u WHERE u.ID=?`, RoleStudent, uid).Scan(&grade, &staff, &consented, &social)
+	if err != nil {
+		return false, false, false, fmt.Errorf("select child status: %w", err)
+	}
+	return !staff && isChild(grade), consented, social, nil
+}
+
+// socialAllowed reports whether uid may use social features: adults may,
+// children once a guardian approves.
+func socialAllowed(ctx context.Context, db dbtx, uid int64) (bool, error) {
+	child, _, social, err := childStatus(ctx, db, uid)
+	return !child || social, err
+}
+
+// socialAllowedSQL is socialAllowed as a condition on users alias u. It
+// takes consentMaxGrade as its argument.
+func socialAllowedSQL(u string) string {
+	return "(EXISTS (SELECT 1 FROM user_roles sr WHERE sr.UserID = " + u + ".ID AND sr.Role <> '" + RoleStudent + "')" +
+		" OR (" + u + ".grade IS NOT NULL AND " + u + ".grade > ?)" +
+		" OR EXISTS (SELECT 1 FROM guardian_links sg WHERE sg.StudentID = " + u + ".ID AND sg.SocialApproved))"
+}
+
+// requireSocial refuses social routes to children whose guardian hasn't
+// approved social features.
+func (a *App) requireSocial(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, _ := ClaimsFromContext(r.Context())
+		ok, err := socialAllowed(r.Context(), a.DB, c.UserID)
+		if err != nil {
+			log.Printf("social check error: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "a guardian must approve social features first", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newInviteCode returns a code like "K7QX-3MPA".
+func newInviteCode() (string, error) {
+	var b strings.Builder
+	for i := range 8 {
+		if i == 4 {
+			b.WriteByte('-')
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(inviteAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte(inviteAlphabet[n.Int64()])
+	}
+	return b.String(), nil
+}
+
+// normalizeInviteCode accepts codes typed in any case, with or without the
+// dash or spaces.
+func normalizeInviteCode(code string) string {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	if len(code) != 8 {
+		return code
+	}
+	return code[:4] + "-" + code[4:]
+}
+
+// CreateGuardianInvite gives a student a code for a guardian to redeem.
+// Redeeming it is the guardian's consent.
+func (a *App) CreateGuardianInvite(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	c, _ := ClaimsFromContext(ctx)
+	code, err := newInviteCode()
+	if err != nil {
+		log.Printf("invite code error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	expires := time.Now().Add(guardianInviteTTL)
+	_, err = a.DB.ExecContext(ctx, "INSERT INTO guardian_invites (CodeHash, StudentID, ExpiresAt) VALUES (?, ?, ?)",
+		hashToken(code), c.UserID, expires)
+	if err != nil {
+		log.Printf("insert invite error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]any{"code": code, "expires_at": expires.UTC().Format(time.RFC3339)})
+}
+
+// checkGuardian returns an error unless guardian may consent for student:
+// their email must be verified and must not be one the student uses, so a
+// child can't approve themselves from a second account.
+func checkGuardian(ctx context.Context, db dbtx, guardian, student int64) error {
+	var email sql.NullString
+	var verified, shared bool
+	err := db.QueryRowContext(ctx, `SELECT g.Email, g.EmailVerifiedAt IS NOT NULL,
+			EXISTS(SELECT 1 FROM users s WHERE s.ID=? AND s.Email = g.Email)
+			OR EXISTS(SELECT 1 FROM user_identities i WHERE i.UserID=? AND i.Email = g.Email)
+		FROM users g WHERE g.ID=?`, student, student, guardian).Scan(&email, &verified, &shared)
+	if err != nil {
+		return fmt.Errorf("select guardian email: %w", err)
+	}
+	if !email.Valid || !verified {
+		return errGuardianUnverified
+	}
+	if shared {
+		return errGuardianSameEmail
+	}
+	return nil
+}
+
+// writeGuardianError answers a failed checkGuardian.
+func writeGuardianError(w http.ResponseWriter, err error) {
+	switch err {
+	case errGuardianUnverified, errGuardianSameEmail:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		log.Printf("guardian check error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	}
+}
+
+type guardianStudent struct {
+	ID                int64  `json:"id"`
+	Username          string `json:"username"`
+	Grade             *int   `json:"grade"`
+	Score             int    `json:"score"`
+	QuestionsAnswered int    `json:"questions_answered"`
+	SocialApproved    bool   `json:"social_approved"`
+}
+
+// LinkStudent redeems a student's invite code, linking the caller as their
+// guardian. Social features stay off until the guardian approves them.
+// Only guardians with a verified email of their own may link.
+func (a *App) LinkStudent(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	c, _ := ClaimsFromContext(ctx)
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, "missing code", http.StatusBadRequest)
+		return
+	}
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("link student begin error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	hash := hashToken(normalizeInviteCode(req.Code))
+	var student int64
+	var expires time.Time
+	var used sql.NullTime
+	err = tx.QueryRowContext(ctx, "SELECT StudentID, ExpiresAt, UsedAt FROM guardian_invites WHERE CodeHash=? FOR UPDATE", hash).
+		Scan(&student, &expires, &used)
+	if err == sql.ErrNoRows || (err == nil && (used.Valid || time.Now().After(expires))) {
+		http.Error(w, "invalid or expired code", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("select invite error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if student == c.UserID {
+		http.Error(w, "you can't be your own guardian", http.StatusBadRequest)
+		return
+	}
+	if err := checkGuardian(ctx, tx, c.UserID, student); err != nil {
+		writeGuardianError(w, err)
+		return
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE guardian_invites SET UsedAt=NOW(), UsedBy=? WHERE CodeHash=?", c.UserID, hash); err != nil {
+		log.Printf("use invite error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT IGNORE INTO guardian_links (GuardianID, StudentID) VALUES (?, ?)", c.UserID, student); err != nil {
+		log.Printf("insert guardian link error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("link student commit error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", "/users/"+strconv.FormatInt(student, 10)+"/progress")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// GuardianStudents lists the caller's students.
+func (a *App) GuardianStudents(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	c, _ := ClaimsFromContext(ctx)
+	rows, err := a.DB.QueryContext(ctx, `SELECT u.ID, u.Username, u.grade, u.Score, u.questionsAnswered, g.SocialApproved
+		FROM guardian_links g JOIN users u ON u.ID = g.StudentID
+		WHERE g.GuardianID=? ORDER BY u.Username`, c.UserID)
+	if err != nil {
+		log.Printf("select guardian students error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	students := []guardianStudent{}
+	for rows.Next() {
+		var s guardianStudent
+		var grade sql.NullInt64
+		if err := rows.Scan(&s.ID, &s.Username, &grade, &s.Score, &s.QuestionsAnswered, &s.SocialApproved); err != nil {
+			log.Printf("scan guardian student error: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if grade.Valid {
+			g := int(grade.Int64)
+			s.Grade = &g
+		}
+		students = append(students, s)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("read guardian students error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, students)
+}
+
+// isGuardianOf reports whether guardian is linked to student.
+func isGuardianOf(ctx context.Context, db dbtx, guardian, student int64) (bool, error) {
+	var ok int
+	err := db.QueryRowContext(ctx, "SELECT 1 FROM guardian_links WHERE GuardianID=? AND StudentID=?", guardian, student).Scan(&ok)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("select guardian link: %w", err)
+	}
+	return true, nil
+}
+
+// guardedStudent parses the {id} path value and checks the caller is that
+// student's guardian.
+func (a *App) guardedStudent(w http.ResponseWriter, r *http.Request) (int64, int64, bool) {
+	c, _ := ClaimsFromContext(r.Context())
+	student, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid user ID", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	ok, err := isGuardianOf(r.Context(), a.DB, c.UserID, student)
+	if err != nil {
+		log.Printf("guardian check error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return 0, 0, false
+	}
+	if !ok {
+		http.Error(w, "not your student", http.StatusNotFound)
+		return 0, 0, false
+	}
+	return c.UserID, student, true
+}
+
+// SetStudentSocial approves or revokes the student's social features, like
+// friending. Approving takes the same verified email as linking. Revoking
+// keeps existing friendships so approving again restores them.
+func (a *App) SetStudentSocial(w http.ResponseWriter, r *http.Request) {
+	guardian, student, ok := a.guardedStudent(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Approved bool `json:"approved"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Approved {
+		if err := checkGuardian(r.Context(), a.DB, guardian, student); err != nil {
+			writeGuardianError(w, err)
+			return
+		}
+	}
+	_, err := a.DB.ExecContext(r.Context(), "UPDATE guardian_links SET SocialApproved=? WHERE GuardianID=? AND StudentID=?",
+		req.Approved, guardian, student)
+	if err != nil {
+		log.Printf("set social error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UnlinkStudent removes the caller as the student's guardian. A child left
+// without a guardian is restricted again.
+func (a *App) UnlinkStudent(w http.ResponseWriter, r *http.Request) {
+	guardian, student, ok := a.guardedStudent(w, r)
+	if !ok {
+		return
+	}
+	if _, err := a.DB.ExecContext(r.Context(), "DELETE FROM guardian_links WHERE GuardianID=? AND StudentID=?", guardian, student); err != nil {
+		log.Printf("unlink student error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type topicProgress struct {
+	Topic             string  `json:"topic"`
+	Difficulty        int     `json:"difficulty"`
+	QuestionsAnswered int     `json:"questions_answered"`
+	CorrectAnswers    int     `json:"correct_answers"`
+	Streak            int     `json:"streak"`
+	AvgTime           float64 `json:"avg_time"`
+}
+
+type recentAttempt struct {
+	Topic     string  `json:"topic"`
+	Correct   bool    `json:"correct"`
+	Score     float64 `json:"score"`
+	TimeTaken float64 `json:"time_taken"`
+	At        string  `json:"at"`
+}
+
+type progressResp struct {
+	Username          string          `json:"username"`
+	Score             int             `json:"score"`
+	QuestionsAnswered int             `json:"questions_answered"`
+	Topics            []topicProgress `json:"topics"`
+	Recent            []recentAttempt `json:"recent"`
+}
+
+// UserProgress is a read-only summary of a user's scores and per-topic
+// record, route: users/{user}/progress. Guardians and teachers can read
+// their students'.
+func (a *App) UserProgress(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, uid, ok := a.authorizeUser(w, r, r.PathValue("user"), readUser)
+	if !ok {
+		return
+	}
+	var p progressResp
+	err := a.DB.QueryRowContext(ctx, "SELECT Username, Score, questionsAnswered FROM users WHERE ID=?", uid).
+		Scan(&p.Username, &p.Score, &p.QuestionsAnswered)
+	if err == sql.ErrNoRows {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("progress select user error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if p.Topics, err = topicProgressFor(ctx, a.DB, uid); err != nil {
+		log.Printf("progress topics error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if p.Recent, err = recentAttemptsFor(ctx, a.DB, uid, 20); err != nil {
+		log.Printf("progress attempts error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+func topicProgressFor(ctx context.Context, db dbtx, uid int64) ([]topicProgress, error) {
+	rows, err := db.QueryContext(ctx, `SELECT Topic, CurrentDifficulty, QuestionsAnswered, CorrectAnswers, Streak, TotalTime
+		FROM user_topic_stats WHERE UserID=? ORDER BY UpdatedAt DESC`, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	topics := []topicProgress{}
+	for rows.Next() {
+		var t topicProgress
+		var total float64
+		if err := rows.Scan(&t.Topic, &t.Difficulty, &t.QuestionsAnswered, &t.CorrectAnswers, &t.Streak, &total); err != nil {
+			return nil, err
+		}
+		if t.QuestionsAnswered > 0 {
+			t.AvgTime = total / float64(t.QuestionsAnswered)
+		}
+		topics = append(topics, t)
+	}
+	return topics, rows.Err()
+}
+
+func recentAttemptsFor(ctx context.Context, db dbtx, uid int64, limit int) ([]recentAttempt, error) {
+	rows, err := db.QueryContext(ctx, `SELECT Topic, Correct, Score, TimeTaken, CreatedAt
+		FROM attempts WHERE UserID=? ORDER BY CreatedAt DESC, ID DESC LIMIT ?`, uid, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	attempts := []recentAttempt{}
+	for rows.Next() {
+		var at recentAttempt
+		var created time.Time
+		if err := rows.Scan(&at.Topic, &at.Correct, &at.Score, &at.TimeTaken, &created); err != nil {
+			return nil, err
+		}
+		at.At = created.UTC().Format(time.RFC3339)
+		attempts = append(attempts, at)
+	}
+	return attempts, rows.Err()
+}
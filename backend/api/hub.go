@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// subscriberBuffer is how many updates a stream may fall behind by
+	// before it is dropped. A dropped client reconnects and refetches the
+	// board rather than slowing every other stream down.
+	subscriberBuffer = 32
+	// hubQueue is how many score changes may wait for the hub; more are
+	// dropped, since boards can be refetched.
+	hubQueue        = 256
+	maxStreamScopes = 8
+	pingInterval    = 25 * time.Second
+)
+
+var (
+	errHubFull   = errors.New("too many leaderboard streams")
+	errHubClosed = errors.New("server is shutting down")
+)
+
+// boardUpdate is a score change as one board sees it: the user's new score
+// and rank in the board's window, and the points that changed it.
+type boardUpdate struct {
+	Scope    string `json:"scope"`
+	Window   string `json:"window"`
+	ScopeID  int64  `json:"scope_id,omitempty"`
+	UserID   int64  `json:"user_id"`
+	Username string `json:"username"`
+	Points   int    `json:"points"`
+	Score    int64  `json:"score"`
+	Rank     int    `json:"rank"`
+}
+
+type scoreEvent struct {
+	userID int64
+	points int
+}
+
+// subscriber is one leaderboard stream. The hub closes updates when it
+// drops the stream or shuts down.
+type subscriber struct {
+	viewer  int64
+	boards  []*leaderboard
+	updates chan boardUpdate
+}
+
+// Hub fans score changes out to leaderboard streams. Publish never blocks:
+// changes queue for a single worker that ranks each one once per watched
+// board and viewer and hands it to subscribers without waiting on slow ones.
+type Hub struct {
+	db         *sql.DB
+	maxSubs    int
+	maxPerUser int
+	events     chan scoreEvent
+
+	mu      sync.Mutex
+	closed  bool
+	subs    map[*subscriber]struct{}
+	topics  map[string]map[*subscriber]struct{}
+	perUser map[int64]int
+}
+
+func NewHub(db *sql.DB) *Hub {
+	return &Hub{
+		db:         db,
+		maxSubs:    int(envFloat("LEADERBOARD_STREAMS_MAX", 2000)),
+		maxPerUser: int(envFloat("LEADERBOARD_STREAMS_PER_USER", 4)),
+		events:     make(chan scoreEvent, hubQueue),
+		subs:       map[*subscriber]struct{}{},
+		topics:     map[string]map[*subscriber]struct{}{},
+		perUser:    map[int64]int{},
+	}
+}
+
+// Publish reports that uid's score changed by points.
+func (h *Hub) Publish(uid int64, points int) {
+	if h == nil {
+		return
+	}
+	select {
+	case h.events <- scoreEvent{userID: uid, points: points}:
+	default:
+		log.Printf("leaderboard hub queue full, dropping update for user %d", uid)
+	}
+}
+
+// Subscribe registers a stream watching boards, all for the same viewer.
+func (h *Hub) Subscribe(viewer int64, boards []*leaderboard) (*subscriber, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, errHubClosed
+	}
+	if len(h.subs) >= h.maxSubs || h.perUser[viewer] >= h.maxPerUser {
+		return nil, errHubFull
+	}
+	s := &subscriber{viewer: viewer, boards: boards, updates: make(chan boardUpdate, subscriberBuffer)}
+	h.subs[s] = struct{}{}
+	h.perUser[viewer]++
+	for _, b := range boards {
+		if h.topics[b.topic()] == nil {
+			h.topics[b.topic()] = map[*subscriber]struct{}{}
+		}
+		h.topics[b.topic()][s] = struct{}{}
+	}
+	return s, nil
+}
+
+// Unsubscribe removes s and closes its updates, unless the hub already did.
+func (h *Hub) Unsubscribe(s *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(s)
+}
+
+// remove must be called with mu held.
+func (h *Hub) remove(s *subscriber) {
+	if _, ok := h.subs[s]; !ok {
+		return
+	}
+	delete(h.subs, s)
+	if h.perUser[s.viewer]--; h.perUser[s.viewer] == 0 {
+		delete(h.perUser, s.viewer)
+	}
+	for _, b := range s.boards {
+		delete(h.topics[b.topic()], s)
+		if len(h.topics[b.topic()]) == 0 {
+			delete(h.topics, b.topic())
+		}
+	}
+	close(s.updates)
+}
+
+// Close ends every stream and refuses new ones, so in-flight stream
+// handlers return and the server can shut down.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for s := range h.subs {
+		h.remove(s)
+	}
+}
+
+// Run handles published score changes until ctx is done.
+func (h *Hub) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-h.events:
+			if err := h.deliver(ctx, ev); err != nil {
+				log.Printf("leaderboard hub error: %v", err)
+			}
+		}
+	}
+}
+
+// deliver sends ev to the streams watching a board the user is on. Boards
+// hide blocked users from their viewer, so a rank is only shared between
+// one viewer's streams. Users who blocked, or were blocked by, the scorer
+// never see it, nor does anyone but the scorer see a child without social
+// approval, matching the boards.
+func (h *Hub) deliver(ctx context.Context, ev scoreEvent) error {
+	h.mu.Lock()
+	watched := map[string][]*subscriber{}
+	for topic, subs := range h.topics {
+		for s := range subs {
+			watched[topic] = append(watched[topic], s)
+		}
+	}
+	h.mu.Unlock()
+	if len(watched) == 0 {
+		return nil
+	}
+
+	hidden, err := hiddenFrom(ctx, h.db, ev.userID)
+	if err != nil {
+		return err
+	}
+	social, err := socialAllowed(ctx, h.db, ev.userID)
+	if err != nil {
+		return fmt.Errorf("social allowed: %w", err)
+	}
+
+	type boardKey struct {
+		topic, window string
+		viewer        int64
+	}
+	ranked := map[boardKey]*boardUpdate{}
+	for topic, subs := range watched {
+		for _, s := range subs {
+			if s.viewer != ev.userID && (!social || hidden[s.viewer]) {
+				continue
+			}
+			for _, b := range s.boards {
+				if b.topic() != topic {
+					continue
+				}
+				key := boardKey{topic, b.window, s.viewer}
+				u, ok := ranked[key]
+				if !ok {
+					if u, err = rankUpdate(ctx, h.db, b, ev); err != nil {
+						return err
+					}
+					ranked[key] = u
+				}
+				if u != nil {
+					h.send(s, *u)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// send hands u to s, dropping s when it has fallen too far behind.
+func (h *Hub) send(s *subscriber, u boardUpdate) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[s]; !ok {
+		return
+	}
+	select {
+	case s.updates <- u:
+	default:
+		h.remove(s)
+	}
+}
+
+// rankUpdate ranks ev's user on b as of now, or returns nil when they
+// aren't on it.
+func rankUpdate(ctx context.Context, db dbtx, b *leaderboard, ev scoreEvent) (*boardUpdate, error) {
+	now := *b
+	now.since, _ = windowStart(b.window, time.Now())
+	e, err := now.rankOf(ctx, db, ev.userID)
+	if err != nil || e == nil {
+		return nil, err
+	}
+	u := &boardUpdate{Scope: b.scope, Window: b.window, UserID: e.UserID, Username: e.Username,
+		Points: ev.points, Score: e.Score, Rank: e.Rank}
+	if b.scope != "global" {
+		u.ScopeID = b.scopeID
+	}
+	return u, nil
+}
+
+// hiddenFrom returns the users who blocked, or were blocked by, uid.
+func hiddenFrom(ctx context.Context, db dbtx, uid int64) (map[int64]bool, error) {
+	rows, err := db.QueryContext(ctx, `SELECT BlockedID FROM blocks WHERE BlockerID=?
+		UNION SELECT BlockerID FROM blocks WHERE BlockedID=?`, uid, uid)
+	if err != nil {
+		return nil, fmt.Errorf("select blocks: %w", err)
+	}
+	defer rows.Close()
+	hidden := map[int64]bool{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("scan blocks: %w", err)
+		}
+		hidden[id] = true
+	}
+	return hidden, rows.Err()
+}
+
+// LeaderboardStream streams score changes on the caller's boards as
+// Server-Sent Events, route:
+// leaderboard/stream?scope=&scope=&window=&grade=&classroom=.
+// Each scope is one board, as in Leaderboard. "update" events carry a
+// user's points, new score and rank; "ping" events keep the connection
+// open. The stream ends when the client falls behind or the server shuts
+// down, after which the client should refetch the boards and reconnect.
+func (a *App) LeaderboardStream(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	c, _ := ClaimsFromContext(ctx)
+	params := r.URL.Query()
+	scopes := params["scope"]
+	if len(scopes) == 0 {
+		scopes = []string{""}
+	}
+	if len(scopes) > maxStreamScopes {
+		http.Error(w, "too many scopes, at most "+strconv.Itoa(maxStreamScopes), http.StatusBadRequest)
+		return
+	}
+	var boards []*leaderboard
+	seen := map[string]bool{}
+	for _, scope := range scopes {
+		b, ok := a.leaderboardFor(w, r, scope, params.Get("window"))
+		if !ok {
+			return
+		}
+		if !seen[b.topic()] {
+			seen[b.topic()] = true
+			boards = append(boards, b)
+		}
+	}
+
+	sub, err := a.Hub.Subscribe(c.UserID, boards)
+	if err == errHubFull {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer a.Hub.Unsubscribe(sub)
+
+	sse, ok := newSSEWriter(w)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case u, ok := <-sub.updates:
+			if !ok {
+				return
+			}
+			if err := sse.Send("update", u); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := sse.Send("ping", struct{}{}); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestHubDropsSlowSubscribers(t *testing.T) {
+	h := NewHub(nil)
+	b := &leaderboard{scope: "global", window: "all"}
+	s, err := h.Subscribe(1, []*leaderboard{b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range subscriberBuffer {
+		h.send(s, boardUpdate{UserID: 2})
+	}
+	if _, ok := h.subs[s]; !ok {
+		t.Fatal("subscriber dropped before its buffer filled")
+	}
+	h.send(s, boardUpdate{UserID: 2})
+	if _, ok := h.subs[s]; ok {
+		t.Fatal("subscriber kept after falling behind")
+	}
+	if len(h.topics) != 0 || len(h.perUser) != 0 {
+		t.Fatalf("dropped subscriber left state behind: %v %v", h.topics, h.perUser)
+	}
+	n := 0
+	for range s.updates {
+		n++
+	}
+	if n != subscriberBuffer {
+		t.Fatalf("got %d buffered updates, want %d", n, subscriberBuffer)
+	}
+	// the handler's deferred Unsubscribe must not close it again
+	h.Unsubscribe(s)
+}
+
+func TestHubLimitsAndClose(t *testing.T) {
+	h := NewHub(nil)
+	b := &leaderboard{scope: "global", window: "all"}
+	var subs []*subscriber
+	for range h.maxPerUser {
+		s, err := h.Subscribe(1, []*leaderboard{b})
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs = append(subs, s)
+	}
+	if _, err := h.Subscribe(1, []*leaderboard{b}); err != errHubFull {
+		t.Fatalf("subscribe past per-user limit: got %v, want %v", err, errHubFull)
+	}
+	if _, err := h.Subscribe(2, []*leaderboard{b}); err != nil {
+		t.Fatalf("other user: %v", err)
+	}
+
+	h.Close()
+	for _, s := range subs {
+		if _, ok := <-s.updates; ok {
+			t.Fatal("stream still open after Close")
+		}
+	}
+	if _, err := h.Subscribe(3, []*leaderboard{b}); err != errHubClosed {
+		t.Fatalf("subscribe after Close: got %v, want %v", err, errHubClosed)
+	}
+}
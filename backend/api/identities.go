@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// oidcStateTTL is how long a user has to finish signing in at the provider.
+const oidcStateTTL = 10 * time.Minute
+
+var errIdentityTaken = errors.New("identity is linked to another account")
+
+// OIDCProviders lists the identity providers for the login page.
+func (a *App) OIDCProviders(w http.ResponseWriter, r *http.Request) {
+	names := []string{}
+	for name := range a.OIDC {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	writeJSON(w, http.StatusOK, map[string][]string{"providers": names})
+}
+
+// StartOIDC begins an authorization code flow with PKCE and returns the
+// provider URL to send the browser to. The frontend keeps the returned
+// state and only posts a callback whose state matches it, so nobody can
+// sign a victim into their own account with a crafted link. Signed-in
+// callers link the identity to their account instead of signing in.
+func (a *App) StartOIDC(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	p, ok := a.OIDC[r.PathValue("provider")]
+	if !ok {
+		http.Error(w, "unknown provider", http.StatusNotFound)
+		return
+	}
+	var linkUser sql.NullInt64
+	if r.Header.Get("Authorization") != "" {
+		c, ok := a.authenticate(w, r)
+		if !ok {
+			return
+		}
+		linkUser = sql.NullInt64{Int64: c.UserID, Valid: true}
+	}
+	state, err := randomToken(32)
+	if err != nil {
+		log.Printf("oidc state error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	nonce, err := randomToken(16)
+	if err != nil {
+		log.Printf("oidc nonce error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	verifier, err := randomToken(32)
+	if err != nil {
+		log.Printf("oidc verifier error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	authURL, err := p.AuthURL(ctx, state, nonce, verifier)
+	if err != nil {
+		log.Printf("oidc %s auth url error: %v", p.Name, err)
+		http.Error(w, "identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+	_, err = a.DB.ExecContext(ctx,
+		"INSERT INTO oidc_states (StateHash, Provider, Nonce, Verifier, LinkUserID, ExpiresAt) VALUES (?, ?, ?, ?, ?, ?)",
+		hashToken(state), p.Name, nonce, verifier, linkUser, time.Now().Add(oidcStateTTL))
+	if err != nil {
+		log.Printf("oidc insert state error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"url": authURL, "state": state})
+}
+
+type oidcCallbackReq struct {
+	State string `json:"state"`
+	Code  string `json:"code"`
+}
+
+type oidcLoginResp struct {
+	*tokenResp
+	// Created is set for a new account, which has no grade yet.
+	Created bool `json:"created"`
+}
+
+// OIDCCallback finishes the flow StartOIDC began: the frontend posts the
+// code and state the provider redirected back with, and gets our usual
+// tokens. The first login with an identity creates an account for it.
+func (a *App) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req oidcCallbackReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.State == "" || req.Code == "" {
+		http.Error(w, "missing state or code", http.StatusBadRequest)
+		return
+	}
+
+	var provider, nonce, verifier string
+	var linkUser sql.NullInt64
+	var expires time.Time
+	err := a.DB.QueryRowContext(ctx, "SELECT Provider, Nonce, Verifier, LinkUserID, ExpiresAt FROM oidc_states WHERE StateHash=?",
+		hashToken(req.State)).Scan(&provider, &nonce, &verifier, &linkUser, &expires)
+	if err == sql.ErrNoRows {
+		http.Error(w, "invalid or expired state", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("oidc select state error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	// each state is good for one callback
+	res, err := a.DB.ExecContext(ctx, "DELETE FROM oidc_states WHERE StateHash=?", hashToken(req.State))
+	if err != nil {
+		log.Printf("oidc delete state error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 || time.Now().After(expires) {
+		http.Error(w, "invalid or expired state", http.StatusBadRequest)
+		return
+	}
+	p, ok := a.OIDC[provider]
+	if !ok {
+		http.Error(w, "unknown provider", http.StatusBadRequest)
+		return
+	}
+
+	id, err := p.Exchange(ctx, req.Code, verifier, nonce)
+	if err != nil {
+		log.Printf("oidc %s exchange error: %v", p.Name, err)
+		http.Error(w, "sign in failed", http.StatusUnauthorized)
+		return
+	}
+
+	uid, created, err := a.resolveIdentity(ctx, p, id, linkUser)
+	if err == errIdentityTaken {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("oidc %s resolve identity error: %v", p.Name, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	resp, err := a.issueTokens(ctx, a.DB, uid, "")
+	if err != nil {
+		log.Printf("token issue error: %v", err)
+		http.Error(w, "failed to create token", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, oidcLoginResp{tokenResp: resp, Created: created})
+}
+
+// resolveIdentity returns the user linked to id. Without one it links id
+// to linkUser when set, or else creates a user for it. Accounts are never
+// matched by email, since a provider can't vouch for addresses it doesn't
+// own.
+func (a *App) resolveIdentity(ctx context.Context, p *OIDCProvider, id *IDClaims, linkUser sql.NullInt64) (int64, bool, error) {
+	var uid int64
+	err := a.DB.QueryRowContext(ctx, "SELECT UserID FROM user_identities WHERE Issuer=? AND Subject=?", p.Issuer, id.Subject).Scan(&uid)
+	if err == nil {
+		if linkUser.Valid && linkUser.Int64 != uid {
+			return 0, false, errIdentityTaken
+		}
+		return uid, false, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, false, fmt.Errorf("select identity: %w", err)
+	}
+
+	if linkUser.Valid {
+		_, err := a.DB.ExecContext(ctx, "INSERT INTO user_identities (Issuer, Subject, UserID, Email) VALUES (?, ?, ?, ?)",
+			p.Issuer, id.Subject, linkUser.Int64, id.Email)
+		if err != nil {
+			return 0, false, fmt.Errorf("link identity: %w", err)
+		}
+		return linkUser.Int64, false, nil
+	}
+
+	uid, err = a.createIdentityUser(ctx, p, id)
+	if err != nil {
+		// a concurrent first login may have created the account already
+		var existing int64
+		if err2 := a.DB.QueryRowContext(ctx, "SELECT UserID FROM user_identities WHERE Issuer=? AND Subject=?", p.Issuer, id.Subject).Scan(&existing); err2 == nil {
+			return existing, false, nil
+		}
+		return 0, false, err
+	}
+	return uid, true, nil
+}
+
+// createIdentityUser creates a student with no password or grade for id.
+// Without a grade the account may be a child's, so the provider's email
+// isn't copied to it; it can be set once a guardian consents.
+func (a *App) createIdentityUser(ctx context.Context, p *OIDCProvider, id *IDClaims) (int64, error) {
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	username, err := pickUsername(ctx, tx, id)
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.ExecContext(ctx,
+		"INSERT INTO users (Username, Score, grade, questionsAnswered) VALUES (?, 100, NULL, 0)", username)
+	if err != nil {
+		return 0, fmt.Errorf("insert user: %w", err)
+	}
+	uid, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("user id: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO user_roles (UserID, Role) VALUES (?, ?)", uid, RoleStudent); err != nil {
+		return 0, fmt.Errorf("insert role: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO user_identities (Issuer, Subject, UserID, Email) VALUES (?, ?, ?, ?)",
+		p.Issuer, id.Subject, uid, id.Email)
+	if err != nil {
+		return 0, fmt.Errorf("insert identity: %w", err)
+	}
+	return uid, tx.Commit()
+}
+
+var usernameUnsafe = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// usernameBase derives a username from the identity's preferred username,
+// email or name.
+func usernameBase(id *IDClaims) string {
+	for _, s := range []string{id.PreferredUsername, strings.SplitN(id.Email, "@", 2)[0], id.Name} {
+		s = usernameUnsafe.ReplaceAllString(s, "")
+		if len(s) > 15 {
+			s = s[:15]
+		}
+		if s != "" {
+			return s
+		}
+	}
+	return "student"
+}
+
+// pickUsername returns the identity's base username, or the base with a
+// random number added when it is taken.
+func pickUsername(ctx context.Context, db dbtx, id *IDClaims) (string, error) {
+	base := usernameBase(id)
+	candidate := base
+	for range 10 {
+		var exists int
+		err := db.QueryRowContext(ctx, "SELECT 1 FROM users WHERE Username=? LIMIT 1", candidate).Scan(&exists)
+		if err == sql.ErrNoRows {
+			return candidate, nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("check username: %w", err)
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(10000))
+		if err != nil {
+			return "", err
+		}
+		candidate = fmt.Sprintf("%s%04d", base, n)
+	}
+	return "", errors.New("no free username")
+}
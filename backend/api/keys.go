@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// pemActivates is the PEM header giving when a key starts signing. Keys
+// are published in the JWKS as soon as they load, so adding the next key
+// ahead of its activation lets verifiers pick it up before any token uses
+// it.
+const pemActivates = "Activates"
+
+// signingKey is an Ed25519 key. kid is its RFC 7638 JWK thumbprint.
+type signingKey struct {
+	kid       string
+	priv      ed25519.PrivateKey
+	pub       ed25519.PublicKey
+	activates time.Time
+}
+
+// Keyring signs access tokens with its newest active key and verifies them
+// with any key it holds, so tokens signed before a rotation stay valid.
+// Retire a key by deleting it once accessTokenTTL has passed since its
+// successor activated.
+type Keyring struct {
+	keys atomic.Pointer[[]*signingKey]
+	dir  string
+	env  string
+}
+
+func isProduction() bool {
+	return os.Getenv("APP_ENV") == "production"
+}
+
+// NewKeyring loads PEM-encoded PKCS#8 Ed25519 keys from JWT_SIGNING_KEYS
+// and from the *.pem files in JWT_KEYS_DIR. Outside production, no keys
+// means a throwaway key is generated; in production it is an error.
+func NewKeyring() (*Keyring, error) {
+	k := &Keyring{dir: os.Getenv("JWT_KEYS_DIR"), env: os.Getenv("JWT_SIGNING_KEYS")}
+	keys, err := k.load()
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		if isProduction() {
+			return nil, errors.New("no signing keys: set JWT_KEYS_DIR or JWT_SIGNING_KEYS")
+		}
+		log.Println("no signing keys configured, using a temporary key; tokens won't survive a restart")
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		keys = []*signingKey{newSigningKey(priv, time.Time{})}
+	}
+	k.keys.Store(&keys)
+	return k, nil
+}
+
+func newSigningKey(priv ed25519.PrivateKey, activates time.Time) *signingKey {
+	pub := priv.Public().(ed25519.PublicKey)
+	// members in lexicographic order, as RFC 7638 requires
+	thumb := sha256.Sum256([]byte(`{"crv":"Ed25519","kty":"OKP","x":"` + base64.RawURLEncoding.EncodeToString(pub) + `"}`))
+	return &signingKey{kid: base64.RawURLEncoding.EncodeToString(thumb[:]), priv: priv, pub: pub, activates: activates}
+}
+
+func (k *Keyring) load() ([]*signingKey, error) {
+	var keys []*signingKey
+	if k.env != "" {
+		parsed, err := parseSigningKeys([]byte(k.env))
+		if err != nil {
+			return nil, fmt.Errorf("JWT_SIGNING_KEYS: %w", err)
+		}
+		keys = append(keys, parsed...)
+	}
+	if k.dir != "" {
+		files, err := filepath.Glob(filepath.Join(k.dir, "*.pem"))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			data, err := os.ReadFile(f)
+			if err != nil {
+				return nil, err
+			}
+			parsed, err := parseSigningKeys(data)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", f, err)
+			}
+			keys = append(keys, parsed...)
+		}
+	}
+	// newest activation first
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].activates.After(keys[j].activates) })
+	return keys, nil
+}
+
+func parseSigningKeys(data []byte) ([]*signingKey, error) {
+	var keys []*signingKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return keys, nil
+		}
+		if block.Type != "PRIVATE KEY" {
+			continue
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		priv, ok := parsed.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("key is %T, not Ed25519", parsed)
+		}
+		var activates time.Time
+		if v := block.Headers[pemActivates]; v != "" {
+			if activates, err = time.Parse(time.RFC3339, v); err != nil {
+				return nil, fmt.Errorf("%s header: %w", pemActivates, err)
+			}
+		}
+		keys = append(keys, newSigningKey(priv, activates))
+	}
+}
+
+// watch reloads the keys until ctx is done, so a new key can be added
+// without a restart. A failed reload keeps the current keys.
+func (k *Keyring) watch(ctx context.Context, interval time.Duration) {
+	if k.dir == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			keys, err := k.load()
+			if err != nil || len(keys) == 0 {
+				log.Printf("signing keys not reloaded: %v", err)
+				continue
+			}
+			k.keys.Store(&keys)
+		}
+	}
+}
+
+// current is the newest key that has activated.
+func (k *Keyring) current() (*signingKey, error) {
+	now := time.Now()
+	for _, key := range *k.keys.Load() {
+		if !key.activates.After(now) {
+			return key, nil
+		}
+	}
+	return nil, errors.New("no active signing key")
+}
+
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	key, err := k.current()
+	if err != nil {
+		return "", err
+	}
+	t := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	t.Header["kid"] = key.kid
+	return t.SignedString(key.priv)
+}
+
+// keyFunc picks the verification key by the token's kid.
+func (k *Keyring) keyFunc(t *jwt.Token) (any, error) {
+	if t.Method.Alg() != jwt.SigningMethodEdDSA.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+	}
+	kid, _ := t.Header["kid"].(string)
+	for _, key := range *k.keys.Load() {
+		if key.kid == kid {
+			return key.pub, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown kid %q", kid)
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+}
+
+// JWKS serves the public keys, including ones not yet active.
+func (k *Keyring) JWKS(w http.ResponseWriter, r *http.Request) {
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{Keys: []jwk{}}
+	for _, key := range *k.keys.Load() {
+		set.Keys = append(set.Keys, jwk{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(key.pub),
+			Kid: key.kid,
+			Alg: "EdDSA",
+			Use: "sig",
+		})
+	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, set)
+}
+
+// runGenSigningKey implements `api gen-signing-key DIR [ACTIVATES]`. It
+// writes a new key to DIR that starts signing at ACTIVATES (RFC 3339), or
+// immediately. Schedule the next rotation by generating its key ahead of
+// time.
+func runGenSigningKey(args []string) error {
+	if len(args) < 1 {
+		return errors.New("usage: gen-signing-key DIR [ACTIVATES]")
+	}
+	activates := time.Now().UTC().Truncate(time.Second)
+	if len(args) > 1 {
+		t, err := time.Parse(time.RFC3339, args[1])
+		if err != nil {
+			return err
+		}
+		activates = t
+	}
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	key := newSigningKey(priv, activates)
+	block := &pem.Block{
+		Type:    "PRIVATE KEY",
+		Headers: map[string]string{pemActivates: activates.Format(time.RFC3339)},
+		Bytes:   der,
+	}
+	path := filepath.Join(args[0], activates.UTC().Format("20060102T150405Z")+"-"+key.kid[:8]+".pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+		return err
+	}
+	fmt.Println(path)
+	return nil
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// leaderboard is one ranking: which users it covers and the window their
+// points are summed over.
+type leaderboard struct {
+	viewer int64
+	scope  string
+	window string
+	// scopeID is the grade, classroom or, for friends, the user whose
+	// friends are ranked.
+	scopeID int64
+	since   time.Time
+}
+
+type leaderboardEntry struct {
+	Rank     int    `json:"rank"`
+	UserID   int64  `json:"user_id"`
+	Username string `json:"username"`
+	Score    int64  `json:"score"`
+}
+
+// topic names the users b ranks, whatever its window.
+func (b *leaderboard) topic() string {
+	if b.scope == "global" {
+		return b.scope
+	}
+	return b.scope + ":" + strconv.FormatInt(b.scopeID, 10)
+}
+
+// windowStart is when a window began, in UTC days; weeks start on Monday.
+// The all-time window has no start.
+func windowStart(window string, now time.Time) (time.Time, bool) {
+	today := now.UTC().Truncate(24 * time.Hour)
+	switch window {
+	case "", "all":
+		return time.Time{}, true
+	case "today":
+		return today, true
+	case "week":
+		return today.AddDate(0, 0, -(int(today.Weekday())+6)%7), true
+	}
+	return time.Time{}, false
+}
+
+// board is a derived table of (ID, Username, Points) for b. It only holds
+// students with an active account, and hides users blocked either way and
+// children without social approval from everyone but themselves.
+func (b *leaderboard) board() (string, []any) {
+	cond := `u.DeletedAt IS NULL
+		AND EXISTS (SELECT 1 FROM user_roles lr WHERE lr.UserID = u.ID AND lr.Role = ?)
+		AND (u.ID = ? OR (` + notBlockedWith("u.ID") + ` AND ` + socialAllowedSQL("u") + `))`
+	args := []any{RoleStudent, b.viewer, b.viewer, b.viewer, consentMaxGrade}
+
+	switch b.scope {
+	case "grade":
+		cond += " AND u.grade = ?"
+		args = append(args, b.scopeID)
+	case "friends":
+		cond += " AND (u.ID = ? OR EXISTS (SELECT 1 FROM friends f WHERE f.ID1 = ? AND f.ID2 = u.ID))"
+		args = append(args, b.scopeID, b.scopeID)
+	case "classroom":
+		cond += " AND EXISTS (SELECT 1 FROM classroom_members m WHERE m.ClassroomID = ? AND m.UserID = u.ID)"
+		args = append(args, b.scopeID)
+	}
+
+	if b.since.IsZero() {
+		return "SELECT u.ID, u.Username, u.Score AS Points FROM users u WHERE " + cond, args
+	}
+	// points come from attempts and challenge results
+	return `SELECT u.ID, u.Username, CAST(SUM(e.Points) AS SIGNED) AS Points
+		FROM users u JOIN (
+			SELECT UserID, Points FROM attempts WHERE CreatedAt >= ?
+			UNION ALL SELECT p.UserID, p.Points FROM challenge_players p JOIN challenges c ON c.ID = p.ChallengeID
+				WHERE p.Points > 0 AND c.FinishedAt >= ?
+		) e ON e.UserID = u.ID
+		WHERE ` + cond + ` GROUP BY u.ID, u.Username`, append([]any{b.since, b.since}, args...)
+}
+
+// page returns up to limit entries after cursor, ranked by points with
+// ties sharing a rank (1, 2, 2, 4), and the cursor of the next page.
+// Users with equal points are listed by ID so pages don't overlap.
+func (b *leaderboard) page(ctx context.Context, db dbtx, cursor *boardCursor, limit int) ([]leaderboardEntry, *boardCursor, error) {
+	from, args := b.board()
+	query := "SELECT ID, Username, Points FROM (" + from + ") b"
+	if cursor != nil {
+		query += " WHERE Points < ? OR (Points = ? AND ID > ?)"
+		args = append(args, cursor.points, cursor.points, cursor.id)
+	}
+	query += " ORDER BY Points DESC, ID LIMIT ?"
+	rows, err := db.QueryContext(ctx, query, append(args, limit+1)...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("select leaderboard: %w", err)
+	}
+	defer rows.Close()
+	entries := []leaderboardEntry{}
+	for rows.Next() {
+		var e leaderboardEntry
+		if err := rows.Scan(&e.UserID, &e.Username, &e.Score); err != nil {
+			return nil, nil, fmt.Errorf("scan leaderboard: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("select leaderboard: %w", err)
+	}
+
+	var next *boardCursor
+	if len(entries) > limit {
+		entries = entries[:limit]
+		last := entries[limit-1]
+		next = &boardCursor{points: last.Score, id: last.UserID}
+	}
+	if len(entries) == 0 {
+		return entries, nil, nil
+	}
+
+	// everyone above the page's top score outranks it, and everyone at it
+	// outranks the rest of the page
+	from, args = b.board()
+	var above, level int
+	err = db.QueryRowContext(ctx, "SELECT COALESCE(SUM(Points > ?), 0), COALESCE(SUM(Points = ?), 0) FROM ("+from+") b",
+		append([]any{entries[0].Score, entries[0].Score}, args...)...).Scan(&above, &level)
+	if err != nil {
+		return nil, nil, fmt.Errorf("rank leaderboard: %w", err)
+	}
+	topInPage := 0
+	for i := range entries {
+		switch {
+		case entries[i].Score == entries[0].Score:
+			entries[i].Rank = above + 1
+			topInPage++
+		case entries[i].Score == entries[i-1].Score:
+			entries[i].Rank = entries[i-1].Rank
+		default:
+			entries[i].Rank = above + level + i - topInPage + 1
+		}
+	}
+	return entries, next, nil
+}
+
+// rankOf returns uid's entry in b, or nil when they aren't on it.
+func (b *leaderboard) rankOf(ctx context.Context, db dbtx, uid int64) (*leaderboardEntry, error) {
+	from, args := b.board()
+	e := leaderboardEntry{UserID: uid}
+	err := db.QueryRowContext(ctx, "SELECT Username, Points FROM ("+from+") b WHERE ID=?", append(args, uid)...).
+		Scan(&e.Username, &e.Score)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("select own score: %w", err)
+	}
+	from, args = b.board()
+	err = db.QueryRowContext(ctx, "SELECT COUNT(*) + 1 FROM ("+from+") b WHERE Points > ?", append(args, e.Score)...).Scan(&e.Rank)
+	if err != nil {
+		return nil, fmt.Errorf("rank own score: %w", err)
+	}
+	return &e, nil
+}
+
+// boardCursor is the last entry of a page: its points and user ID.
+type boardCursor struct {
+	points int64
+	id     int64
+}
+
+func (c *boardCursor) String() string {
+	return strconv.FormatInt(c.points, 10) + "." + strconv.FormatInt(c.id, 10)
+}
+
+func parseBoardCursor(s string) (*boardCursor, error) {
+	points, id, ok := strings.Cut(s, ".")
+	if !ok {
+		return nil, fmt.Errorf("invalid cursor %q", s)
+	}
+	var c boardCursor
+	var err error
+	if c.points, err = strconv.ParseInt(points, 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid cursor %q", s)
+	}
+	if c.id, err = strconv.ParseInt(id, 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid cursor %q", s)
+	}
+	return &c, nil
+}
+
+// leaderboardFor checks a scope and window for the caller, defaulting to
+// the global all-time board, and writes the error when they are invalid.
+// grade= and classroom= choose the board for those scopes.
+func (a *App) leaderboardFor(w http.ResponseWriter, r *http.Request, scope, window string) (*leaderboard, bool) {
+	ctx := r.Context()
+	c, _ := ClaimsFromContext(ctx)
+	params := r.URL.Query()
+	b := &leaderboard{viewer: c.UserID, scope: scope, window: window}
+	if b.scope == "" {
+		b.scope = "global"
+	}
+	if b.window == "" {
+		b.window = "all"
+	}
+	var ok bool
+	if b.since, ok = windowStart(b.window, time.Now()); !ok {
+		http.Error(w, "window must be all, week or today", http.StatusBadRequest)
+		return nil, false
+	}
+
+	switch b.scope {
+	case "global":
+	case "friends":
+		b.scopeID = c.UserID
+	case "grade":
+		if raw := params.Get("grade"); raw != "" {
+			grade, err := strconv.Atoi(raw)
+			if err != nil || grade < 0 || grade > 12 {
+				http.Error(w, "grade out of bounds", http.StatusBadRequest)
+				return nil, false
+			}
+			b.scopeID = int64(grade)
+			break
+		}
+		grade, err := a.userGrade(ctx, c.UserID)
+		if err == errNoGrade {
+			http.Error(w, "set your grade first", http.StatusConflict)
+			return nil, false
+		}
+		if err != nil {
+			log.Printf("leaderboard grade error: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return nil, false
+		}
+		b.scopeID = int64(grade)
+	case "classroom":
+		id, err := strconv.ParseInt(params.Get("classroom"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid classroom ID", http.StatusBadRequest)
+			return nil, false
+		}
+		if !a.inClassroom(w, r, c, id) {
+			return nil, false
+		}
+		b.scopeID = id
+	default:
+		http.Error(w, "scope must be global, grade, friends or classroom", http.StatusBadRequest)
+		return nil, false
+	}
+	return b, true
+}
+
+// Leaderboard ranks students, route:
+// leaderboard?scope=&window=&grade=&classroom=&limit=&cursor=.
+// scope is global (the default), grade (the caller's, or grade=),
+// friends (the caller and their friends) or classroom (classroom=, which
+// the caller teaches or is in). window is all (the default), week or today.
+// The response has the page of entries, the caller's own entry when they
+// are on the board, and next_cursor for the following page.
+func (a *App) Leaderboard(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	c, _ := ClaimsFromContext(ctx)
+	params := r.URL.Query()
+	b, ok := a.leaderboardFor(w, r, params.Get("scope"), params.Get("window"))
+	if !ok {
+		return
+	}
+
+	limit, _, ok := pageParams(w, params.Get("limit"), "")
+	if !ok {
+		return
+	}
+	var cursor *boardCursor
+	if raw := params.Get("cursor"); raw != "" {
+		var err error
+		if cursor, err = parseBoardCursor(raw); err != nil {
+			http.Error(w, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, next, err := b.page(ctx, a.DB, cursor, limit)
+	if err != nil {
+		log.Printf("leaderboard error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	me, err := b.rankOf(ctx, a.DB, c.UserID)
+	if err != nil {
+		log.Printf("leaderboard own rank error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	resp := map[string]any{"scope": b.scope, "window": b.window, "entries": entries, "me": me, "next_cursor": nil}
+	if next != nil {
+		resp["next_cursor"] = next.String()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// inClassroom writes 403 unless the caller teaches or is in the classroom,
+// or is an admin.
+func (a *App) inClassroom(w http.ResponseWriter, r *http.Request, c *Claims, id int64) bool {
+	if c.HasRole(RoleAdmin) {
+		return true
+	}
+	var ok int
+	err := a.DB.QueryRowContext(r.Context(), `SELECT 1 FROM classrooms c WHERE c.ID=? AND (c.TeacherID=?
+		OR EXISTS (SELECT 1 FROM classroom_members m WHERE m.ClassroomID = c.ID AND m.UserID=?))`, id, c.UserID, c.UserID).Scan(&ok)
+	if err == sql.ErrNoRows {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return false
+	}
+	if err != nil {
+		log.Printf("select classroom error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
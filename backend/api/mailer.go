@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Mail is a plain-text email.
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends mail.
+type Mailer interface {
+	Send(ctx context.Context, m Mail) error
+}
+
+// NewMailer picks the mailer from MAIL_BACKEND:
+//   - "log" (default) writes messages to the log
+//   - "file" writes each message to MAIL_DIR as an .eml file
+//   - "smtp" sends through SMTP_ADDR, with SMTP_USERNAME and SMTP_PASSWORD
+//     when set; a local sink like MailHog needs neither
+//
+// MAIL_FROM is the sender address. In production the log mailer would
+// swallow verification and reset links, so a real backend must be set.
+func NewMailer() (Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "no-reply@localhost"
+	}
+	switch b := os.Getenv("MAIL_BACKEND"); b {
+	case "", "log":
+		if isProduction() {
+			return nil, fmt.Errorf("MAIL_BACKEND must be file or smtp in production")
+		}
+		return LogMailer{}, nil
+	case "file":
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = "mail"
+		}
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("mail dir: %w", err)
+		}
+		return &FileMailer{Dir: dir, From: from}, nil
+	case "smtp":
+		addr := os.Getenv("SMTP_ADDR")
+		if addr == "" {
+			return nil, fmt.Errorf("SMTP_ADDR is not set")
+		}
+		return &SMTPMailer{Addr: addr, From: from, Username: os.Getenv("SMTP_USERNAME"), Password: os.Getenv("SMTP_PASSWORD")}, nil
+	default:
+		return nil, fmt.Errorf("unknown MAIL_BACKEND %q", b)
+	}
+}
+
+// message renders m as an RFC 5322 message.
+func (m Mail) message(from string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", m.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// LogMailer logs messages instead of sending them, for development.
+type LogMailer struct{}
+
+func (LogMailer) Send(_ context.Context, m Mail) error {
+	log.Printf("mail to %s: %s\n%s", m.To, m.Subject, m.Body)
+	return nil
+}
+
+// FileMailer writes each message to its own file in Dir.
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func (f *FileMailer) Send(_ context.Context, m Mail) error {
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.NewReplacer("@", "_at_", "/", "_").Replace(m.To))
+	return os.WriteFile(filepath.Join(f.Dir, name), m.message(f.From), 0o600)
+}
+
+// SMTPMailer sends through an SMTP server, upgrading to TLS when the server
+// offers STARTTLS. A send gives up when its context ends, so a hung server
+// can't hold the caller.
+type SMTPMailer struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+func (s *SMTPMailer) Send(ctx context.Context, m Mail) error {
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return fmt.Errorf("smtp addr: %w", err)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return fmt.Errorf("smtp dial: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// unblock reads and writes when ctx is cancelled
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if err := s.send(conn, host, m); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("send mail: %w", ctx.Err())
+		}
+		return fmt.Errorf("send mail: %w", err)
+	}
+	return nil
+}
+
+// send runs the SMTP conversation that smtp.SendMail would over conn.
+func (s *SMTPMailer) send(conn net.Conn, host string, m Mail) error {
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if s.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(s.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(m.To); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(m.message(s.From)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
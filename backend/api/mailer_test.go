@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSMTPMailerGivesUpWithContext(t *testing.T) {
+	// a server that accepts the connection but never greets
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	m := &SMTPMailer{Addr: ln.Addr().String(), From: "no-reply@localhost"}
+	start := time.Now()
+	if err := m.Send(ctx, Mail{To: "a@example.com", Subject: "hi", Body: "hi"}); err == nil {
+		t.Fatal("send to a silent server succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("send took %v after its context ended", elapsed)
+	}
+}
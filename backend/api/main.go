@@ -3,49 +3,205 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/rs/cors"
 )
 
 type App struct {
-	DB *sql.DB
+	DB    *sql.DB
+	Model ModelClient
+	// OutputAttempts bounds how many times a model task is re-prompted
+	// after returning invalid output.
+	OutputAttempts int
+	Rubrics        RubricSet
+	Difficulty     *DifficultyService
+	Revoked        *RevocationList
+	Limiter        *RateLimiter
+	Mailer         Mailer
+	Keys           *Keyring
+	OIDC           map[string]*OIDCProvider
+	Hub            *Hub
 }
 
+// shutdownTimeout bounds how long in-flight requests get to finish once
+// the server is told to stop.
+const shutdownTimeout = 15 * time.Second
+
 func main() {
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "export-attempts":
+			if err := runExportAttempts(ctx, os.Args[2:]); err != nil {
+				log.Fatalf("export attempts: %v", err)
+			}
+			return
+		case "gen-signing-key":
+			if err := runGenSigningKey(os.Args[2:]); err != nil {
+				log.Fatalf("gen signing key: %v", err)
+			}
+			return
+		}
+	}
 	mux := http.NewServeMux()
 	fmt.Printf("started backend api")
 
+	keys, err := NewKeyring()
+	if err != nil {
+		log.Fatalf("cannot load signing keys: %v", err)
+	}
+	go keys.watch(ctx, time.Minute)
+
 	db, err := InitDB(ctx)
 	if err != nil {
 		log.Fatalf("cannot access db: %v", err)
 	}
-	app := &App{DB: db}
+	model, err := NewModelClient(ctx)
+	if err != nil {
+		log.Fatalf("cannot create model client: %v", err)
+	}
+	attempts, _ := strconv.Atoi(os.Getenv("MODEL_OUTPUT_ATTEMPTS"))
+	rubrics, err := LoadRubrics()
+	if err != nil {
+		log.Fatalf("cannot load rubrics: %v", err)
+	}
+	var policy DifficultyPolicy = rulesPolicy{}
+	if path := os.Getenv("DIFFICULTY_MODEL_FILE"); path != "" {
+		interval, err := time.ParseDuration(os.Getenv("DIFFICULTY_MODEL_POLL"))
+		if err != nil || interval <= 0 {
+			interval = 30 * time.Second
+		}
+		mp := newModelPolicy(path, rulesPolicy{})
+		go mp.watch(ctx, interval)
+		policy = mp
+	}
+	limits, err := NewLimitStore(db)
+	if err != nil {
+		log.Fatalf("cannot create rate limit store: %v", err)
+	}
+	mailer, err := NewMailer()
+	if err != nil {
+		log.Fatalf("cannot create mailer: %v", err)
+	}
+	providers, err := LoadOIDCProviders()
+	if err != nil {
+		log.Fatalf("cannot load oidc providers: %v", err)
+	}
+	app := &App{
+		DB:             db,
+		Model:          model,
+		OutputAttempts: attempts,
+		Rubrics:        rubrics,
+		Difficulty:     NewDifficultyService(db, policy),
+		Revoked:        NewRevocationList(db),
+		Limiter:        NewRateLimiter(limits, os.Getenv("TRUST_PROXY_HEADERS") == "1"),
+		Mailer:         mailer,
+		Keys:           keys,
+		OIDC:           providers,
+		Hub:            NewHub(db),
+	}
+
+	go app.runDeletions(ctx, time.Hour)
+	go app.Limiter.runSweeps(ctx, 10*time.Minute)
+	go app.Hub.Run(ctx)
+	go app.runChallengeExpiry(ctx, time.Minute)
 
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, "Hello, World!")
 	})
-	mux.HandleFunc("/signup", app.Signup)
-	mux.HandleFunc("/login", app.Login)
-
-	protected := http.NewServeMux()
-	protected.HandleFunc("/addfriend", app.addFriend)
-	protected.HandleFunc("/getallfriends/{user}", app.getAllFriends)
-	protected.HandleFunc("/gen", func(w http.ResponseWriter, r *http.Request) {
-		Gen(ctx, w, r)
-	})
-	protected.HandleFunc("/eval", func(w http.ResponseWriter, r *http.Request) {
-		Eval(ctx, w, r)
-	})
-	mux.Handle("/addfriend", Auth(protected))
-	mux.Handle("/getallfriends/{user}", Auth(protected))
-	mux.Handle("/gen", Auth(protected))
-	mux.Handle("/eval", Auth(protected))
+	mux.HandleFunc("GET /.well-known/jwks.json", app.Keys.JWKS)
+	mux.Handle("/signup", app.Limiter.ByIP("signup", signupIPLimit, app.Signup))
+	mux.Handle("/login", app.Limiter.ByIP("login", loginIPLimit, app.Login))
+	mux.Handle("/token/refresh", app.Limiter.ByIP("refresh", refreshIPLimit, app.RefreshToken))
+	mux.HandleFunc("GET /oidc/providers", app.OIDCProviders)
+	mux.Handle("POST /oidc/{provider}/start", app.Limiter.ByIP("oidc", oidcIPLimit, app.StartOIDC))
+	mux.Handle("POST /oidc/callback", app.Limiter.ByIP("oidc", oidcIPLimit, app.OIDCCallback))
+	mux.Handle("POST /email/verify", app.Limiter.ByIP("email", emailIPLimit, app.VerifyEmail))
+	mux.Handle("POST /password/forgot", app.Limiter.ByIP("email", emailIPLimit, app.ForgotPassword))
+	mux.Handle("POST /password/reset", app.Limiter.ByIP("email", emailIPLimit, app.ResetPassword))
+
+	app.protect(mux, "/addfriend", app.addFriend)
+	app.protect(mux, "/getallfriends/{user}", app.getAllFriends)
+	app.protect(mux, "POST /friends/requests", app.SendFriendRequest)
+	app.protect(mux, "GET /friends/requests/incoming", app.IncomingFriendRequests)
+	app.protect(mux, "GET /friends/requests/outgoing", app.OutgoingFriendRequests)
+	app.protect(mux, "POST /friends/requests/{id}/accept", app.AcceptFriendRequest)
+	app.protect(mux, "POST /friends/requests/{id}/decline", app.DeclineFriendRequest)
+	app.protect(mux, "DELETE /friends/requests/{id}", app.CancelFriendRequest)
+	app.protect(mux, "DELETE /friends/{id}", app.Unfriend)
+	app.protect(mux, "POST /blocks", app.BlockUser)
+	app.protect(mux, "DELETE /blocks/{id}", app.UnblockUser)
+	app.protect(mux, "GET /blocks", app.BlockedUsers)
+	app.protect(mux, "GET /users/search", app.SearchUsers)
+	app.protect(mux, "GET /leaderboard", app.Leaderboard)
+	app.protect(mux, "GET /leaderboard/stream", app.LeaderboardStream)
+	app.protect(mux, "POST /challenges", app.CreateChallenge)
+	app.protect(mux, "GET /challenges", app.Challenges)
+	app.protect(mux, "GET /challenges/{id}", app.Challenge)
+	app.protect(mux, "POST /challenges/{id}/accept", app.AcceptChallenge)
+	app.protect(mux, "POST /challenges/{id}/decline", app.DeclineChallenge)
+	app.protect(mux, "POST /challenges/{id}/start", app.StartChallenge)
+	app.protect(mux, "DELETE /challenges/{id}", app.CancelChallenge)
+	app.protect(mux, "/gen", app.Gen)
+	app.protect(mux, "/gen/stream", app.GenStream)
+	app.protect(mux, "/eval", app.Eval)
+	app.protect(mux, "/logout", app.Logout)
+	app.protect(mux, "POST /email", app.SetEmail)
+	app.protect(mux, "POST /grade", app.SetGrade)
+	app.protect(mux, "GET /users/{user}/progress", app.UserProgress)
+	app.protect(mux, "GET /account/export", app.ExportAccount)
+	app.protect(mux, "GET /account/deletion", app.DeletionStatus)
+	app.protect(mux, "POST /account/deletion", app.RequestDeletion)
+	app.protect(mux, "DELETE /account/deletion", app.CancelDeletion)
+	app.protect(mux, "GET /account/privacy", app.Privacy)
+	app.protect(mux, "PUT /account/privacy", app.SetPrivacy)
+	app.protect(mux, "POST /admin/roles", app.SetRoles)
+	app.protect(mux, "POST /classrooms", app.CreateClassroom)
+	app.protect(mux, "POST /classrooms/{id}/invites", app.CreateClassroomInvite)
+	app.protect(mux, "POST /classrooms/join", app.JoinClassroom)
+	app.protect(mux, "GET /classrooms/{id}/members", app.ClassroomMembers)
+	app.protect(mux, "POST /guardian/invites", app.CreateGuardianInvite)
+	app.protect(mux, "POST /guardian/students", app.LinkStudent)
+	app.protect(mux, "GET /guardian/students", app.GuardianStudents)
+	app.protect(mux, "PUT /guardian/students/{id}/social", app.SetStudentSocial)
+	app.protect(mux, "DELETE /guardian/students/{id}", app.UnlinkStudent)
 	handler := cors.Default().Handler(mux)
 
+	srv := &http.Server{Addr: ":5000", Handler: handler}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		log.Println("shutting down")
+		// leaderboard streams never go idle, so end them first
+		app.Hub.Close()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("shutdown error: %v", err)
+		}
+	}()
+
 	log.Println("listening on :5000")
-	log.Fatal(http.ListenAndServe(":5000", handler))
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
+	db.Close()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
 }
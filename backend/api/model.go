@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+const defaultModelID = "openai.gpt-oss-120b-1:0"
+
+type ChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type ModelRequest struct {
+	Messages  []ChatMessage
+	MaxTokens int
+}
+
+// ModelClient sends a chat completion request to a model backend and returns
+// the raw response body. Both backends speak the OpenAI chat-completions shape.
+type ModelClient interface {
+	Invoke(ctx context.Context, req ModelRequest) ([]byte, error)
+	ModelID() string
+}
+
+// StreamingModelClient is implemented by backends that can deliver a
+// completion incrementally. onDelta is called with each new piece of
+// assistant text in order; returning an error from it aborts the stream.
+type StreamingModelClient interface {
+	ModelClient
+	Stream(ctx context.Context, req ModelRequest, onDelta func(string) error) error
+}
+
+// NewModelClient picks a backend from the environment:
+//
+//	MODEL_BACKEND  bedrock (default) or openai
+//	MODEL_ID       model name sent with each request
+//	MODEL_REGION   AWS region for bedrock, default us-east-1
+//	MODEL_BASE_URL base URL for openai, e.g. http://localhost:8000/v1
+//	MODEL_API_KEY  optional bearer token for openai
+func NewModelClient(ctx context.Context) (ModelClient, error) {
+	modelID := os.Getenv("MODEL_ID")
+	if modelID == "" {
+		modelID = defaultModelID
+	}
+
+	switch backend := strings.ToLower(os.Getenv("MODEL_BACKEND")); backend {
+	case "", "bedrock":
+		region := os.Getenv("MODEL_REGION")
+		if region == "" {
+			region = "us-east-1"
+		}
+		return NewBedrockClient(ctx, region, modelID)
+	case "openai":
+		baseURL := os.Getenv("MODEL_BASE_URL")
+		if baseURL == "" {
+			baseURL = "http://localhost:8000/v1"
+		}
+		return NewOpenAIClient(baseURL, os.Getenv("MODEL_API_KEY"), modelID), nil
+	default:
+		return nil, fmt.Errorf("unknown MODEL_BACKEND %q", backend)
+	}
+}
+
+func chatBody(modelID string, req ModelRequest, stream bool) ([]byte, error) {
+	maxTokens := req.MaxTokens
+	if maxTokens == 0 {
+		maxTokens = 512
+	}
+	body := map[string]interface{}{
+		"model":                 modelID,
+		"messages":              req.Messages,
+		"max_completion_tokens": maxTokens,
+	}
+	if stream {
+		body["stream"] = true
+	}
+	return json.Marshal(body)
+}
+
+// chunkDelta returns the assistant text carried by one streamed
+// chat.completion.chunk payload.
+func chunkDelta(payload []byte) (string, error) {
+	var chunk struct {
+		Choices []struct {
+			Delta struct {
+				Content string `json:"content"`
+			} `json:"delta"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(payload, &chunk); err != nil {
+		return "", fmt.Errorf("decode stream chunk: %w", err)
+	}
+	if len(chunk.Choices) == 0 {
+		return "", nil
+	}
+	return chunk.Choices[0].Delta.Content, nil
+}
+
+type BedrockClient struct {
+	client  *bedrockruntime.Client
+	modelID string
+}
+
+func NewBedrockClient(ctx context.Context, region, modelID string) (*BedrockClient, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("load aws config: %w", err)
+	}
+	return &BedrockClient{client: bedrockruntime.NewFromConfig(cfg), modelID: modelID}, nil
+}
+
+func (c *BedrockClient) ModelID() string { return c.modelID }
+
+func (c *BedrockClient) Invoke(ctx context.Context, req ModelRequest) ([]byte, error) {
+	body, err := chatBody(c.modelID, req, false)
+	if err != nil {
+		return nil, fmt.Errorf("encode request: %w", err)
+	}
+	resp, err := c.client.InvokeModel(ctx, &bedrockruntime.InvokeModelInput{
+		ModelId:     aws.String(c.modelID),
+		ContentType: aws.String("application/json"),
+		Body:        body,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invoke model failed: %w", err)
+	}
+	if resp == nil || len(resp.Body) == 0 {
+		return nil, fmt.Errorf("empty response from model")
+	}
+	return resp.Body, nil
+}
+
+func (c *BedrockClient) Stream(ctx context.Context, req ModelRequest, onDelta func(string) error) error {
+	body, err := chatBody(c.modelID, req, true)
+	if err != nil {
+		return fmt.Errorf("encode request: %w", err)
+	}
+	resp, err := c.client.InvokeModelWithResponseStream(ctx, &bedrockruntime.InvokeModelWithResponseStreamInput{
+		ModelId:     aws.String(c.modelID),
+		ContentType: aws.String("application/json"),
+		Body:        body,
+	})
+	if err != nil {
+		return fmt.Errorf("invoke model stream failed: %w", err)
+	}
+	stream := resp.GetStream()
+	defer stream.Close()
+
+	for event := range stream.Events() {
+		chunk, ok := event.(*types.ResponseStreamMemberChunk)
+		if !ok {
+			continue
+		}
+		delta, err := chunkDelta(chunk.Value.Bytes)
+		if err != nil {
+			return err
+		}
+		if delta == "" {
+			continue
+		}
+		if err := onDelta(delta); err != nil {
+			return err
+		}
+	}
+	if err := stream.Err(); err != nil {
+		return fmt.Errorf("model stream: %w", err)
+	}
+	return nil
+}
+
+// OpenAIClient talks to any server exposing POST {baseURL}/chat/completions,
+// such as a local stand-in model during development.
+type OpenAIClient struct {
+	baseURL string
+	apiKey  string
+	modelID string
+	http    *http.Client
+}
+
+func NewOpenAIClient(baseURL, apiKey, modelID string) *OpenAIClient {
+	return &OpenAIClient{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		apiKey:  apiKey,
+		modelID: modelID,
+		http:    &http.Client{Timeout: 2 * time.Minute},
+	}
+}
+
+func (c *OpenAIClient) ModelID() string { return c.modelID }
+
+func (c *OpenAIClient) post(ctx context.Context, req ModelRequest, stream bool) (*http.Response, error) {
+	body, err := chatBody(c.modelID, req, stream)
+	if err != nil {
+		return nil, fmt.Errorf("encode request: %w", err)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("build request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if c.apiKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+
+	resp, err := c.http.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("invoke model failed: %w", err)
+	}
+	return resp, nil
+}
+
+func (c *OpenAIClient) Invoke(ctx context.Context, req ModelRequest) ([]byte, error) {
+	resp, err := c.post(ctx, req, false)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read model response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("model returned %s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	if len(respBody) == 0 {
+		return nil, fmt.Errorf("empty response from model")
+	}
+	return respBody, nil
+}
+
+func (c *OpenAIClient) Stream(ctx context.Context, req ModelRequest, onDelta func(string) error) error {
+	resp, err := c.post(ctx, req, true)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("model returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			return nil
+		}
+		delta, err := chunkDelta([]byte(data))
+		if err != nil {
+			return err
+		}
+		if delta == "" {
+			continue
+		}
+		if err := onDelta(delta); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("model stream: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	numericRelTol = 0.01
+	numericAbsTol = 1e-6
+)
+
+// dims holds the exponents of length, mass, time, current and amount.
+type dims [5]int
+
+// Quantity is a parsed number in SI base units.
+type Quantity struct {
+	Value float64
+	Dims  dims
+	// HasUnit is false for a bare number, which may be read in the key's unit.
+	HasUnit bool
+}
+
+type unitDef struct {
+	factor float64
+	dims   dims
+}
+
+var (
+	dimLength  = dims{1, 0, 0, 0, 0}
+	dimMass    = dims{0, 1, 0, 0, 0}
+	dimTime    = dims{0, 0, 1, 0, 0}
+	dimCurrent = dims{0, 0, 0, 1, 0}
+	dimAmount  = dims{0, 0, 0, 0, 1}
+	dimNone    = dims{}
+)
+
+var units = map[string]unitDef{
+	"m": {1, dimLength}, "km": {1e3, dimLength}, "cm": {1e-2, dimLength}, "mm": {1e-3, dimLength},
+	"um": {1e-6, dimLength}, "µm": {1e-6, dimLength}, "nm": {1e-9, dimLength},
+	"in": {0.0254, dimLength}, "ft": {0.3048, dimLength}, "yd": {0.9144, dimLength}, "mi": {1609.344, dimLength},
+	"meter": {1, dimLength}, "meters": {1, dimLength}, "metre": {1, dimLength}, "metres": {1, dimLength},
+
+	"kg": {1, dimMass}, "g": {1e-3, dimMass}, "mg": {1e-6, dimMass}, "t": {1e3, dimMass}, "lb": {0.45359237, dimMass},
+	"gram": {1e-3, dimMass}, "grams": {1e-3, dimMass},
+
+	"s": {1, dimTime}, "ms": {1e-3, dimTime}, "min": {60, dimTime}, "h": {3600, dimTime}, "hr": {3600, dimTime},
+	"sec": {1, dimTime}, "second": {1, dimTime}, "seconds": {1, dimTime},
+	"minute": {60, dimTime}, "minutes": {60, dimTime}, "hour": {3600, dimTime}, "hours": {3600, dimTime},
+	"day": {86400, dimTime}, "days": {86400, dimTime},
+
+	"A": {1, dimCurrent}, "mA": {1e-3, dimCurrent},
+	"mol": {1, dimAmount}, "mmol": {1e-3, dimAmount},
+
+	"L":  {1e-3, dims{3, 0, 0, 0, 0}},
+	"mL": {1e-6, dims{3, 0, 0, 0, 0}},
+	"Hz": {1, dims{0, 0, -1, 0, 0}}, "kHz": {1e3, dims{0, 0, -1, 0, 0}},
+	"N": {1, dims{1, 1, -2, 0, 0}}, "kN": {1e3, dims{1, 1, -2, 0, 0}},
+	"J": {1, dims{2, 1, -2, 0, 0}}, "kJ": {1e3, dims{2, 1, -2, 0, 0}},
+	"W": {1, dims{2, 1, -3, 0, 0}}, "kW": {1e3, dims{2, 1, -3, 0, 0}},
+	"Pa": {1, dims{-1, 1, -2, 0, 0}}, "kPa": {1e3, dims{-1, 1, -2, 0, 0}},
+	"V": {1, dims{2, 1, -3, -1, 0}},
+	"C": {1, dims{0, 0, 1, 1, 0}},
+
+	"%":   {0.01, dimNone},
+	"rad": {1, dimNone},
+	"deg": {math.Pi / 180, dimNone}, "°": {math.Pi / 180, dimNone},
+}
+
+var errAmbiguousAnswer = errors.New("answer is not a single quantity")
+
+var (
+	numberRe      = regexp.MustCompile(`^[+-]?(?:\d{1,3}(?:,\d{3})+|\d+)?(?:\.\d+)?(?:[eE][+-]?\d+)?`)
+	sciRe         = regexp.MustCompile(`^(?:\\times|\\cdot|[x×*·])\s*10\s*\^\s*\{?\s*([+-]?\d+)\s*\}?`)
+	denominatorRe = regexp.MustCompile(`^/\s*(\d+(?:\.\d+)?)$`)
+	fractionRe    = regexp.MustCompile(`^\\[dt]?frac\{([^{}]+)\}\{([^{}]+)\}$`)
+	leadingVarRe  = regexp.MustCompile(`^[A-Za-z]\w*\s*(?:=|≈|\\approx)\s*`)
+	latexTextRe   = regexp.MustCompile(`\\(?:text|mathrm)\{([^{}]*)\}`)
+	unitExpRe     = regexp.MustCompile(`^(.+?)(?:\^\{?([+-]?\d+)\}?|([²³]))?$`)
+	latexSpacesRe = regexp.MustCompile(`\\[,;:! ]`)
+)
+
+// parseQuantity reads answers like "0.104", "10.4%", "1.04e-1",
+// "1.04 \times 10^{-1}", "3/4" or "3 m/s".
+func parseQuantity(s string) (Quantity, error) {
+	s = strings.TrimSpace(s)
+	s = strings.Trim(s, "$")
+	s = latexTextRe.ReplaceAllString(s, "$1")
+	s = latexSpacesRe.ReplaceAllString(s, " ")
+	s = strings.ReplaceAll(s, `\%`, "%")
+	s = strings.ReplaceAll(s, `\circ`, "°")
+	s = strings.ReplaceAll(s, "^°", "°")
+	s = strings.ReplaceAll(s, "−", "-")
+	s = leadingVarRe.ReplaceAllString(s, "")
+	s = strings.TrimSuffix(strings.TrimSpace(s), ".")
+	if s == "" {
+		return Quantity{}, errAmbiguousAnswer
+	}
+
+	if m := fractionRe.FindStringSubmatch(s); m != nil {
+		s = m[1] + "/" + m[2]
+	}
+
+	num := numberRe.FindString(s)
+	if num == "" || num == "+" || num == "-" {
+		return Quantity{}, errAmbiguousAnswer
+	}
+	value, err := strconv.ParseFloat(strings.ReplaceAll(num, ",", ""), 64)
+	if err != nil {
+		return Quantity{}, errAmbiguousAnswer
+	}
+	rest := strings.TrimSpace(s[len(num):])
+
+	if m := sciRe.FindStringSubmatch(rest); m != nil {
+		exp, _ := strconv.Atoi(m[1])
+		value *= math.Pow(10, float64(exp))
+		rest = strings.TrimSpace(rest[len(m[0]):])
+	}
+
+	// A bare fraction of two numbers, like 3/4.
+	if m := denominatorRe.FindStringSubmatch(rest); m != nil {
+		d, err := strconv.ParseFloat(strings.ReplaceAll(m[1], ",", ""), 64)
+		if err != nil || d == 0 {
+			return Quantity{}, errAmbiguousAnswer
+		}
+		return Quantity{Value: value / d}, nil
+	}
+
+	if rest == "" {
+		return Quantity{Value: value}, nil
+	}
+	u, err := parseUnit(rest)
+	if err != nil {
+		return Quantity{}, err
+	}
+	return Quantity{Value: value * u.factor, Dims: u.dims, HasUnit: true}, nil
+}
+
+// parseUnit reads a product of units with optional exponents, where "/"
+// divides by the unit that follows it: "m/s^2", "kg*m/s", "km h^-1".
+func parseUnit(s string) (unitDef, error) {
+	s = strings.NewReplacer("/", " / ", "*", " ", "·", " ", `\cdot`, " ").Replace(s)
+	result := unitDef{factor: 1}
+	divide := false
+	for _, tok := range strings.Fields(s) {
+		if tok == "/" {
+			divide = true
+			continue
+		}
+		m := unitExpRe.FindStringSubmatch(tok)
+		if m == nil {
+			return unitDef{}, errAmbiguousAnswer
+		}
+		u, ok := units[m[1]]
+		if !ok {
+			return unitDef{}, errAmbiguousAnswer
+		}
+		exp := 1
+		switch {
+		case m[2] != "":
+			exp, _ = strconv.Atoi(m[2])
+		case m[3] == "²":
+			exp = 2
+		case m[3] == "³":
+			exp = 3
+		}
+		if divide {
+			exp = -exp
+			divide = false
+		}
+		result.factor *= math.Pow(u.factor, float64(exp))
+		for i := range result.dims {
+			result.dims[i] += u.dims[i] * exp
+		}
+	}
+	if divide {
+		return unitDef{}, errAmbiguousAnswer
+	}
+	return result, nil
+}
+
+// gradeNumeric compares answer with a numeric key. It returns
+// errAmbiguousAnswer when the answer should go to the model instead.
+func gradeNumeric(q *Question, key *AnswerKey, rubric Rubric, answer string) (*EvalResult, error) {
+	keyUnit := unitDef{factor: 1}
+	if key.Unit != "" {
+		u, err := parseUnit(key.Unit)
+		if err != nil {
+			return nil, err
+		}
+		keyUnit = u
+	}
+	got, err := parseQuantity(answer)
+	if err != nil {
+		return nil, err
+	}
+
+	want := key.Value * keyUnit.factor
+	var correct bool
+	if got.HasUnit {
+		if got.Dims != keyUnit.dims {
+			return nil, errAmbiguousAnswer
+		}
+		correct = closeEnough(got.Value, want)
+	} else {
+		// A bare number may be given in the key's unit or in SI terms,
+		// e.g. "10.4" or "0.104" for a key of 10.4%.
+		correct = closeEnough(got.Value, key.Value) || (keyUnit.dims == dimNone && closeEnough(got.Value, want))
+	}
+
+	expected := strconv.FormatFloat(key.Value, 'g', 6, 64)
+	if key.Unit != "" {
+		expected += " " + key.Unit
+	}
+	return keyedResult(q, rubric, "numeric", correct, expected, answer), nil
+}
+
+func closeEnough(got, want float64) bool {
+	diff := math.Abs(got - want)
+	return diff <= numericAbsTol || diff <= numericRelTol*math.Abs(want)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseQuantity(t *testing.T) {
+	speed := dims{1, 0, -1, 0, 0}
+	tests := []struct {
+		in      string
+		value   float64
+		dims    dims
+		hasUnit bool
+	}{
+		{"0.104", 0.104, dimNone, false},
+		{"$12.5$", 12.5, dimNone, false},
+		{"12.5.", 12.5, dimNone, false},
+		{"-3", -3, dimNone, false},
+		{"1,250", 1250, dimNone, false},
+		{"10.4%", 0.104, dimNone, true},
+		{`10.4\%`, 0.104, dimNone, true},
+		{"1.04e-1", 0.104, dimNone, false},
+		{"1.04E+2", 104, dimNone, false},
+		{`1.04 \times 10^{-1}`, 0.104, dimNone, false},
+		{"1.04 x 10^-1", 0.104, dimNone, false},
+		{"6.02 × 10^23 mol", 6.02e23, dimAmount, true},
+		{"3/4", 0.75, dimNone, false},
+		{`\frac{3}{4}`, 0.75, dimNone, false},
+		{"x = 5 m", 5, dimLength, true},
+		{"3 km", 3000, dimLength, true},
+		{"250 g", 0.25, dimMass, true},
+		{"20 m/s", 20, speed, true},
+		{"72 km/h", 20, speed, true},
+		{"72 km h^-1", 20, speed, true},
+		{"9.8 m/s^2", 9.8, dims{1, 0, -2, 0, 0}, true},
+		{`5 \text{cm}^2`, 5e-4, dims{2, 0, 0, 0, 0}, true},
+		{"2 kN", 2000, dims{1, 1, -2, 0, 0}, true},
+		{"90°", math.Pi / 2, dimNone, true},
+		{`90^\circ`, math.Pi / 2, dimNone, true},
+	}
+	for _, tt := range tests {
+		got, err := parseQuantity(tt.in)
+		if err != nil {
+			t.Errorf("parseQuantity(%q): %v", tt.in, err)
+			continue
+		}
+		if math.Abs(got.Value-tt.value) > 1e-12*math.Max(1, math.Abs(tt.value)) || got.Dims != tt.dims || got.HasUnit != tt.hasUnit {
+			t.Errorf("parseQuantity(%q) = %v %v %v, want %v %v %v", tt.in, got.Value, got.Dims, got.HasUnit, tt.value, tt.dims, tt.hasUnit)
+		}
+	}
+}
+
+func TestParseQuantityFallsThrough(t *testing.T) {
+	for _, in := range []string{"", "abc", "-", "x^2 + 1", "3 furlongs", "3/0", "5 m/", "about five", `\sqrt{2}`} {
+		if q, err := parseQuantity(in); err != errAmbiguousAnswer {
+			t.Errorf("parseQuantity(%q) = %v, %v; want errAmbiguousAnswer", in, q, err)
+		}
+	}
+}
+
+func TestCloseEnough(t *testing.T) {
+	tests := []struct {
+		got, want float64
+		ok        bool
+	}{
+		{100, 100, true},
+		{101, 100, true}, // exactly 1% off
+		{99, 100, true},
+		{101.01, 100, false},
+		{98.9, 100, false},
+		{-101, -100, true},
+		{0.000001, 0, true}, // exactly the absolute tolerance
+		{0.000002, 0, false},
+		{1e-7, 2e-7, true},
+	}
+	for _, tt := range tests {
+		if got := closeEnough(tt.got, tt.want); got != tt.ok {
+			t.Errorf("closeEnough(%v, %v) = %v, want %v", tt.got, tt.want, got, tt.ok)
+		}
+	}
+}
+
+func TestGradeNumeric(t *testing.T) {
+	q := &Question{ID: 1}
+	rubric := Rubric{Criteria: []Criterion{{Name: "answer", Weight: 10}}}
+	tests := []struct {
+		name      string
+		key       AnswerKey
+		answer    string
+		correct   bool
+		ambiguous bool
+	}{
+		{"percent as given", AnswerKey{Value: 10.4, Unit: "%"}, "10.4%", true, false},
+		{"percent as a bare number", AnswerKey{Value: 10.4, Unit: "%"}, "10.4", true, false},
+		{"percent as a fraction", AnswerKey{Value: 10.4, Unit: "%"}, "0.104", true, false},
+		{"percent wrong", AnswerKey{Value: 10.4, Unit: "%"}, "11%", false, false},
+		{"converted units", AnswerKey{Value: 20, Unit: "m/s"}, "72 km/h", true, false},
+		{"bare number in the key's unit", AnswerKey{Value: 20, Unit: "m/s"}, "20", true, false},
+		{"scientific notation", AnswerKey{Value: 0.00042, Unit: "m"}, `4.2 \times 10^{-4} m`, true, false},
+		{"fraction", AnswerKey{Value: 0.75}, `\frac{3}{4}`, true, false},
+		{"within 1%", AnswerKey{Value: 100}, "101", true, false},
+		{"past 1%", AnswerKey{Value: 100}, "101.01", false, false},
+		{"within the absolute tolerance", AnswerKey{Value: 0}, "0.000001", true, false},
+		{"past the absolute tolerance", AnswerKey{Value: 0}, "0.000002", false, false},
+		{"wrong dimension goes to the model", AnswerKey{Value: 20, Unit: "m/s"}, "20 m", false, true},
+		{"expression goes to the model", AnswerKey{Value: 2}, "x^2 + 1", false, true},
+		{"words go to the model", AnswerKey{Value: 2}, "two apples", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := tt.key
+			key.Kind = answerNumeric
+			result, err := gradeNumeric(q, &key, rubric, tt.answer)
+			if tt.ambiguous {
+				if err != errAmbiguousAnswer {
+					t.Fatalf("got %v, %v; want errAmbiguousAnswer", result, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Correct != tt.correct || result.Grader != "numeric" {
+				t.Errorf("correct %v by %s, want %v by numeric", result.Correct, result.Grader, tt.correct)
+			}
+			if want := map[bool]float64{true: 10, false: 0}[tt.correct]; result.Criteria[0].Points != want {
+				t.Errorf("points %v, want %v", result.Criteria[0].Points, want)
+			}
+		})
+	}
+}
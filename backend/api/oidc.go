@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwksRefetchInterval bounds how often an unknown kid makes us fetch the
+// provider's keys again.
+const jwksRefetchInterval = time.Minute
+
+// OIDCProvider is an OpenID Connect identity provider users can sign in
+// with. Its endpoints come from the issuer's discovery document, fetched on
+// first use.
+type OIDCProvider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Client       *http.Client
+
+	mu          sync.Mutex
+	meta        *oidcMetadata
+	keys        map[string]any
+	keysFetched time.Time
+}
+
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// IDClaims are the ID token claims we use.
+type IDClaims struct {
+	Nonce             string `json:"nonce"`
+	AuthorizedParty   string `json:"azp"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+	Name              string `json:"name"`
+	jwt.RegisteredClaims
+}
+
+// LoadOIDCProviders reads the providers named in OIDC_PROVIDERS, a comma
+// separated list. Provider "google" is configured by OIDC_GOOGLE_ISSUER,
+// OIDC_GOOGLE_CLIENT_ID and OIDC_GOOGLE_CLIENT_SECRET; the secret may be
+// empty for public clients. Every provider redirects back to the
+// frontend's /oidc/callback page.
+func LoadOIDCProviders() (map[string]*OIDCProvider, error) {
+	providers := map[string]*OIDCProvider{}
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		p := &OIDCProvider{
+			Name:         name,
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  appURL("/oidc/callback"),
+			Client:       &http.Client{Timeout: 10 * time.Second},
+		}
+		if p.Issuer == "" || p.ClientID == "" {
+			return nil, fmt.Errorf("oidc provider %s: %sISSUER and %sCLIENT_ID are required", name, prefix, prefix)
+		}
+		providers[name] = p
+	}
+	return providers, nil
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, u string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (p *OIDCProvider) metadata(ctx context.Context) (*oidcMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.meta != nil {
+		return p.meta, nil
+	}
+	var meta oidcMetadata
+	if err := p.getJSON(ctx, strings.TrimRight(p.Issuer, "/")+"/.well-known/openid-configuration", &meta); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if meta.Issuer != p.Issuer {
+		return nil, fmt.Errorf("discovery: issuer is %q, want %q", meta.Issuer, p.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, errors.New("discovery: missing endpoints")
+	}
+	p.meta = &meta
+	return p.meta, nil
+}
+
+// pkceChallenge is the S256 code challenge for verifier.
+func pkceChallenge(verifier string) string {
+	h := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+// AuthURL is where to send the browser to sign in.
+func (p *OIDCProvider) AuthURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(meta.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("authorization endpoint: %w", err)
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.ClientID)
+	q.Set("redirect_uri", p.RedirectURL)
+	q.Set("scope", "openid email profile")
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", pkceChallenge(verifier))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Exchange redeems an authorization code and returns the verified ID token
+// claims.
+func (p *OIDCProvider) Exchange(ctx context.Context, code, verifier, nonce string) (*IDClaims, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	if p.ClientSecret == "" {
+		form.Set("client_id", p.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token request: %w", err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("token response: %s: %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token response: %s: %s %s", resp.Status, body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return nil, errors.New("token response has no id_token")
+	}
+	return p.Verify(ctx, body.IDToken, nonce)
+}
+
+// Verify checks an ID token's signature, issuer, audience, expiry and
+// nonce.
+func (p *OIDCProvider) Verify(ctx context.Context, raw, nonce string) (*IDClaims, error) {
+	claims := &IDClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims,
+		func(t *jwt.Token) (any, error) { return p.key(ctx, t) },
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "ES256", "ES384", "EdDSA"}),
+		jwt.WithIssuer(p.Issuer),
+		jwt.WithAudience(p.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("id token: %w", err)
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("id token has no subject")
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("id token nonce mismatch")
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.ClientID {
+		return nil, errors.New("id token azp mismatch")
+	}
+	return claims, nil
+}
+
+// key finds the token's verification key, fetching the provider's keys
+// again when the kid is unknown, since that usually means they rotated.
+func (p *OIDCProvider) key(ctx context.Context, t *jwt.Token) (any, error) {
+	kid, _ := t.Header["kid"].(string)
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < jwksRefetchInterval {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := p.getJSON(ctx, meta.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+	keys := map[string]any{}
+	for _, raw := range set.Keys {
+		id, key, err := parseJWK(raw)
+		if err != nil {
+			// skip key types we don't use, like encryption keys
+			continue
+		}
+		keys[id] = key
+	}
+	p.keys = keys
+	p.keysFetched = time.Now()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown kid %q", kid)
+}
+
+// parseJWK decodes an RSA, P-256/P-384 or Ed25519 public signing key.
+func parseJWK(raw []byte) (string, any, error) {
+	var k struct {
+		Kid string `json:"kid"`
+		Kty string `json:"kty"`
+		Use string `json:"use"`
+		Crv string `json:"crv"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+	if err := json.Unmarshal(raw, &k); err != nil {
+		return "", nil, err
+	}
+	if k.Use != "" && k.Use != "sig" {
+		return "", nil, fmt.Errorf("key use %q", k.Use)
+	}
+	b64 := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := b64(k.N)
+		if err != nil {
+			return "", nil, err
+		}
+		e, err := b64(k.E)
+		if err != nil {
+			return "", nil, err
+		}
+		exp := new(big.Int).SetBytes(e)
+		if !exp.IsInt64() || exp.Int64() < 3 {
+			return "", nil, errors.New("bad RSA exponent")
+		}
+		return k.Kid, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return "", nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64(k.X)
+		if err != nil {
+			return "", nil, err
+		}
+		y, err := b64(k.Y)
+		if err != nil {
+			return "", nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		// ECDH rejects points that aren't on the curve
+		if _, err := key.ECDH(); err != nil {
+			return "", nil, err
+		}
+		return k.Kid, key, nil
+	case "OKP":
+		x, err := b64(k.X)
+		if err != nil || k.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return "", nil, errors.New("bad Ed25519 key")
+		}
+		return k.Kid, ed25519.PublicKey(x), nil
+	}
+	return "", nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// mockIdP is a minimal OpenID provider: /authorize redirects straight back
+// with a code, and /token checks the PKCE verifier before returning an ID
+// token for subject.
+type mockIdP struct {
+	*httptest.Server
+	key      *rsa.PrivateKey
+	kid      string
+	clientID string
+	subject  string
+
+	mu    sync.Mutex
+	codes map[string]url.Values // code -> authorize query
+}
+
+func newMockIdP(t *testing.T, clientID string) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIdP{key: key, kid: "k1", clientID: clientID, subject: "alice-sub", codes: map[string]url.Values{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, oidcMetadata{
+			Issuer:                m.URL,
+			AuthorizationEndpoint: m.URL + "/authorize",
+			TokenEndpoint:         m.URL + "/token",
+			JWKSURI:               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		pub := m.key.PublicKey
+		writeJSON(w, http.StatusOK, map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": m.kid,
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("GET /authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		code, _ := randomToken(16)
+		m.mu.Lock()
+		m.codes[code] = q
+		m.mu.Unlock()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?code="+code+"&state="+url.QueryEscape(q.Get("state")), http.StatusFound)
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		m.mu.Lock()
+		auth, ok := m.codes[r.PostForm.Get("code")]
+		delete(m.codes, r.PostForm.Get("code"))
+		m.mu.Unlock()
+		if !ok || r.PostForm.Get("client_id") != m.clientID || r.PostForm.Get("redirect_uri") != auth.Get("redirect_uri") ||
+			pkceChallenge(r.PostForm.Get("code_verifier")) != auth.Get("code_challenge") {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"id_token": m.idToken(t, auth.Get("nonce"))})
+	})
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func (m *mockIdP) idToken(t *testing.T, nonce string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	claims := IDClaims{
+		Nonce:         nonce,
+		Email:         "alice@school.example",
+		EmailVerified: true,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    m.URL,
+			Subject:   m.subject,
+			Audience:  jwt.ClaimStrings{m.clientID},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(5 * time.Minute)),
+		},
+	}
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	tok.Header["kid"] = m.kid
+	s, err := tok.SignedString(m.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// authorize follows the provider's auth URL and returns the code it
+// redirects back with.
+func (m *mockIdP) authorize(t *testing.T, authURL, wantState string) string {
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := loc.Query().Get("state"); got != wantState {
+		t.Fatalf("state %q, want %q", got, wantState)
+	}
+	return loc.Query().Get("code")
+}
+
+func newTestProvider(idp *mockIdP) *OIDCProvider {
+	return &OIDCProvider{
+		Name:        "mock",
+		Issuer:      idp.URL,
+		ClientID:    idp.clientID,
+		RedirectURL: "http://app.example/oidc/callback",
+		Client:      idp.Client(),
+	}
+}
+
+func TestOIDCCodeFlowWithPKCE(t *testing.T) {
+	ctx := context.Background()
+	idp := newMockIdP(t, "app")
+	p := newTestProvider(idp)
+
+	authURL, err := p.AuthURL(ctx, "st", "n1", "verifier-verifier-verifier-verifier-verif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(authURL, "code_challenge_method=S256") {
+		t.Errorf("auth url has no S256 challenge: %s", authURL)
+	}
+	code := idp.authorize(t, authURL, "st")
+	id, err := p.Exchange(ctx, code, "verifier-verifier-verifier-verifier-verif", "n1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Subject != "alice-sub" || id.Email != "alice@school.example" || !id.EmailVerified {
+		t.Errorf("claims = %+v", id)
+	}
+	if got := usernameBase(id); got != "alice" {
+		t.Errorf("usernameBase = %q, want alice", got)
+	}
+
+	// codes are single use
+	if _, err := p.Exchange(ctx, code, "verifier-verifier-verifier-verifier-verif", "n1"); err == nil {
+		t.Error("reused code accepted")
+	}
+}
+
+func TestOIDCRejects(t *testing.T) {
+	ctx := context.Background()
+	idp := newMockIdP(t, "app")
+	p := newTestProvider(idp)
+	verifier := "verifier-verifier-verifier-verifier-verif"
+
+	authURL, err := p.AuthURL(ctx, "st", "n1", verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Exchange(ctx, idp.authorize(t, authURL, "st"), "wrong-verifier", "n1"); err == nil {
+		t.Error("wrong PKCE verifier accepted")
+	}
+	if _, err := p.Exchange(ctx, idp.authorize(t, authURL, "st"), verifier, "other-nonce"); err == nil {
+		t.Error("wrong nonce accepted")
+	}
+
+	other := newTestProvider(idp)
+	other.ClientID = "someone-else"
+	if _, err := other.Verify(ctx, idp.idToken(t, "n1"), "n1"); err == nil {
+		t.Error("token for another audience accepted")
+	}
+
+	// a token signed with a key the provider doesn't publish
+	forged := newMockIdP(t, "app")
+	forged.URL, forged.kid = idp.URL, idp.kid
+	if _, err := p.Verify(ctx, forged.idToken(t, "n1"), "n1"); err == nil {
+		t.Error("forged token accepted")
+	}
+}
+
+func TestOIDCRefetchesKeysAfterRotation(t *testing.T) {
+	ctx := context.Background()
+	idp := newMockIdP(t, "app")
+	p := newTestProvider(idp)
+	if _, err := p.Verify(ctx, idp.idToken(t, "n"), "n"); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.mu.Lock()
+	idp.key, idp.kid = key, "k2"
+	idp.mu.Unlock()
+	p.keysFetched = time.Now().Add(-jwksRefetchInterval)
+	if _, err := p.Verify(ctx, idp.idToken(t, "n"), "n"); err != nil {
+		t.Fatalf("after rotation: %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// argonParams are the argon2id costs. Hashes are stored with their
+// parameters, so raising these only affects new hashes, and Login re-hashes
+// older ones as users sign in.
+type argonParams struct {
+	memory  uint32 // KiB
+	time    uint32
+	threads uint8
+	keyLen  uint32
+	saltLen int
+}
+
+// currentArgon follows the OWASP minimum for argon2id.
+var currentArgon = argonParams{memory: 19 * 1024, time: 2, threads: 1, keyLen: 32, saltLen: 16}
+
+var errBadHash = errors.New("malformed password hash")
+
+// hashPassword returns pwd hashed with argon2id in the PHC string format:
+// $argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>
+func hashPassword(pwd string) (string, error) {
+	p := currentArgon
+	salt := make([]byte, p.saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("salt: %w", err)
+	}
+	key := argon2.IDKey([]byte(pwd), salt, p.time, p.memory, p.threads, p.keyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.memory, p.time, p.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// dummyHash is checked against when a login names no account, so the
+// response takes as long as a wrong password and doesn't reveal which
+// usernames exist.
+var dummyHash = sync.OnceValue(func() string {
+	h, err := hashPassword("not a real password")
+	if err != nil {
+		log.Printf("dummy hash error: %v", err)
+	}
+	return h
+})
+
+// verifyPassword checks pwd against a stored hash. rehash is true when the
+// password matched but the hash should be replaced: it is a legacy SHA-256
+// hash or uses weaker parameters than currentArgon.
+func verifyPassword(pwd, stored string) (ok, rehash bool, err error) {
+	if !strings.HasPrefix(stored, "$argon2id$") {
+		// Legacy rows are unsalted sha256 hex, truncated to 32 characters by
+		// the old auth.Hash column.
+		h := sha256.Sum256([]byte(pwd))
+		hashed := hex.EncodeToString(h[:])
+		if len(stored) == 32 {
+			hashed = hashed[:32]
+		}
+		ok = subtle.ConstantTimeCompare([]byte(hashed), []byte(stored)) == 1
+		return ok, ok, nil
+	}
+
+	p, salt, want, err := decodeArgonHash(stored)
+	if err != nil {
+		return false, false, err
+	}
+	got := argon2.IDKey([]byte(pwd), salt, p.time, p.memory, p.threads, p.keyLen)
+	if subtle.ConstantTimeCompare(got, want) != 1 {
+		return false, false, nil
+	}
+	c := currentArgon
+	rehash = p.memory < c.memory || p.time < c.time || p.threads < c.threads || p.keyLen < c.keyLen || len(salt) < c.saltLen
+	return true, rehash, nil
+}
+
+func decodeArgonHash(s string) (p argonParams, salt, key []byte, err error) {
+	parts := strings.Split(s, "$")
+	if len(parts) != 6 {
+		return p, nil, nil, errBadHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, errBadHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return p, nil, nil, errBadHash
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return p, nil, nil, errBadHash
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(key) == 0 {
+		return p, nil, nil, errBadHash
+	}
+	p.keyLen = uint32(len(key))
+	p.saltLen = len(salt)
+	return p, salt, key, nil
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// deletionGrace is how long a deletion request waits, so it can be
+// cancelled, before the account is erased.
+var deletionGrace = time.Duration(envFloat("DELETION_GRACE_DAYS", 14) * float64(24*time.Hour))
+
+// exportSections are the queries that make up a data export, by archive
+// section. Every ? is the user's ID. Password hashes and token hashes are
+// left out; they are secrets, not data about the user.
+var exportSections = []struct {
+	name  string
+	query string
+}{
+	{"user", "SELECT * FROM users WHERE ID=?"},
+	{"roles", "SELECT Role FROM user_roles WHERE UserID=?"},
+	{"identities", "SELECT Issuer, Subject, Email, CreatedAt FROM user_identities WHERE UserID=?"},
+	{"friends", "SELECT u.ID, u.Username FROM friends f JOIN users u ON u.ID = f.ID2 WHERE f.ID1=?"},
+	{"friend_requests_sent", "SELECT ToID, CreatedAt FROM friend_requests WHERE FromID=?"},
+	{"friend_requests_received", "SELECT FromID, CreatedAt FROM friend_requests WHERE ToID=?"},
+	{"blocked", "SELECT BlockedID, CreatedAt FROM blocks WHERE BlockerID=?"},
+	{"classrooms", `SELECT c.ID, c.Name, c.TeacherID FROM classroom_members m
+		JOIN classrooms c ON c.ID = m.ClassroomID WHERE m.UserID=?`},
+	{"taught_classrooms", "SELECT ID, Name, CreatedAt FROM classrooms WHERE TeacherID=?"},
+	{"guardians", `SELECT g.GuardianID, u.Username, g.SocialApproved, g.CreatedAt FROM guardian_links g
+		JOIN users u ON u.ID = g.GuardianID WHERE g.StudentID=?`},
+	{"students", `SELECT g.StudentID, u.Username, g.SocialApproved, g.CreatedAt FROM guardian_links g
+		JOIN users u ON u.ID = g.StudentID WHERE g.GuardianID=?`},
+	{"topic_stats", "SELECT * FROM user_topic_stats WHERE UserID=? ORDER BY Topic"},
+	{"questions", `SELECT q.*, k.Kind, k.Value, k.Unit, k.Expr FROM questions q
+		LEFT JOIN question_keys k ON k.QuestionID = q.ID WHERE q.UserID=? ORDER BY q.ID`},
+	{"attempts", "SELECT * FROM attempts WHERE UserID=? ORDER BY ID"},
+	{"challenges", `SELECT c.ID, c.ChallengerID, c.OpponentID, c.Topic, c.Status, c.CreatedAt, c.FinishedAt, c.WinnerID,
+		p.StartedAt, p.Answered, p.Score, p.Points FROM challenge_players p
+		JOIN challenges c ON c.ID = p.ChallengeID WHERE p.UserID=? ORDER BY c.ID`},
+	{"challenge_answers", "SELECT * FROM challenge_answers WHERE UserID=? ORDER BY ChallengeID, CreatedAt"},
+	{"sessions", "SELECT CreatedAt, ExpiresAt, UsedAt, RevokedAt FROM refresh_tokens WHERE UserID=? ORDER BY CreatedAt"},
+	{"deletion", "SELECT RequestedAt, ScheduledFor, CancelledAt FROM account_deletions WHERE UserID=?"},
+}
+
+// queryMaps returns rows as column name to value maps.
+func queryMaps(ctx context.Context, db dbtx, query string, args ...any) ([]map[string]any, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	out := []map[string]any{}
+	for rows.Next() {
+		vals := make([]any, len(cols))
+		ptrs := make([]any, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		m := make(map[string]any, len(cols))
+		for i, col := range cols {
+			if b, ok := vals[i].([]byte); ok {
+				vals[i] = string(b)
+			}
+			m[col] = vals[i]
+		}
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
+
+// audit records an action on a user's account. Details hold IDs and
+// counts, never personal data, since the log outlives deleted accounts.
+func audit(ctx context.Context, db dbtx, actor int64, action string, subject int64, detail any) error {
+	b, err := json.Marshal(detail)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "INSERT INTO audit_log (ActorID, Action, SubjectID, Detail) VALUES (NULLIF(?, 0), ?, ?, ?)",
+		actor, action, subject, string(b))
+	if err != nil {
+		return fmt.Errorf("insert audit: %w", err)
+	}
+	return nil
+}
+
+// ExportAccount sends everything we hold about the caller as a JSON
+// download. Admins may export another user with ?user=.
+func (a *App) ExportAccount(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	c, uid, ok := a.authorizeUser(w, r, r.URL.Query().Get("user"), actAsUser)
+	if !ok {
+		return
+	}
+	archive := map[string]any{"exported_at": time.Now().UTC().Format(time.RFC3339)}
+	for _, s := range exportSections {
+		args := make([]any, strings.Count(s.query, "?"))
+		for i := range args {
+			args[i] = uid
+		}
+		rows, err := queryMaps(ctx, a.DB, s.query, args...)
+		if err != nil {
+			log.Printf("export %s error: %v", s.name, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		archive[s.name] = rows
+	}
+	if users, _ := archive["user"].([]map[string]any); len(users) == 0 {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+	if err := audit(ctx, a.DB, c.UserID, "account.export", uid, nil); err != nil {
+		log.Printf("export audit error: %v", err)
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="account-%d.json"`, uid))
+	writeJSON(w, http.StatusOK, archive)
+}
+
+// RequestDeletion schedules the caller's account for deletion after the
+// grace period. Admins may schedule another user with ?user=, for example
+// when a school asks.
+func (a *App) RequestDeletion(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	c, uid, ok := a.authorizeUser(w, r, r.URL.Query().Get("user"), actAsUser)
+	if !ok {
+		return
+	}
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("request deletion begin error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var scheduled time.Time
+	err = tx.QueryRowContext(ctx, `SELECT ScheduledFor FROM account_deletions
+		WHERE UserID=? AND CancelledAt IS NULL AND CompletedAt IS NULL FOR UPDATE`, uid).Scan(&scheduled)
+	if err == nil {
+		// already pending; keep the original date
+		writeJSON(w, http.StatusOK, map[string]string{"scheduled_for": scheduled.UTC().Format(time.RFC3339)})
+		return
+	}
+	if err != sql.ErrNoRows {
+		log.Printf("request deletion select error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	scheduled = time.Now().Add(deletionGrace)
+	res, err := tx.ExecContext(ctx, `INSERT INTO account_deletions (UserID, RequestedBy, RequestedAt, ScheduledFor)
+		SELECT ID, ?, NOW(), ? FROM users WHERE ID=? AND DeletedAt IS NULL
+		ON DUPLICATE KEY UPDATE RequestedBy=VALUES(RequestedBy), RequestedAt=VALUES(RequestedAt),
+			ScheduledFor=VALUES(ScheduledFor), CancelledAt=NULL`, c.UserID, scheduled, uid)
+	if err != nil {
+		log.Printf("request deletion insert error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+	if err := audit(ctx, tx, c.UserID, "account.deletion_requested", uid, map[string]string{"scheduled_for": scheduled.UTC().Format(time.RFC3339)}); err != nil {
+		log.Printf("request deletion audit error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("request deletion commit error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"scheduled_for": scheduled.UTC().Format(time.RFC3339)})
+}
+
+// CancelDeletion cancels a pending deletion during the grace period.
+func (a *App) CancelDeletion(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	c, uid, ok := a.authorizeUser(w, r, r.URL.Query().Get("user"), actAsUser)
+	if !ok {
+		return
+	}
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("cancel deletion begin error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, "UPDATE account_deletions SET CancelledAt=NOW() WHERE UserID=? AND CancelledAt IS NULL AND CompletedAt IS NULL", uid)
+	if err != nil {
+		log.Printf("cancel deletion error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "no pending deletion", http.StatusNotFound)
+		return
+	}
+	if err := audit(ctx, tx, c.UserID, "account.deletion_cancelled", uid, nil); err != nil {
+		log.Printf("cancel deletion audit error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("cancel deletion commit error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deletionSteps erase a user's rows. Every ? is the user's ID. Attempts
+// are kept for training the difficulty model; once the users row is
+// anonymized nothing ties them to the person.
+var deletionSteps = []struct {
+	table string
+	query string
+}{
+	{"auth", "DELETE FROM auth WHERE userID=?"},
+	{"friends", "DELETE FROM friends WHERE ID1=? OR ID2=?"},
+	{"friend_requests", "DELETE FROM friend_requests WHERE FromID=? OR ToID=?"},
+	{"blocks", "DELETE FROM blocks WHERE BlockerID=? OR BlockedID=?"},
+	{"user_roles", "DELETE FROM user_roles WHERE UserID=?"},
+	{"refresh_tokens", "DELETE FROM refresh_tokens WHERE UserID=?"},
+	{"email_tokens", "DELETE FROM email_tokens WHERE UserID=?"},
+	{"user_identities", "DELETE FROM user_identities WHERE UserID=?"},
+	{"oidc_states", "DELETE FROM oidc_states WHERE LinkUserID=?"},
+	{"guardian_links", "DELETE FROM guardian_links WHERE GuardianID=? OR StudentID=?"},
+	{"guardian_invites", "DELETE FROM guardian_invites WHERE StudentID=? OR UsedBy=?"},
+	{"classroom_members", "DELETE FROM classroom_members WHERE UserID=? OR ClassroomID IN (SELECT ID FROM classrooms WHERE TeacherID=?)"},
+	{"classroom_invites", "DELETE FROM classroom_invites WHERE ClassroomID IN (SELECT ID FROM classrooms WHERE TeacherID=?)"},
+	{"classrooms", "DELETE FROM classrooms WHERE TeacherID=?"},
+	{"challenges", "UPDATE challenges SET Status='" + challengeCancelled + "' WHERE (ChallengerID=? OR OpponentID=?) AND Status IN " + openChallengeStatuses},
+	{"user_topic_stats", "DELETE FROM user_topic_stats WHERE UserID=?"},
+	{"question_keys", "DELETE k FROM question_keys k JOIN questions q ON q.ID = k.QuestionID WHERE q.UserID=?"},
+	{"questions", "DELETE FROM questions WHERE UserID=?"},
+	{"users", `UPDATE users SET Username=CONCAT('deleted-', ID), Email=NULL, EmailVerifiedAt=NULL, grade=NULL,
+		DeletedAt=NOW() WHERE ID=?`},
+}
+
+// deleteAccount erases uid in one transaction if its deletion is still
+// due, and records what was removed.
+func (a *App) deleteAccount(ctx context.Context, uid int64) error {
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	// lock the request so a cancellation or another instance can't race us
+	var requestedBy int64
+	err = tx.QueryRowContext(ctx, `SELECT RequestedBy FROM account_deletions
+		WHERE UserID=? AND ScheduledFor <= NOW() AND CancelledAt IS NULL AND CompletedAt IS NULL FOR UPDATE`, uid).Scan(&requestedBy)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("select deletion: %w", err)
+	}
+	var username string
+	if err := tx.QueryRowContext(ctx, "SELECT Username FROM users WHERE ID=?", uid).Scan(&username); err != nil {
+		return fmt.Errorf("select user: %w", err)
+	}
+
+	removed := map[string]int64{}
+	for _, s := range deletionSteps {
+		args := make([]any, strings.Count(s.query, "?"))
+		for i := range args {
+			args[i] = uid
+		}
+		res, err := tx.ExecContext(ctx, s.query, args...)
+		if err != nil {
+			return fmt.Errorf("%s: %w", s.table, err)
+		}
+		removed[s.table], _ = res.RowsAffected()
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE account_deletions SET CompletedAt=NOW() WHERE UserID=?", uid); err != nil {
+		return fmt.Errorf("complete deletion: %w", err)
+	}
+	if err := audit(ctx, tx, requestedBy, "account.deleted", uid, removed); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	if err := a.Limiter.store.ClearFailures(ctx, loginKey(username)); err != nil {
+		log.Printf("deletion clear login failures error: %v", err)
+	}
+	return nil
+}
+
+// runDeletions erases accounts whose grace period has passed, until ctx
+// is done.
+func (a *App) runDeletions(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rows, err := a.DB.QueryContext(ctx, `SELECT UserID FROM account_deletions
+				WHERE ScheduledFor <= NOW() AND CancelledAt IS NULL AND CompletedAt IS NULL LIMIT 100`)
+			if err != nil {
+				log.Printf("select due deletions error: %v", err)
+				continue
+			}
+			var due []int64
+			for rows.Next() {
+				var uid int64
+				if err := rows.Scan(&uid); err == nil {
+					due = append(due, uid)
+				}
+			}
+			rows.Close()
+			for _, uid := range due {
+				if err := a.deleteAccount(ctx, uid); err != nil {
+					log.Printf("delete account %d error: %v", uid, err)
+				}
+			}
+		}
+	}
+}
+
+// DeletionStatus reports when the caller's account is due to be deleted,
+// or null when no deletion is pending.
+func (a *App) DeletionStatus(w http.ResponseWriter, r *http.Request) {
+	_, uid, ok := a.authorizeUser(w, r, r.URL.Query().Get("user"), actAsUser)
+	if !ok {
+		return
+	}
+	var scheduled sql.NullTime
+	err := a.DB.QueryRowContext(r.Context(), `SELECT ScheduledFor FROM account_deletions
+		WHERE UserID=? AND CancelledAt IS NULL AND CompletedAt IS NULL`, uid).Scan(&scheduled)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("deletion status error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	resp := map[string]any{"scheduled_for": nil}
+	if scheduled.Valid {
+		resp["scheduled_for"] = scheduled.Time.UTC().Format(time.RFC3339)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
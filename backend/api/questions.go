@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	genPromptVersion       = "gen-v2"
+	genStreamPromptVersion = "gen-stream-v2"
+)
+
+var errQuestionNotFound = errors.New("question not found")
+
+// Question is a generated question as stored in the questions table. Eval
+// always grades against the stored text, never against client input.
+type Question struct {
+	ID            int64     `json:"id"`
+	UserID        int64     `json:"-"`
+	Topic         string    `json:"topic"`
+	Grade         int       `json:"grade"`
+	Difficulty    int       `json:"difficulty"`
+	QuestionLatex string    `json:"question_latex"`
+	PromptVersion string    `json:"-"`
+	Model         string    `json:"-"`
+	CreatedAt     time.Time `json:"-"`
+}
+
+func (a *App) saveQuestion(ctx context.Context, q *Question) error {
+	res, err := a.DB.ExecContext(ctx,
+		"INSERT INTO questions (UserID, Topic, Grade, Difficulty, QuestionLatex, PromptVersion, Model) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		q.UserID, q.Topic, q.Grade, q.Difficulty, q.QuestionLatex, q.PromptVersion, q.Model)
+	if err != nil {
+		return fmt.Errorf("insert question: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("question id: %w", err)
+	}
+	q.ID = id
+	return nil
+}
+
+func (a *App) getQuestion(ctx context.Context, id int64) (*Question, error) {
+	q := &Question{}
+	err := a.DB.QueryRowContext(ctx,
+		"SELECT ID, UserID, Topic, Grade, Difficulty, QuestionLatex, PromptVersion, Model, CreatedAt FROM questions WHERE ID=?", id).
+		Scan(&q.ID, &q.UserID, &q.Topic, &q.Grade, &q.Difficulty, &q.QuestionLatex, &q.PromptVersion, &q.Model, &q.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errQuestionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("select question: %w", err)
+	}
+	return q, nil
+}
+
+// AnswerKey is the canonical answer the model gave for a question when it was
+// created. Kind is "numeric" when Value and Unit hold the answer,
+// "expression" when Expr does, and "other" when the answer can only be judged
+// by the model.
+type AnswerKey struct {
+	QuestionID int64
+	Kind       string
+	Value      float64
+	Unit       string
+	Expr       string
+}
+
+func (a *App) saveAnswerKey(ctx context.Context, k *AnswerKey) error {
+	var value sql.NullFloat64
+	var exprText sql.NullString
+	switch k.Kind {
+	case answerNumeric:
+		value = sql.NullFloat64{Float64: k.Value, Valid: true}
+	case answerExpression:
+		exprText = sql.NullString{String: k.Expr, Valid: true}
+	}
+	_, err := a.DB.ExecContext(ctx,
+		"INSERT INTO question_keys (QuestionID, Kind, Value, Unit, Expr, Model) VALUES (?, ?, ?, ?, ?, ?)",
+		k.QuestionID, k.Kind, value, k.Unit, exprText, a.Model.ModelID())
+	if err != nil {
+		return fmt.Errorf("insert answer key: %w", err)
+	}
+	return nil
+}
+
+// getAnswerKey returns nil without error when the question has no key yet.
+func (a *App) getAnswerKey(ctx context.Context, questionID int64) (*AnswerKey, error) {
+	k := &AnswerKey{}
+	var value sql.NullFloat64
+	var exprText sql.NullString
+	err := a.DB.QueryRowContext(ctx, "SELECT QuestionID, Kind, Value, Unit, Expr FROM question_keys WHERE QuestionID=?", questionID).
+		Scan(&k.QuestionID, &k.Kind, &value, &k.Unit, &exprText)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("select answer key: %w", err)
+	}
+	k.Value = value.Float64
+	k.Expr = exprText.String
+	return k, nil
+}
+
+// errNoGrade means the user hasn't set their grade yet.
+var errNoGrade = errors.New("grade not set")
+
+func (a *App) userGrade(ctx context.Context, userID int64) (int, error) {
+	var grade sql.NullInt64
+	err := a.DB.QueryRowContext(ctx, "SELECT grade FROM users WHERE ID=?", userID).Scan(&grade)
+	if err != nil {
+		return 0, fmt.Errorf("select grade: %w", err)
+	}
+	if !grade.Valid {
+		return 0, errNoGrade
+	}
+	return int(grade.Int64), nil
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit is a token bucket: Burst requests at once, refilled at Rate per
+// second.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+func perMinute(n float64) float64 { return n / 60 }
+func perHour(n float64) float64   { return n / 3600 }
+
+var (
+	// a classroom signs in from one address, so the IP limits allow a
+	// class-sized burst
+	loginIPLimit   = Limit{Rate: 1, Burst: 50}
+	signupIPLimit  = Limit{Rate: perMinute(6), Burst: 30}
+	refreshIPLimit = Limit{Rate: 1, Burst: 50}
+	oidcIPLimit    = Limit{Rate: 1, Burst: 50}
+	loginUserLimit = Limit{Rate: perMinute(1), Burst: 10}
+	emailIPLimit   = Limit{Rate: perMinute(2), Burst: 10}
+)
+
+// routeQuotas are per-user limits on protected routes that call the model
+// or are open to guessing. Routes sharing a name share a bucket.
+var routeQuotas = map[string]struct {
+	name  string
+	limit Limit
+}{
+	"/gen":        {"gen", Limit{Rate: perHour(envFloat("GEN_QUOTA_PER_HOUR", 60)), Burst: 20}},
+	"/gen/stream": {"gen", Limit{Rate: perHour(envFloat("GEN_QUOTA_PER_HOUR", 60)), Burst: 20}},
+	"/eval":       {"eval", Limit{Rate: perHour(envFloat("EVAL_QUOTA_PER_HOUR", 120)), Burst: 30}},
+	// invite codes are short, so guessing them is kept slow
+	"POST /guardian/students": {"guardian-link", Limit{Rate: perHour(10), Burst: 5}},
+	"POST /guardian/invites":  {"guardian-invite", Limit{Rate: perHour(10), Burst: 5}},
+	"POST /classrooms/join":   {"classroom-join", Limit{Rate: perHour(10), Burst: 5}},
+	"/addfriend":              {"friend-request", Limit{Rate: perHour(30), Burst: 10}},
+	"POST /friends/requests":  {"friend-request", Limit{Rate: perHour(30), Burst: 10}},
+	"GET /users/search":       {"search", Limit{Rate: perHour(600), Burst: 60}},
+	"GET /leaderboard":        {"leaderboard", Limit{Rate: perHour(600), Burst: 60}},
+	// each challenge generates several questions
+	"POST /challenges": {"challenge", Limit{Rate: perHour(envFloat("CHALLENGE_QUOTA_PER_HOUR", 10)), Burst: 5}},
+	// each call mails a verification link to the address given
+	"POST /email": {"email", Limit{Rate: perHour(3), Burst: 3}},
+	// exports read every table
+	"GET /account/export": {"export", Limit{Rate: perHour(2), Burst: 3}},
+}
+
+const (
+	// lockoutThreshold failed logins lock a username for lockoutBase,
+	// doubling with each further failure up to lockoutMax.
+	lockoutThreshold = 5
+	lockoutBase      = 30 * time.Second
+	lockoutMax       = time.Hour
+	// failures older than failureWindow are forgotten
+	failureWindow = 24 * time.Hour
+	// bucketTTL is longer than any limit here takes to refill, so a bucket
+	// left that long is full again and can be dropped
+	bucketTTL = 24 * time.Hour
+)
+
+func envFloat(name string, def float64) float64 {
+	if v, err := strconv.ParseFloat(os.Getenv(name), 64); err == nil && v > 0 {
+		return v
+	}
+	return def
+}
+
+func loginBackoff(failures int) time.Duration {
+	if failures < lockoutThreshold {
+		return 0
+	}
+	d := lockoutBase << min(failures-lockoutThreshold, 16)
+	return min(d, lockoutMax)
+}
+
+// LimitStore holds rate limit and lockout state. MemoryLimitStore suits a
+// single instance; DBLimitStore shares state between instances.
+type LimitStore interface {
+	// Take takes a token from key's bucket. When the bucket is empty it
+	// returns how long until the next token instead.
+	Take(ctx context.Context, key string, l Limit) (time.Duration, error)
+	// LockedUntil returns when key's lockout ends, or zero.
+	LockedUntil(ctx context.Context, key string) (time.Time, error)
+	// AddFailure counts a failed attempt for key and locks it for
+	// backoff(failures).
+	AddFailure(ctx context.Context, key string, backoff func(failures int) time.Duration) (time.Time, error)
+	// ClearFailures forgets key's failures and lockout.
+	ClearFailures(ctx context.Context, key string) error
+	// Sweep drops buckets and failures that no longer limit anyone as of
+	// now.
+	Sweep(ctx context.Context, now time.Time) error
+}
+
+// RateLimiter applies limits from a LimitStore. Store errors are logged and
+// the request allowed, so a DB hiccup doesn't lock everyone out.
+type RateLimiter struct {
+	store LimitStore
+	// trustProxy reads the client address from X-Forwarded-For, which is
+	// only safe behind a load balancer that sets it.
+	trustProxy bool
+}
+
+func NewRateLimiter(store LimitStore, trustProxy bool) *RateLimiter {
+	return &RateLimiter{store: store, trustProxy: trustProxy}
+}
+
+// NewLimitStore picks the store from RATE_LIMIT_STORE: "memory" (default)
+// or "db".
+func NewLimitStore(db *sql.DB) (LimitStore, error) {
+	switch s := os.Getenv("RATE_LIMIT_STORE"); s {
+	case "", "memory":
+		return NewMemoryLimitStore(), nil
+	case "db":
+		return &DBLimitStore{db: db}, nil
+	default:
+		return nil, fmt.Errorf("unknown RATE_LIMIT_STORE %q", s)
+	}
+}
+
+// runSweeps sweeps the store every interval until ctx is done, so keys
+// from one-off clients don't accumulate.
+func (rl *RateLimiter) runSweeps(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := rl.store.Sweep(ctx, now); err != nil {
+				log.Printf("rate limit sweep error: %v", err)
+			}
+		}
+	}
+}
+
+// allow takes a token for key and writes 429 when there is none.
+func (rl *RateLimiter) allow(w http.ResponseWriter, r *http.Request, key string, l Limit) bool {
+	wait, err := rl.store.Take(r.Context(), key, l)
+	if err != nil {
+		log.Printf("rate limit error for %s: %v", key, err)
+		return true
+	}
+	if wait > 0 {
+		tooManyRequests(w, wait)
+		return false
+	}
+	return true
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(max(wait.Seconds(), 1)))))
+	http.Error(w, "too many requests", http.StatusTooManyRequests)
+}
+
+// ByIP limits next per client address.
+func (rl *RateLimiter) ByIP(name string, l Limit, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rl.allow(w, r, name+":ip:"+rl.clientIP(r), l) {
+			next(w, r)
+		}
+	})
+}
+
+// ByUser limits next per signed-in user. It must run after Auth.
+func (rl *RateLimiter) ByUser(name string, l Limit, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uid, ok := userIDFromContext(r.Context())
+		if !ok || rl.allow(w, r, name+":user:"+strconv.FormatInt(uid, 10), l) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+func (rl *RateLimiter) clientIP(r *http.Request) string {
+	if rl.trustProxy {
+		// the load balancer appends the address it saw, so the last entry
+		// is the only one the client can't forge
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			parts := strings.Split(xff, ",")
+			return strings.TrimSpace(parts[len(parts)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func loginKey(username string) string {
+	return "login:user:" + strings.ToLower(username)
+}
+
+// checkLogin is called before a password is checked. It refuses locked
+// usernames and limits attempts per username, whichever address they come
+// from.
+func (rl *RateLimiter) checkLogin(w http.ResponseWriter, r *http.Request, username string) bool {
+	key := loginKey(username)
+	until, err := rl.store.LockedUntil(r.Context(), key)
+	if err != nil {
+		log.Printf("lockout check error: %v", err)
+	} else if wait := time.Until(until); wait > 0 {
+		tooManyRequests(w, wait)
+		return false
+	}
+	return rl.allow(w, r, key, loginUserLimit)
+}
+
+func (rl *RateLimiter) loginFailed(ctx context.Context, username string) {
+	if _, err := rl.store.AddFailure(ctx, loginKey(username), loginBackoff); err != nil {
+		log.Printf("record login failure error: %v", err)
+	}
+}
+
+func (rl *RateLimiter) loginSucceeded(ctx context.Context, username string) {
+	if err := rl.store.ClearFailures(ctx, loginKey(username)); err != nil {
+		log.Printf("clear login failures error: %v", err)
+	}
+}
+
+// MemoryLimitStore keeps limits in process memory.
+type MemoryLimitStore struct {
+	mu       sync.Mutex
+	buckets  map[string]*bucket
+	failures map[string]*failures
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type failures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+func NewMemoryLimitStore() *MemoryLimitStore {
+	return &MemoryLimitStore{buckets: make(map[string]*bucket), failures: make(map[string]*failures)}
+}
+
+// refill returns the tokens in a bucket that held tokens at last.
+func refill(tokens float64, last, now time.Time, l Limit) float64 {
+	return math.Min(float64(l.Burst), tokens+now.Sub(last).Seconds()*l.Rate)
+}
+
+// waitFor is how long until a bucket holding tokens has one.
+func waitFor(tokens float64, l Limit) time.Duration {
+	return time.Duration((1 - tokens) / l.Rate * float64(time.Second))
+}
+
+func (s *MemoryLimitStore) Take(_ context.Context, key string, l Limit) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.Burst), last: now}
+		s.buckets[key] = b
+	}
+	b.tokens = refill(b.tokens, b.last, now, l)
+	b.last = now
+	if b.tokens < 1 {
+		return waitFor(b.tokens, l), nil
+	}
+	b.tokens--
+	return 0, nil
+}
+
+// Sweep drops state that has returned to its initial value.
+func (s *MemoryLimitStore) Sweep(_ context.Context, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, b := range s.buckets {
+		if now.Sub(b.last) > bucketTTL {
+			delete(s.buckets, k)
+		}
+	}
+	for k, f := range s.failures {
+		if now.Sub(f.last) > failureWindow && now.After(f.lockedUntil) {
+			delete(s.failures, k)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryLimitStore) LockedUntil(_ context.Context, key string) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.failures[key]; ok {
+		return f.lockedUntil, nil
+	}
+	return time.Time{}, nil
+}
+
+func (s *MemoryLimitStore) AddFailure(_ context.Context, key string, backoff func(int) time.Duration) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	f, ok := s.failures[key]
+	if !ok {
+		f = &failures{}
+		s.failures[key] = f
+	}
+	if now.Sub(f.last) > failureWindow {
+		f.count = 0
+	}
+	f.count++
+	f.last = now
+	if d := backoff(f.count); d > 0 {
+		f.lockedUntil = now.Add(d)
+	}
+	return f.lockedUntil, nil
+}
+
+func (s *MemoryLimitStore) ClearFailures(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.failures, key)
+	return nil
+}
+
+// DBLimitStore keeps limits in the rate_buckets and login_failures tables,
+// so every instance behind the load balancer sees the same counts.
+type DBLimitStore struct {
+	db *sql.DB
+}
+
+func (s *DBLimitStore) Take(ctx context.Context, key string, l Limit) (time.Duration, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	tokens := float64(l.Burst)
+	var last time.Time
+	err = tx.QueryRowContext(ctx, "SELECT Tokens, UpdatedAt FROM rate_buckets WHERE BucketKey=? FOR UPDATE", key).Scan(&tokens, &last)
+	switch {
+	case err == sql.ErrNoRows:
+		last = now
+	case err != nil:
+		return 0, fmt.Errorf("select bucket: %w", err)
+	}
+	tokens = refill(tokens, last, now, l)
+
+	var wait time.Duration
+	if tokens < 1 {
+		wait = waitFor(tokens, l)
+	} else {
+		tokens--
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO rate_buckets (BucketKey, Tokens, UpdatedAt) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE Tokens=VALUES(Tokens), UpdatedAt=VALUES(UpdatedAt)`, key, tokens, now)
+	if err != nil {
+		return 0, fmt.Errorf("upsert bucket: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit: %w", err)
+	}
+	return wait, nil
+}
+
+func (s *DBLimitStore) LockedUntil(ctx context.Context, key string) (time.Time, error) {
+	var until sql.NullTime
+	err := s.db.QueryRowContext(ctx, "SELECT LockedUntil FROM login_failures WHERE FailureKey=?", key).Scan(&until)
+	if err != nil && err != sql.ErrNoRows {
+		return time.Time{}, fmt.Errorf("select lockout: %w", err)
+	}
+	return until.Time, nil
+}
+
+func (s *DBLimitStore) AddFailure(ctx context.Context, key string, backoff func(int) time.Duration) (time.Time, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	var count int
+	var last time.Time
+	var until sql.NullTime
+	err = tx.QueryRowContext(ctx, "SELECT Failures, LastFailure, LockedUntil FROM login_failures WHERE FailureKey=? FOR UPDATE", key).
+		Scan(&count, &last, &until)
+	if err != nil && err != sql.ErrNoRows {
+		return time.Time{}, fmt.Errorf("select failures: %w", err)
+	}
+	if now.Sub(last) > failureWindow {
+		count = 0
+	}
+	count++
+	if d := backoff(count); d > 0 {
+		until = sql.NullTime{Time: now.Add(d), Valid: true}
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO login_failures (FailureKey, Failures, LastFailure, LockedUntil) VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE Failures=VALUES(Failures), LastFailure=VALUES(LastFailure), LockedUntil=VALUES(LockedUntil)`,
+		key, count, now, until)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("upsert failures: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return time.Time{}, fmt.Errorf("commit: %w", err)
+	}
+	return until.Time, nil
+}
+
+func (s *DBLimitStore) ClearFailures(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM login_failures WHERE FailureKey=?", key)
+	return err
+}
+
+func (s *DBLimitStore) Sweep(ctx context.Context, now time.Time) error {
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM rate_buckets WHERE UpdatedAt < ?", now.Add(-bucketTTL)); err != nil {
+		return fmt.Errorf("sweep buckets: %w", err)
+	}
+	_, err := s.db.ExecContext(ctx, "DELETE FROM login_failures WHERE LastFailure < ? AND (LockedUntil IS NULL OR LockedUntil < ?)",
+		now.Add(-failureWindow), now)
+	if err != nil {
+		return fmt.Errorf("sweep failures: %w", err)
+	}
+	return nil
+}
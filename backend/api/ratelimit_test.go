@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRefill(t *testing.T) {
+	l := Limit{Rate: 2, Burst: 10}
+	t0 := time.Unix(1000, 0)
+	tests := []struct {
+		name    string
+		tokens  float64
+		elapsed time.Duration
+		want    float64
+	}{
+		{"no time passed", 3, 0, 3},
+		{"half a second", 3, 500 * time.Millisecond, 4},
+		{"partial token", 0, 250 * time.Millisecond, 0.5},
+		{"capped at burst", 9, time.Minute, 10},
+		{"empty refills fully", 0, 5 * time.Second, 10},
+	}
+	for _, tt := range tests {
+		if got := refill(tt.tokens, t0, t0.Add(tt.elapsed), l); got != tt.want {
+			t.Errorf("%s: refill = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if got := waitFor(0.5, l); got != 250*time.Millisecond {
+		t.Errorf("waitFor(0.5) = %v, want 250ms", got)
+	}
+	if got := waitFor(0, Limit{Rate: perHour(10), Burst: 5}); got != 6*time.Minute {
+		t.Errorf("waitFor(0) at 10/hour = %v, want 6m", got)
+	}
+}
+
+func TestMemoryLimitStoreTake(t *testing.T) {
+	s := NewMemoryLimitStore()
+	ctx := context.Background()
+	l := Limit{Rate: perHour(1), Burst: 3}
+	for i := range 3 {
+		if wait, _ := s.Take(ctx, "k", l); wait != 0 {
+			t.Fatalf("take %d: waited %v within the burst", i, wait)
+		}
+	}
+	wait, _ := s.Take(ctx, "k", l)
+	if wait <= 59*time.Minute || wait > time.Hour {
+		t.Fatalf("take past the burst: wait %v, want about an hour", wait)
+	}
+	if wait, _ := s.Take(ctx, "other", l); wait != 0 {
+		t.Fatalf("other key waited %v", wait)
+	}
+}
+
+func TestLoginBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, 0},
+		{lockoutThreshold - 1, 0},
+		{lockoutThreshold, lockoutBase},
+		{lockoutThreshold + 1, 2 * lockoutBase},
+		{lockoutThreshold + 3, 8 * lockoutBase},
+		{lockoutThreshold + 10, lockoutMax},
+		{1000, lockoutMax},
+	}
+	for _, tt := range tests {
+		if got := loginBackoff(tt.failures); got != tt.want {
+			t.Errorf("loginBackoff(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryLimitStoreLockout(t *testing.T) {
+	s := NewMemoryLimitStore()
+	ctx := context.Background()
+	var until time.Time
+	for range lockoutThreshold - 1 {
+		until, _ = s.AddFailure(ctx, "k", loginBackoff)
+	}
+	if !until.IsZero() {
+		t.Fatalf("locked after %d failures", lockoutThreshold-1)
+	}
+	until, _ = s.AddFailure(ctx, "k", loginBackoff)
+	if wait := time.Until(until); wait <= 0 || wait > lockoutBase {
+		t.Fatalf("lockout %v, want up to %v", wait, lockoutBase)
+	}
+	if got, _ := s.LockedUntil(ctx, "k"); !got.Equal(until) {
+		t.Fatalf("LockedUntil = %v, want %v", got, until)
+	}
+
+	// failures outside the window are forgotten
+	s.failures["k"].last = time.Now().Add(-failureWindow - time.Minute)
+	s.failures["k"].lockedUntil = time.Time{}
+	until, _ = s.AddFailure(ctx, "k", loginBackoff)
+	if !until.IsZero() || s.failures["k"].count != 1 {
+		t.Fatalf("failure after the window: count %d, locked until %v", s.failures["k"].count, until)
+	}
+
+	if err := s.ClearFailures(ctx, "k"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.LockedUntil(ctx, "k"); !got.IsZero() {
+		t.Fatalf("locked after ClearFailures until %v", got)
+	}
+}
+
+func TestMemoryLimitStoreSweep(t *testing.T) {
+	s := NewMemoryLimitStore()
+	ctx := context.Background()
+	l := Limit{Rate: 1, Burst: 1}
+	s.Take(ctx, "old", l)
+	s.Take(ctx, "new", l)
+	s.AddFailure(ctx, "stale", loginBackoff)
+	s.AddFailure(ctx, "recent", loginBackoff)
+	for range lockoutThreshold {
+		s.AddFailure(ctx, "locked", loginBackoff)
+	}
+	now := time.Now()
+	s.buckets["old"].last = now.Add(-bucketTTL - time.Minute)
+	s.failures["stale"].last = now.Add(-failureWindow - time.Minute)
+	s.failures["locked"].last = now.Add(-failureWindow - time.Minute)
+
+	if err := s.Sweep(ctx, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.buckets["old"]; ok {
+		t.Error("old bucket kept")
+	}
+	if _, ok := s.buckets["new"]; !ok {
+		t.Error("new bucket dropped")
+	}
+	if _, ok := s.failures["stale"]; ok {
+		t.Error("stale failures kept")
+	}
+	for _, k := range []string{"recent", "locked"} {
+		if _, ok := s.failures[k]; !ok {
+			t.Errorf("%s failures dropped", k)
+		}
+	}
+}
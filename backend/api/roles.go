@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	RoleStudent  = "student"
+	RoleTeacher  = "teacher"
+	RoleAdmin    = "admin"
+	RoleGuardian = "guardian"
+)
+
+var allRoles = []string{RoleStudent, RoleTeacher, RoleAdmin, RoleGuardian}
+
+// Claims are the access token claims. Roles and grade are read from the
+// DB when the token is issued, so a role change applies at the next refresh.
+// Grade is null until the user sets it, for accounts created by an
+// identity provider.
+type Claims struct {
+	Username string   `json:"username"`
+	Roles    []string `json:"roles"`
+	Grade    *int     `json:"grade"`
+	jwt.RegisteredClaims
+
+	// UserID is Subject parsed, filled in by Auth.
+	UserID int64 `json:"-"`
+}
+
+func (c *Claims) HasRole(roles ...string) bool {
+	for _, r := range roles {
+		if slices.Contains(c.Roles, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClaimsFromContext returns the claims Auth stored in the request context.
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	c, ok := ctx.Value(claimsKey).(*Claims)
+	return c, ok
+}
+
+// userIDFromContext returns the caller's user ID from the claims Auth stored
+// in the request context.
+func userIDFromContext(ctx context.Context) (int64, bool) {
+	c, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return 0, false
+	}
+	return c.UserID, true
+}
+
+// dbtx is satisfied by both *sql.DB and *sql.Tx.
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// loadClaims reads the user's token claims. Users with no roles row are
+// students.
+func loadClaims(ctx context.Context, db dbtx, uid int64) (*Claims, error) {
+	c := &Claims{UserID: uid}
+	var grade sql.NullInt64
+	err := db.QueryRowContext(ctx, "SELECT Username, grade FROM users WHERE ID=?", uid).Scan(&c.Username, &grade)
+	if err != nil {
+		return nil, fmt.Errorf("select user: %w", err)
+	}
+	if grade.Valid {
+		g := int(grade.Int64)
+		c.Grade = &g
+	}
+	rows, err := db.QueryContext(ctx, "SELECT Role FROM user_roles WHERE UserID=? ORDER BY Role", uid)
+	if err != nil {
+		return nil, fmt.Errorf("select roles: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, fmt.Errorf("scan role: %w", err)
+		}
+		c.Roles = append(c.Roles, role)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("read roles: %w", err)
+	}
+	if len(c.Roles) == 0 {
+		c.Roles = []string{RoleStudent}
+	}
+	c.Subject = strconv.FormatInt(uid, 10)
+	return c, nil
+}
+
+// anyRole allows every signed-in user.
+var anyRole = allRoles
+
+// socialRoles take part in social features. Guardians only look after
+// their students.
+var socialRoles = []string{RoleStudent, RoleTeacher, RoleAdmin}
+
+// routePolicy lists the roles allowed on each protected route. protect
+// refuses to register a route that isn't listed, so every protected
+// endpoint is declared here.
+var routePolicy = map[string][]string{
+	"/addfriend":                          socialRoles,
+	"/getallfriends/{user}":               anyRole,
+	"POST /friends/requests":              socialRoles,
+	"GET /friends/requests/incoming":      socialRoles,
+	"GET /friends/requests/outgoing":      socialRoles,
+	"POST /friends/requests/{id}/accept":  socialRoles,
+	"POST /friends/requests/{id}/decline": socialRoles,
+	"DELETE /friends/requests/{id}":       socialRoles,
+	"DELETE /friends/{id}":                socialRoles,
+	"POST /blocks":                        anyRole,
+	"DELETE /blocks/{id}":                 anyRole,
+	"GET /blocks":                         anyRole,
+	"GET /users/search":                   socialRoles,
+	"GET /leaderboard":                    socialRoles,
+	"GET /leaderboard/stream":             socialRoles,
+	"POST /challenges":                    socialRoles,
+	"GET /challenges":                     socialRoles,
+	"GET /challenges/{id}":                socialRoles,
+	"POST /challenges/{id}/accept":        socialRoles,
+	"POST /challenges/{id}/decline":       socialRoles,
+	"POST /challenges/{id}/start":         socialRoles,
+	"DELETE /challenges/{id}":             socialRoles,
+	"/gen":                                anyRole,
+	"/gen/stream":                         anyRole,
+	"/eval":                               anyRole,
+	"/logout":                             anyRole,
+	"POST /email":                         anyRole,
+	"POST /grade":                         anyRole,
+	"GET /users/{user}/progress":          anyRole,
+	"GET /account/export":                 anyRole,
+	"GET /account/deletion":               anyRole,
+	"POST /account/deletion":              anyRole,
+	"DELETE /account/deletion":            anyRole,
+	"GET /account/privacy":                anyRole,
+	"PUT /account/privacy":                anyRole,
+	"POST /admin/roles":                   {RoleAdmin},
+	"POST /classrooms":                    {RoleTeacher, RoleAdmin},
+	"POST /classrooms/{id}/invites":       {RoleTeacher, RoleAdmin},
+	"POST /classrooms/join":               {RoleStudent},
+	"GET /classrooms/{id}/members":        {RoleTeacher, RoleAdmin},
+	"POST /guardian/invites":              {RoleStudent},
+	"POST /guardian/students":             {RoleGuardian},
+	"GET /guardian/students":              {RoleGuardian},
+	"PUT /guardian/students/{id}/social":  {RoleGuardian},
+	"DELETE /guardian/students/{id}":      {RoleGuardian},
+}
+
+// socialRoutes are closed to children until a guardian approves social
+// features.
+var socialRoutes = map[string]bool{
+	"/addfriend":                         true,
+	"/getallfriends/{user}":              true,
+	"POST /friends/requests":             true,
+	"GET /friends/requests/incoming":     true,
+	"GET /friends/requests/outgoing":     true,
+	"POST /friends/requests/{id}/accept": true,
+	"GET /users/search":                  true,
+	"POST /challenges":                   true,
+	"POST /challenges/{id}/accept":       true,
+}
+
+// protect registers h behind Auth, the route's policy, guardian consent
+// for social routes and its quota.
+func (a *App) protect(mux *http.ServeMux, pattern string, h http.HandlerFunc) {
+	roles, ok := routePolicy[pattern]
+	if !ok {
+		panic("no route policy for " + pattern)
+	}
+	var next http.Handler = h
+	if q, ok := routeQuotas[pattern]; ok {
+		next = a.Limiter.ByUser(q.name, q.limit, next)
+	}
+	if socialRoutes[pattern] {
+		next = a.requireSocial(next)
+	}
+	mux.Handle(pattern, a.Auth(requireRole(roles, next)))
+}
+
+func requireRole(roles []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := ClaimsFromContext(r.Context())
+		if !ok || !c.HasRole(roles...) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SetRoles replaces a user's roles.
+func (a *App) SetRoles(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req struct {
+		UserID int64    `json:"user_id"`
+		Roles  []string `json:"roles"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == 0 || len(req.Roles) == 0 {
+		http.Error(w, "Missing input field", http.StatusBadRequest)
+		return
+	}
+	for _, role := range req.Roles {
+		if !slices.Contains(allRoles, role) {
+			http.Error(w, "unknown role "+role, http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("set roles begin error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	var exists int
+	err = tx.QueryRowContext(ctx, "SELECT 1 FROM users WHERE ID=?", req.UserID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("set roles select user error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_roles WHERE UserID=?", req.UserID); err != nil {
+		log.Printf("set roles delete error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	for _, role := range req.Roles {
+		if _, err := tx.ExecContext(ctx, "INSERT IGNORE INTO user_roles (UserID, Role) VALUES (?, ?)", req.UserID, role); err != nil {
+			log.Printf("set roles insert error: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("set roles commit error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Criterion is one line of a grading rubric. Weight is the number of points
+// the criterion contributes to the 100-point total.
+type Criterion struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Weight      float64 `json:"weight"`
+}
+
+type Rubric struct {
+	Criteria []Criterion `json:"criteria"`
+}
+
+// RubricSet maps a topic to its rubric. Lookups are case-insensitive and fall
+// back to the "default" entry.
+type RubricSet map[string]Rubric
+
+func newRubric(correctness, method, communication float64, correctnessDesc, methodDesc, communicationDesc string) Rubric {
+	return Rubric{Criteria: []Criterion{
+		{Name: "correctness", Weight: correctness, Description: correctnessDesc},
+		{Name: "method", Weight: method, Description: methodDesc},
+		{Name: "communication", Weight: communication, Description: communicationDesc},
+	}}
+}
+
+// defaultRubrics covers the topics in backend/ml/generate_data.py.
+var defaultRubrics = RubricSet{
+	"default": newRubric(50, 30, 20,
+		"The final answer is right.",
+		"The approach is sound and the reasoning is valid.",
+		"The answer is clear and uses correct terminology."),
+	"algebra": newRubric(60, 30, 10,
+		"The final value or expression is right, including signs and all solutions.",
+		"Manipulations are valid and each step follows from the last.",
+		"Notation is correct and the work can be followed."),
+	"computer science": newRubric(50, 35, 15,
+		"The algorithm, output or complexity stated is right.",
+		"The approach handles edge cases and is reasonably efficient.",
+		"Code or pseudocode is readable and terms are used precisely."),
+	"biology": newRubric(50, 25, 25,
+		"The facts and conclusions are scientifically accurate.",
+		"Mechanisms and cause and effect are explained, not just named.",
+		"Biological vocabulary is used correctly and the answer is organised."),
+	"english": newRubric(30, 30, 40,
+		"The interpretation or grammar point is defensible and accurate.",
+		"Claims are supported with evidence from the text or rules.",
+		"Writing is clear, well structured and free of errors."),
+	"history": newRubric(40, 30, 30,
+		"Dates, people and events are accurate.",
+		"The argument weighs causes, context and sources.",
+		"The answer is organised and makes a clear argument."),
+}
+
+// LoadRubrics returns the default rubrics, overridden per topic by the JSON
+// file named in RUBRICS_FILE if set. The file maps topic to rubric.
+func LoadRubrics() (RubricSet, error) {
+	set := RubricSet{}
+	for topic, r := range defaultRubrics {
+		set[topic] = r
+	}
+
+	path := os.Getenv("RUBRICS_FILE")
+	if path == "" {
+		return set, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read rubrics: %w", err)
+	}
+	var overrides RubricSet
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return nil, fmt.Errorf("parse rubrics: %w", err)
+	}
+	for topic, r := range overrides {
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("rubric %q: %w", topic, err)
+		}
+		set[strings.ToLower(topic)] = r
+	}
+	return set, nil
+}
+
+func (r Rubric) validate() error {
+	if len(r.Criteria) == 0 {
+		return fmt.Errorf("no criteria")
+	}
+	seen := map[string]bool{}
+	for _, c := range r.Criteria {
+		if c.Name == "" || c.Weight <= 0 {
+			return fmt.Errorf("criterion needs a name and positive weight")
+		}
+		if seen[c.Name] {
+			return fmt.Errorf("duplicate criterion %q", c.Name)
+		}
+		seen[c.Name] = true
+	}
+	return nil
+}
+
+// For returns the rubric for topic. A topic that names a configured topic,
+// like "Algebra: quadratics", uses that topic's rubric.
+func (s RubricSet) For(topic string) Rubric {
+	topic = strings.ToLower(strings.TrimSpace(topic))
+	if r, ok := s[topic]; ok {
+		return r
+	}
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name != "default" && strings.Contains(topic, name) {
+			return s[name]
+		}
+	}
+	if r, ok := s["default"]; ok {
+		return r
+	}
+	return defaultRubrics["default"]
+}
+
+func (r Rubric) total() float64 {
+	var total float64
+	for _, c := range r.Criteria {
+		total += c.Weight
+	}
+	return total
+}
+
+// task is the model output schema for grading against r: a 0-100 mark per
+// criterion plus feedback and a verdict.
+func (r Rubric) task() OutputTask {
+	scores := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	for _, c := range r.Criteria {
+		scores.Properties[c.Name] = &Schema{Type: "number", Minimum: floatPtr(0), Maximum: floatPtr(100)}
+		scores.Required = append(scores.Required, c.Name)
+	}
+	return OutputTask{
+		Name: "evaluation",
+		Schema: &Schema{
+			Type:     "object",
+			Required: []string{"scores", "feedback", "error", "correct"},
+			Properties: map[string]*Schema{
+				"scores":   scores,
+				"feedback": {Type: "string", MinLength: 1},
+				"error":    {Type: "string"},
+				"correct":  {Type: "boolean"},
+			},
+		},
+	}
+}
+
+func (r Rubric) describe() string {
+	var b strings.Builder
+	for _, c := range r.Criteria {
+		fmt.Fprintf(&b, "- %s (%g points): %s\n", c.Name, c.Weight, c.Description)
+	}
+	return b.String()
+}
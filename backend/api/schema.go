@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// migrations are applied in order, once each, and recorded in
+// schema_migrations. Only ever append to this list.
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS questions (
+		ID BIGINT AUTO_INCREMENT PRIMARY KEY,
+		UserID BIGINT NOT NULL,
+		Topic VARCHAR(255) NOT NULL,
+		Grade INT NOT NULL,
+		Difficulty INT NOT NULL,
+		QuestionLatex TEXT NOT NULL,
+		PromptVersion VARCHAR(32) NOT NULL,
+		Model VARCHAR(128) NOT NULL,
+		CreatedAt DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_questions_user (UserID),
+		INDEX idx_questions_topic (Topic, Grade, Difficulty)
+	)`,
+	`CREATE TABLE IF NOT EXISTS question_keys (
+		QuestionID BIGINT PRIMARY KEY,
+		Kind VARCHAR(16) NOT NULL,
+		Value DOUBLE NULL,
+		Unit VARCHAR(32) NOT NULL DEFAULT '',
+		Model VARCHAR(128) NOT NULL,
+		CreatedAt DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`ALTER TABLE question_keys ADD COLUMN Expr TEXT NULL`,
+	`CREATE TABLE IF NOT EXISTS user_topic_stats (
+		UserID BIGINT NOT NULL,
+		Topic VARCHAR(255) NOT NULL,
+		CurrentDifficulty INT NOT NULL,
+		QuestionsAnswered INT NOT NULL DEFAULT 0,
+		CorrectAnswers INT NOT NULL DEFAULT 0,
+		Streak INT NOT NULL DEFAULT 0,
+		TotalTime DOUBLE NOT NULL DEFAULT 0,
+		UpdatedAt DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		PRIMARY KEY (UserID, Topic)
+	)`,
+	`CREATE TABLE IF NOT EXISTS attempts (
+		ID BIGINT AUTO_INCREMENT PRIMARY KEY,
+		UserID BIGINT NOT NULL,
+		QuestionID BIGINT NOT NULL,
+		Topic VARCHAR(255) NOT NULL,
+		Difficulty INT NOT NULL,
+		Correct BOOLEAN NOT NULL,
+		Score DOUBLE NOT NULL,
+		TimeTaken DOUBLE NOT NULL,
+		Streak INT NOT NULL,
+		AccuracyRate DOUBLE NOT NULL,
+		AvgTimePerQuestion DOUBLE NOT NULL,
+		QuestionsAnswered INT NOT NULL,
+		NextDifficulty INT NOT NULL,
+		CreatedAt DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_attempts_user (UserID, CreatedAt),
+		INDEX idx_attempts_question (QuestionID)
+	)`,
+	// argon2id hashes are ~100 characters; legacy sha256 rows stay valid
+	`ALTER TABLE auth MODIFY Hash VARCHAR(255) NOT NULL`,
+	`CREATE TABLE IF NOT EXISTS refresh_tokens (
+		TokenHash CHAR(64) PRIMARY KEY,
+		UserID BIGINT NOT NULL,
+		FamilyID VARCHAR(32) NOT NULL,
+		ExpiresAt DATETIME NOT NULL,
+		UsedAt DATETIME NULL,
+		RevokedAt DATETIME NULL,
+		CreatedAt DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_refresh_family (FamilyID),
+		INDEX idx_refresh_user (UserID)
+	)`,
+	`CREATE TABLE IF NOT EXISTS revoked_tokens (
+		JTI VARCHAR(32) PRIMARY KEY,
+		ExpiresAt DATETIME NOT NULL,
+		INDEX idx_revoked_expires (ExpiresAt)
+	)`,
+	`CREATE TABLE IF NOT EXISTS user_roles (
+		UserID BIGINT NOT NULL,
+		Role VARCHAR(16) NOT NULL,
+		PRIMARY KEY (UserID, Role)
+	)`,
+	`CREATE TABLE IF NOT EXISTS classrooms (
+		ID BIGINT AUTO_INCREMENT PRIMARY KEY,
+		TeacherID BIGINT NOT NULL,
+		Name VARCHAR(100) NOT NULL,
+		CreatedAt DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_classrooms_teacher (TeacherID)
+	)`,
+	`CREATE TABLE IF NOT EXISTS classroom_members (
+		ClassroomID BIGINT NOT NULL,
+		UserID BIGINT NOT NULL,
+		PRIMARY KEY (ClassroomID, UserID),
+		INDEX idx_classroom_members_user (UserID)
+	)`,
+	`CREATE TABLE IF NOT EXISTS rate_buckets (
+		BucketKey VARCHAR(191) PRIMARY KEY,
+		Tokens DOUBLE NOT NULL,
+		UpdatedAt DATETIME(6) NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS login_failures (
+		FailureKey VARCHAR(191) PRIMARY KEY,
+		Failures INT NOT NULL,
+		LastFailure DATETIME(6) NOT NULL,
+		LockedUntil DATETIME(6) NULL
+	)`,
+	`ALTER TABLE users
+		ADD COLUMN Email VARCHAR(254) NULL,
+		ADD COLUMN EmailVerifiedAt DATETIME NULL,
+		ADD INDEX idx_users_email (Email)`,
+	`CREATE TABLE IF NOT EXISTS email_tokens (
+		TokenHash CHAR(64) PRIMARY KEY,
+		UserID BIGINT NOT NULL,
+		Purpose VARCHAR(16) NOT NULL,
+		Email VARCHAR(254) NOT NULL,
+		ExpiresAt DATETIME NOT NULL,
+		UsedAt DATETIME NULL,
+		CreatedAt DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_email_tokens_user (UserID, Purpose)
+	)`,
+	// accounts created by an identity provider set their grade later
+	`ALTER TABLE users MODIFY grade INT NULL`,
+	`CREATE TABLE IF NOT EXISTS user_identities (
+		Issuer VARCHAR(255) NOT NULL,
+		Subject VARCHAR(255) NOT NULL,
+		UserID BIGINT NOT NULL,
+		Email VARCHAR(254) NOT NULL DEFAULT '',
+		CreatedAt DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (Issuer, Subject),
+		INDEX idx_user_identities_user (UserID)
+	)`,
+	`CREATE TABLE IF NOT EXISTS oidc_states (
+		StateHash CHAR(64) PRIMARY KEY,
+		Provider VARCHAR(64) NOT NULL,
+		Nonce VARCHAR(64) NOT NULL,
+		Verifier VARCHAR(64) NOT NULL,
+		LinkUserID BIGINT NULL,
+		ExpiresAt DATETIME NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS guardian_links (
+		GuardianID BIGINT NOT NULL,
+		StudentID BIGINT NOT NULL,
+		SocialApproved BOOLEAN NOT NULL DEFAULT FALSE,
+		CreatedAt DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (GuardianID, StudentID),
+		INDEX idx_guardian_links_student (StudentID)
+	)`,
+	`CREATE TABLE IF NOT EXISTS guardian_invites (
+		CodeHash CHAR(64) PRIMARY KEY,
+		StudentID BIGINT NOT NULL,
+		ExpiresAt DATETIME NOT NULL,
+		UsedAt DATETIME NULL,
+		UsedBy BIGINT NULL,
+		CreatedAt DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_guardian_invites_student (StudentID)
+	)`,
+	// deleted accounts keep an anonymized users row so attempts stay
+	// grouped for training
+	`ALTER TABLE users ADD COLUMN DeletedAt DATETIME NULL`,
+	`CREATE TABLE IF NOT EXISTS account_deletions (
+		UserID BIGINT PRIMARY KEY,
+		RequestedBy BIGINT NOT NULL,
+		RequestedAt DATETIME NOT NULL,
+		ScheduledFor DATETIME NOT NULL,
+		CancelledAt DATETIME NULL,
+		CompletedAt DATETIME NULL,
+		INDEX idx_account_deletions_due (ScheduledFor)
+	)`,
+	`CREATE TABLE IF NOT EXISTS audit_log (
+		ID BIGINT AUTO_INCREMENT PRIMARY KEY,
+		ActorID BIGINT NULL,
+		Action VARCHAR(64) NOT NULL,
+		SubjectID BIGINT NOT NULL,
+		Detail TEXT NOT NULL,
+		CreatedAt DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_audit_log_subject (SubjectID, CreatedAt)
+	)`,
+	`CREATE TABLE IF NOT EXISTS friend_requests (
+		FromID BIGINT NOT NULL,
+		ToID BIGINT NOT NULL,
+		CreatedAt DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (FromID, ToID),
+		INDEX idx_friend_requests_to (ToID)
+	)`,
+	`CREATE TABLE IF NOT EXISTS blocks (
+		BlockerID BIGINT NOT NULL,
+		BlockedID BIGINT NOT NULL,
+		CreatedAt DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (BlockerID, BlockedID),
+		INDEX idx_blocks_blocked (BlockedID)
+	)`,
+	`ALTER TABLE users
+		ADD COLUMN SearchVisibility VARCHAR(16) NOT NULL DEFAULT 'everyone',
+		ADD INDEX idx_users_username (Username)`,
+	// leaderboard points each attempt earned; windowed boards sum them
+	`ALTER TABLE attempts
+		ADD COLUMN Points INT NOT NULL DEFAULT 0,
+		ADD INDEX idx_attempts_created (CreatedAt, UserID)`,
+	`CREATE TABLE IF NOT EXISTS challenges (
+		ID BIGINT AUTO_INCREMENT PRIMARY KEY,
+		ChallengerID BIGINT NOT NULL,
+		OpponentID BIGINT NOT NULL,
+		Topic VARCHAR(255) NOT NULL,
+		QuestionCount INT NOT NULL,
+		Status VARCHAR(16) NOT NULL,
+		CreatedAt DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		ExpiresAt DATETIME NOT NULL,
+		FinishedAt DATETIME NULL,
+		WinnerID BIGINT NULL,
+		INDEX idx_challenges_challenger (ChallengerID, CreatedAt),
+		INDEX idx_challenges_opponent (OpponentID, CreatedAt),
+		INDEX idx_challenges_expiry (Status, ExpiresAt)
+	)`,
+	`CREATE TABLE IF NOT EXISTS challenge_questions (
+		ChallengeID BIGINT NOT NULL,
+		Position INT NOT NULL,
+		QuestionID BIGINT NOT NULL,
+		PRIMARY KEY (ChallengeID, Position),
+		INDEX idx_challenge_questions_question (QuestionID)
+	)`,
+	// Points are what the result added to the player's leaderboard score
+	`CREATE TABLE IF NOT EXISTS challenge_players (
+		ChallengeID BIGINT NOT NULL,
+		UserID BIGINT NOT NULL,
+		StartedAt DATETIME NULL,
+		LastAnswerAt DATETIME NULL,
+		Answered INT NOT NULL DEFAULT 0,
+		Score DOUBLE NOT NULL DEFAULT 0,
+		Points INT NOT NULL DEFAULT 0,
+		PRIMARY KEY (ChallengeID, UserID),
+		INDEX idx_challenge_players_user (UserID)
+	)`,
+	`CREATE TABLE IF NOT EXISTS challenge_answers (
+		ChallengeID BIGINT NOT NULL,
+		UserID BIGINT NOT NULL,
+		QuestionID BIGINT NOT NULL,
+		Correct BOOLEAN NOT NULL,
+		Score DOUBLE NOT NULL,
+		CreatedAt DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (ChallengeID, UserID, QuestionID)
+	)`,
+	// students join classrooms with a code instead of being added
+	`CREATE TABLE IF NOT EXISTS classroom_invites (
+		CodeHash CHAR(64) PRIMARY KEY,
+		ClassroomID BIGINT NOT NULL,
+		ExpiresAt DATETIME NOT NULL,
+		CreatedAt DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_classroom_invites_classroom (ClassroomID)
+	)`,
+	// for the rate limit sweep
+	`ALTER TABLE rate_buckets ADD INDEX idx_rate_buckets_updated (UpdatedAt)`,
+	`ALTER TABLE login_failures ADD INDEX idx_login_failures_last (LastFailure)`,
+}
+
+func migrate(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		Version INT PRIMARY KEY,
+		AppliedAt DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	var current int
+	err = db.QueryRowContext(ctx, "SELECT COALESCE(MAX(Version), 0) FROM schema_migrations").Scan(&current)
+	if err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+
+	for v := current + 1; v <= len(migrations); v++ {
+		if _, err := db.ExecContext(ctx, migrations[v-1]); err != nil {
+			return fmt.Errorf("migration %d: %w", v, err)
+		}
+		if _, err := db.ExecContext(ctx, "INSERT INTO schema_migrations (Version) VALUES (?)", v); err != nil {
+			return fmt.Errorf("record migration %d: %w", v, err)
+		}
+		log.Printf("applied migration %d", v)
+	}
+	return nil
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Search visibility settings: who can find a user by searching or
+	// send them a request by username.
+	visibleEveryone   = "everyone"
+	visibleClassmates = "classmates"
+	visibleNobody     = "nobody"
+
+	searchMinQuery = 2
+	// searchMaxResults caps the ranked results a query pages through.
+	searchMaxResults = 200
+	// fuzzyCandidates caps the rows fetched to run edit distance on.
+	fuzzyCandidates = 1000
+)
+
+// visibleTo is a condition on users alias u that holds when viewer may
+// find u: another active account, not blocked either way, that can be
+// befriended and whose search visibility includes viewer. Guardians are
+// never found. It returns the condition's arguments.
+func visibleTo(viewer int64) (string, []any) {
+	cond := `u.ID <> ? AND u.DeletedAt IS NULL
+		AND ` + notBlockedWith("u.ID") + `
+		AND NOT EXISTS (SELECT 1 FROM user_roles gr WHERE gr.UserID = u.ID AND gr.Role = ?)
+		AND ` + socialAllowedSQL("u") + `
+		AND (u.SearchVisibility = ? OR (u.SearchVisibility = ? AND (
+			EXISTS (SELECT 1 FROM classroom_members m1 JOIN classroom_members m2 ON m2.ClassroomID = m1.ClassroomID
+				WHERE m1.UserID = u.ID AND m2.UserID = ?)
+			OR EXISTS (SELECT 1 FROM classroom_members m JOIN classrooms c ON c.ID = m.ClassroomID
+				WHERE (m.UserID = u.ID AND c.TeacherID = ?) OR (m.UserID = ? AND c.TeacherID = u.ID)))))`
+	return cond, []any{viewer, viewer, viewer, RoleGuardian, consentMaxGrade,
+		visibleEveryone, visibleClassmates, viewer, viewer, viewer}
+}
+
+// levenshtein is the edit distance between a and b, by rune.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// maxTypos is how many edits a fuzzy match may be from a query: none for
+// very short queries, one for short ones and two otherwise.
+func maxTypos(q string) int {
+	switch n := len([]rune(q)); {
+	case n < 3:
+		return 0
+	case n < 6:
+		return 1
+	default:
+		return 2
+	}
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+type searchResult struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+	Friend   bool   `json:"friend"`
+	// Request is "incoming" or "outgoing" when a friend request is
+	// pending between the caller and this user.
+	Request string `json:"request,omitempty"`
+
+	rank     int
+	distance int
+}
+
+// searchUsers finds users visible to viewer whose username starts with q
+// or is within a few typos of it. Exact matches come first, then prefix
+// matches, then fuzzy matches by distance.
+func searchUsers(ctx context.Context, db dbtx, viewer int64, q string) ([]searchResult, error) {
+	visible, visibleArgs := visibleTo(viewer)
+	cols := `SELECT u.ID, u.Username,
+		EXISTS (SELECT 1 FROM friends f WHERE f.ID1 = ? AND f.ID2 = u.ID),
+		EXISTS (SELECT 1 FROM friend_requests r WHERE r.FromID = u.ID AND r.ToID = ?),
+		EXISTS (SELECT 1 FROM friend_requests r WHERE r.FromID = ? AND r.ToID = u.ID)
+		FROM users u WHERE `
+	colArgs := []any{viewer, viewer, viewer}
+
+	found := map[int64]*searchResult{}
+	scan := func(query string, args ...any) error {
+		rows, err := db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var res searchResult
+			var incoming, outgoing bool
+			if err := rows.Scan(&res.ID, &res.Username, &res.Friend, &incoming, &outgoing); err != nil {
+				return err
+			}
+			if incoming {
+				res.Request = "incoming"
+			} else if outgoing {
+				res.Request = "outgoing"
+			}
+			if _, ok := found[res.ID]; !ok {
+				found[res.ID] = &res
+			}
+		}
+		return rows.Err()
+	}
+
+	args := append(append(slices.Clone(colArgs), escapeLike(q)+"%"), visibleArgs...)
+	err := scan(cols+`u.Username LIKE ? AND `+visible+` ORDER BY u.Username LIMIT `+strconv.Itoa(searchMaxResults), args...)
+	if err != nil {
+		return nil, err
+	}
+	if typos := maxTypos(q); typos > 0 {
+		// edit distance can't run in the DB, so narrow the candidates to
+		// similar lengths sharing a first letter or sound
+		n := len([]rune(q))
+		args := append(slices.Clone(colArgs), n-typos, n+typos, escapeLike(string([]rune(q)[:1]))+"%", q)
+		args = append(args, visibleArgs...)
+		err := scan(cols+`CHAR_LENGTH(u.Username) BETWEEN ? AND ?
+			AND (u.Username LIKE ? OR SOUNDEX(u.Username) = SOUNDEX(?)) AND `+visible+
+			` LIMIT `+strconv.Itoa(fuzzyCandidates), args...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	lq := strings.ToLower(q)
+	results := []searchResult{}
+	for _, res := range found {
+		name := strings.ToLower(res.Username)
+		switch {
+		case name == lq:
+			res.rank = 0
+		case strings.HasPrefix(name, lq):
+			res.rank = 1
+		default:
+			res.rank, res.distance = 2, levenshtein(name, lq)
+			if res.distance > maxTypos(q) {
+				continue
+			}
+		}
+		results = append(results, *res)
+	}
+	slices.SortFunc(results, func(a, b searchResult) int {
+		if a.rank != b.rank {
+			return a.rank - b.rank
+		}
+		if a.distance != b.distance {
+			return a.distance - b.distance
+		}
+		if c := strings.Compare(strings.ToLower(a.Username), strings.ToLower(b.Username)); c != 0 {
+			return c
+		}
+		return int(a.ID - b.ID)
+	})
+	if len(results) > searchMaxResults {
+		results = results[:searchMaxResults]
+	}
+	return results, nil
+}
+
+// SearchUsers searches usernames, route: users/search?q=&limit=&cursor=.
+// cursor is the next_cursor of the previous page.
+func (a *App) SearchUsers(w http.ResponseWriter, r *http.Request) {
+	c, _ := ClaimsFromContext(r.Context())
+	params := r.URL.Query()
+	q := strings.TrimSpace(params.Get("q"))
+	if len([]rune(q)) < searchMinQuery || len(q) > 64 {
+		http.Error(w, "query must be at least 2 characters", http.StatusBadRequest)
+		return
+	}
+	limit, offset, ok := pageParams(w, params.Get("limit"), params.Get("cursor"))
+	if !ok {
+		return
+	}
+	results, err := searchUsers(r.Context(), a.DB, c.UserID, q)
+	if err != nil {
+		log.Printf("search users error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	page := results[min(offset, len(results)):min(offset+limit, len(results))]
+	resp := map[string]any{"results": page, "next_cursor": nil}
+	if offset+limit < len(results) {
+		resp["next_cursor"] = strconv.Itoa(offset + limit)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// pageParams parses limit (default 20, at most 50) and an offset cursor.
+func pageParams(w http.ResponseWriter, rawLimit, cursor string) (limit, offset int, ok bool) {
+	limit = 20
+	if rawLimit != "" {
+		n, err := strconv.Atoi(rawLimit)
+		if err != nil || n < 1 || n > 50 {
+			http.Error(w, "limit must be 1-50", http.StatusBadRequest)
+			return 0, 0, false
+		}
+		limit = n
+	}
+	if cursor != "" {
+		n, err := strconv.Atoi(cursor)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid cursor", http.StatusBadRequest)
+			return 0, 0, false
+		}
+		offset = n
+	}
+	return limit, offset, true
+}
+
+// findVisibleUser resolves a username for viewer. Usernames aren't unique,
+// so more than one match is errAmbiguousUsername.
+func findVisibleUser(ctx context.Context, db dbtx, viewer int64, username string) (int64, error) {
+	visible, args := visibleTo(viewer)
+	rows, err := db.QueryContext(ctx, "SELECT u.ID FROM users u WHERE u.Username = ? AND "+visible+" LIMIT 2",
+		append([]any{username}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	switch len(ids) {
+	case 0:
+		return 0, errFriendNotFound
+	case 1:
+		return ids[0], nil
+	default:
+		return 0, errAmbiguousUsername
+	}
+}
+
+// Privacy returns the caller's privacy settings.
+func (a *App) Privacy(w http.ResponseWriter, r *http.Request) {
+	c, _ := ClaimsFromContext(r.Context())
+	var visibility string
+	err := a.DB.QueryRowContext(r.Context(), "SELECT SearchVisibility FROM users WHERE ID=?", c.UserID).Scan(&visibility)
+	if err == sql.ErrNoRows {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("select privacy error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"search_visibility": visibility})
+}
+
+// SetPrivacy changes who can find the caller: "everyone", "classmates"
+// (people sharing a classroom with them) or "nobody".
+func (a *App) SetPrivacy(w http.ResponseWriter, r *http.Request) {
+	c, _ := ClaimsFromContext(r.Context())
+	var req struct {
+		SearchVisibility string `json:"search_visibility"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if !slices.Contains([]string{visibleEveryone, visibleClassmates, visibleNobody}, req.SearchVisibility) {
+		http.Error(w, "search_visibility must be everyone, classmates or nobody", http.StatusBadRequest)
+		return
+	}
+	if _, err := a.DB.ExecContext(r.Context(), "UPDATE users SET SearchVisibility=? WHERE ID=?", req.SearchVisibility, c.UserID); err != nil {
+		log.Printf("set privacy error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
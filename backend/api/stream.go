@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	reasoningOpen  = "<reasoning>"
+	reasoningClose = "</reasoning>"
+)
+
+// reasoningFilter is the streaming counterpart of RemoveReasoningBlock. Tags
+// may be split across chunks, so any tail that could still grow into a tag is
+// held back until the next chunk decides it.
+type reasoningFilter struct {
+	buf     string
+	inBlock bool
+}
+
+// Write consumes the next chunk and returns the text that is safe to emit.
+func (f *reasoningFilter) Write(chunk string) string {
+	f.buf += chunk
+	var out strings.Builder
+	for {
+		if f.inBlock {
+			i := strings.Index(f.buf, reasoningClose)
+			if i < 0 {
+				f.buf = f.buf[len(f.buf)-partialTagLen(f.buf, reasoningClose):]
+				return out.String()
+			}
+			f.buf = f.buf[i+len(reasoningClose):]
+			f.inBlock = false
+			continue
+		}
+		i := strings.Index(f.buf, reasoningOpen)
+		if i < 0 {
+			keep := partialTagLen(f.buf, reasoningOpen)
+			out.WriteString(f.buf[:len(f.buf)-keep])
+			f.buf = f.buf[len(f.buf)-keep:]
+			return out.String()
+		}
+		out.WriteString(f.buf[:i])
+		f.buf = f.buf[i+len(reasoningOpen):]
+		f.inBlock = true
+	}
+}
+
+// Flush returns whatever was held back once the stream has ended. An
+// unterminated reasoning block is dropped.
+func (f *reasoningFilter) Flush() string {
+	rest := f.buf
+	f.buf = ""
+	if f.inBlock {
+		return ""
+	}
+	return rest
+}
+
+// partialTagLen is the length of the longest suffix of s that is a proper
+// prefix of tag.
+func partialTagLen(s, tag string) int {
+	for n := len(tag) - 1; n > 0; n-- {
+		if strings.HasSuffix(s, tag[:n]) {
+			return n
+		}
+	}
+	return 0
+}
+
+// sseWriter writes Server-Sent Events and flushes after each one.
+type sseWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func newSSEWriter(w http.ResponseWriter) (*sseWriter, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, false
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return &sseWriter{w: w, flusher: flusher}, true
+}
+
+func (s *sseWriter) Send(event string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+// filterChunks runs chunks through a reasoningFilter and returns all it
+// emitted.
+func filterChunks(chunks ...string) string {
+	var f reasoningFilter
+	out := ""
+	for _, c := range chunks {
+		out += f.Write(c)
+	}
+	return out + f.Flush()
+}
+
+func TestReasoningFilterSplits(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"no reasoning", "x^2 + 1", "x^2 + 1"},
+		{"block first", "<reasoning>think</reasoning>Solve $x$", "Solve $x$"},
+		{"block in the middle", "a<reasoning>b</reasoning>c", "ac"},
+		{"empty block", "<reasoning></reasoning>done", "done"},
+		{"two blocks", "<reasoning>1</reasoning>a<reasoning>2</reasoning>b", "ab"},
+		{"unterminated block", "a<reasoning>never closed", "a"},
+		{"near miss stays", "a <reason b </reasoning", "a <reason b </reasoning"},
+		{"tag prefix at the end", "a<reas", "a<reas"},
+		{"repeated opening bracket", "<<reasoning>x</reasoning>>", "<>"},
+		{"close tag inside block prefix", "<reasoning></reason</reasoning>ok", "ok"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := filterChunks(tt.in); got != tt.want {
+				t.Errorf("whole: got %q, want %q", got, tt.want)
+			}
+			for i := 0; i <= len(tt.in); i++ {
+				if got := filterChunks(tt.in[:i], tt.in[i:]); got != tt.want {
+					t.Errorf("split at %d: got %q, want %q", i, got, tt.want)
+				}
+			}
+			for i := 0; i <= len(tt.in); i++ {
+				for j := i; j <= len(tt.in); j++ {
+					if got := filterChunks(tt.in[:i], tt.in[i:j], tt.in[j:]); got != tt.want {
+						t.Errorf("split at %d and %d: got %q, want %q", i, j, got, tt.want)
+					}
+				}
+			}
+			bytes := make([]string, len(tt.in))
+			for i := range tt.in {
+				bytes[i] = tt.in[i : i+1]
+			}
+			if got := filterChunks(bytes...); got != tt.want {
+				t.Errorf("byte by byte: got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const defaultOutputAttempts = 3
+
+var reasoningRe = regexp.MustCompile(`(?s)<reasoning>.*?</reasoning>`)
+
+func RemoveReasoningBlock(s string) string {
+	return reasoningRe.ReplaceAllString(s, "")
+}
+
+// Schema is the subset of JSON Schema used to describe what a model task must
+// return. It is embedded in the prompt and checked against every response.
+type Schema struct {
+	Type       string             `json:"type"`
+	Properties map[string]*Schema `json:"properties,omitempty"`
+	Required   []string           `json:"required,omitempty"`
+	Items      *Schema            `json:"items,omitempty"`
+	Enum       []string           `json:"enum,omitempty"`
+	Minimum    *float64           `json:"minimum,omitempty"`
+	Maximum    *float64           `json:"maximum,omitempty"`
+	MinLength  int                `json:"minLength,omitempty"`
+	MaxLength  int                `json:"maxLength,omitempty"`
+}
+
+func floatPtr(f float64) *float64 { return &f }
+
+func (s *Schema) Validate(v any) error {
+	return s.validate(v, "$")
+}
+
+func (s *Schema) validate(v any, path string) error {
+	switch s.Type {
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: expected object", path)
+		}
+		for _, key := range s.Required {
+			if _, ok := obj[key]; !ok {
+				return fmt.Errorf("%s: missing required key %q", path, key)
+			}
+		}
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			prop, ok := s.Properties[key]
+			if !ok {
+				return fmt.Errorf("%s: unexpected key %q", path, key)
+			}
+			if err := prop.validate(obj[key], path+"."+key); err != nil {
+				return err
+			}
+		}
+	case "array":
+		arr, ok := v.([]any)
+		if !ok {
+			return fmt.Errorf("%s: expected array", path)
+		}
+		if s.Items != nil {
+			for i, item := range arr {
+				if err := s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%s: expected string", path)
+		}
+		if len(strings.TrimSpace(str)) < s.MinLength {
+			return fmt.Errorf("%s: must be at least %d characters", path, s.MinLength)
+		}
+		if s.MaxLength > 0 && len(str) > s.MaxLength {
+			return fmt.Errorf("%s: must be at most %d characters", path, s.MaxLength)
+		}
+		if len(s.Enum) > 0 {
+			found := false
+			for _, e := range s.Enum {
+				if str == e {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("%s: must be one of %s", path, strings.Join(s.Enum, ", "))
+			}
+		}
+	case "number", "integer":
+		num, ok := v.(float64)
+		if !ok {
+			return fmt.Errorf("%s: expected %s", path, s.Type)
+		}
+		if s.Type == "integer" && num != math.Trunc(num) {
+			return fmt.Errorf("%s: expected integer", path)
+		}
+		if s.Minimum != nil && num < *s.Minimum {
+			return fmt.Errorf("%s: must be >= %g", path, *s.Minimum)
+		}
+		if s.Maximum != nil && num > *s.Maximum {
+			return fmt.Errorf("%s: must be <= %g", path, *s.Maximum)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s: expected boolean", path)
+		}
+	default:
+		return fmt.Errorf("%s: schema has unknown type %q", path, s.Type)
+	}
+	return nil
+}
+
+// OutputTask names a model task and the shape its answer must take.
+type OutputTask struct {
+	Name   string
+	Schema *Schema
+}
+
+var questionTask = OutputTask{
+	Name: "question",
+	Schema: &Schema{
+		Type:     "object",
+		Required: []string{"question_latex"},
+		Properties: map[string]*Schema{
+			"question_latex": {Type: "string", MinLength: 10, MaxLength: 4000},
+		},
+	},
+}
+
+// OutputError is returned when the model never produced output matching the
+// task schema within the allowed number of attempts.
+type OutputError struct {
+	Task     string
+	Attempts int
+	Output   string
+	Err      error
+}
+
+func (e *OutputError) Error() string {
+	return fmt.Sprintf("model output for %s invalid after %d attempts: %v", e.Task, e.Attempts, e.Err)
+}
+
+func (e *OutputError) Unwrap() error { return e.Err }
+
+// completeStructured asks the model to answer prompt with JSON matching
+// task.Schema and decodes the result into out. Invalid output is fed back to
+// the model with the validation error until the attempts run out.
+func (a *App) completeStructured(ctx context.Context, task OutputTask, prompt string, out any) error {
+	schemaJSON, err := json.Marshal(task.Schema)
+	if err != nil {
+		return fmt.Errorf("encode %s schema: %w", task.Name, err)
+	}
+	attempts := a.OutputAttempts
+	if attempts <= 0 {
+		attempts = defaultOutputAttempts
+	}
+
+	messages := []ChatMessage{{
+		Role:    "user",
+		Content: prompt + "\nThe JSON must validate against this JSON schema:\n" + string(schemaJSON),
+	}}
+	var lastErr error
+	var lastText string
+	for i := 0; i < attempts; i++ {
+		body, err := a.Model.Invoke(ctx, ModelRequest{Messages: messages})
+		if err != nil {
+			return err
+		}
+		text := extractContent(body)
+		raw, err := decodeOutput(task, text)
+		if err == nil {
+			return json.Unmarshal(raw, out)
+		}
+		lastErr, lastText = err, text
+		messages = append(messages,
+			ChatMessage{Role: "assistant", Content: text},
+			ChatMessage{Role: "user", Content: fmt.Sprintf(
+				"Your previous output was rejected: %v\nReply again with ONLY a JSON object that validates against the schema. No other text.", err)},
+		)
+	}
+	return &OutputError{Task: task.Name, Attempts: attempts, Output: lastText, Err: lastErr}
+}
+
+// extractContent pulls the assistant text out of a model response body,
+// whichever of the known envelopes it arrived in, with reasoning removed.
+func extractContent(body []byte) string {
+	text := string(body)
+
+	var wrapped struct {
+		OutputText string `json:"output_text"`
+	}
+	if err := json.Unmarshal(body, &wrapped); err == nil && wrapped.OutputText != "" {
+		text = wrapped.OutputText
+	}
+
+	var chat struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal([]byte(text), &chat); err == nil && len(chat.Choices) > 0 {
+		text = chat.Choices[0].Message.Content
+	}
+
+	return strings.TrimSpace(RemoveReasoningBlock(text))
+}
+
+// decodeOutput finds the first JSON object in text and validates it.
+func decodeOutput(task OutputTask, text string) (json.RawMessage, error) {
+	raw, ok := findJSONObject(text)
+	if !ok {
+		return nil, errors.New("no JSON object found in output")
+	}
+	var v any
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	if err := task.Schema.Validate(v); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+func findJSONObject(text string) (json.RawMessage, bool) {
+	for i := 0; i < len(text); i++ {
+		if text[i] != '{' {
+			continue
+		}
+		dec := json.NewDecoder(strings.NewReader(text[i:]))
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == nil && bytes.HasPrefix(raw, []byte("{")) {
+			return raw, true
+		}
+	}
+	return nil, false
+}
+
+// modelError reports a failed model call to the client.
+func modelError(w http.ResponseWriter, err error) {
+	var outErr *OutputError
+	if errors.As(err, &outErr) {
+		log.Printf("%v; last output: %q", outErr, outErr.Output)
+		http.Error(w, "model returned invalid "+outErr.Task, http.StatusBadGateway)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
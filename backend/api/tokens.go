@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+	// revocationCacheTTL is how long a "not revoked" answer is trusted
+	// before asking the DB again, which bounds how long a logout on another
+	// instance takes to apply here.
+	revocationCacheTTL = 30 * time.Second
+)
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// refresh tokens are only stored as their SHA-256; they are random, so no
+// salt or slow hash is needed.
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+func (a *App) issueAccessToken(ctx context.Context, db dbtx, uid int64) (string, error) {
+	claims, err := loadClaims(ctx, db, uid)
+	if err != nil {
+		return "", err
+	}
+	if claims.ID, err = randomToken(16); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(accessTokenTTL))
+	return a.Keys.Sign(claims)
+}
+
+type tokenResp struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// issueTokens creates an access token and a refresh token for uid. Each
+// login starts a new refresh token family; refreshing continues one.
+func (a *App) issueTokens(ctx context.Context, db dbtx, uid int64, family string) (*tokenResp, error) {
+	access, err := a.issueAccessToken(ctx, db, uid)
+	if err != nil {
+		return nil, fmt.Errorf("sign access token: %w", err)
+	}
+	refresh, err := randomToken(32)
+	if err != nil {
+		return nil, fmt.Errorf("refresh token: %w", err)
+	}
+	if family == "" {
+		if family, err = randomToken(16); err != nil {
+			return nil, fmt.Errorf("token family: %w", err)
+		}
+	}
+	_, err = db.ExecContext(ctx,
+		"INSERT INTO refresh_tokens (TokenHash, UserID, FamilyID, ExpiresAt) VALUES (?, ?, ?, ?)",
+		hashToken(refresh), uid, family, time.Now().Add(refreshTokenTTL))
+	if err != nil {
+		return nil, fmt.Errorf("insert refresh token: %w", err)
+	}
+	return &tokenResp{Token: access, RefreshToken: refresh, ExpiresIn: int(accessTokenTTL.Seconds())}, nil
+}
+
+type refreshReq struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RefreshToken trades a refresh token for a new access token and a new
+// refresh token. A refresh token works once: presenting a used one means it
+// was copied, so the whole family is revoked and everyone holding it must
+// log in again.
+func (a *App) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req refreshReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "missing refresh_token", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("refresh begin error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var uid int64
+	var family string
+	var expires time.Time
+	var used, revoked sql.NullTime
+	err = tx.QueryRowContext(ctx,
+		"SELECT UserID, FamilyID, ExpiresAt, UsedAt, RevokedAt FROM refresh_tokens WHERE TokenHash=? FOR UPDATE",
+		hashToken(req.RefreshToken)).Scan(&uid, &family, &expires, &used, &revoked)
+	if err == sql.ErrNoRows {
+		http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("refresh select error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	if used.Valid && !revoked.Valid {
+		log.Printf("refresh token reuse for user %d, revoking family %s", uid, family)
+		if err := revokeFamily(ctx, tx, family); err != nil {
+			log.Printf("refresh revoke family error: %v", err)
+		} else if err := tx.Commit(); err != nil {
+			log.Printf("refresh revoke family commit error: %v", err)
+		}
+		http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if revoked.Valid || used.Valid || time.Now().After(expires) {
+		http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE refresh_tokens SET UsedAt=NOW() WHERE TokenHash=?", hashToken(req.RefreshToken))
+	if err != nil {
+		log.Printf("refresh mark used error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	resp, err := a.issueTokens(ctx, tx, uid, family)
+	if err != nil {
+		log.Printf("refresh issue error: %v", err)
+		http.Error(w, "failed to create token", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("refresh commit error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func revokeFamily(ctx context.Context, db dbtx, family string) error {
+	_, err := db.ExecContext(ctx, "UPDATE refresh_tokens SET RevokedAt=NOW() WHERE FamilyID=? AND RevokedAt IS NULL", family)
+	return err
+}
+
+// Logout revokes the caller's access token and, if given, the refresh
+// token family it belongs to.
+func (a *App) Logout(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req refreshReq
+	_ = json.NewDecoder(r.Body).Decode(&req)
+
+	if claims.ExpiresAt != nil {
+		if err := a.Revoked.Revoke(ctx, claims.ID, claims.ExpiresAt.Time); err != nil {
+			log.Printf("logout revoke error: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if req.RefreshToken != "" {
+		var family string
+		err := a.DB.QueryRowContext(ctx, "SELECT FamilyID FROM refresh_tokens WHERE TokenHash=? AND UserID=?",
+			hashToken(req.RefreshToken), claims.UserID).Scan(&family)
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("logout select refresh error: %v", err)
+		}
+		if family != "" {
+			if err := revokeFamily(ctx, a.DB, family); err != nil {
+				log.Printf("logout revoke family error: %v", err)
+			}
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RevocationList is the jti denylist. Revoked IDs are cached until their
+// token expires; IDs found not revoked are rechecked after
+// revocationCacheTTL.
+type RevocationList struct {
+	db    *sql.DB
+	mu    sync.Mutex
+	cache map[string]revocation
+}
+
+type revocation struct {
+	revoked bool
+	until   time.Time
+}
+
+func NewRevocationList(db *sql.DB) *RevocationList {
+	return &RevocationList{db: db, cache: make(map[string]revocation)}
+}
+
+func (l *RevocationList) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	now := time.Now()
+	l.mu.Lock()
+	c, ok := l.cache[jti]
+	l.mu.Unlock()
+	if ok && now.Before(c.until) {
+		return c.revoked, nil
+	}
+
+	var expires time.Time
+	err := l.db.QueryRowContext(ctx, "SELECT ExpiresAt FROM revoked_tokens WHERE JTI=?", jti).Scan(&expires)
+	switch {
+	case err == sql.ErrNoRows:
+		c = revocation{revoked: false, until: now.Add(revocationCacheTTL)}
+	case err != nil:
+		return false, fmt.Errorf("select revoked token: %w", err)
+	default:
+		c = revocation{revoked: true, until: expires}
+	}
+	l.store(jti, c)
+	return c.revoked, nil
+}
+
+// Revoke denylists jti until expires, when the token stops working anyway.
+func (l *RevocationList) Revoke(ctx context.Context, jti string, expires time.Time) error {
+	_, err := l.db.ExecContext(ctx, "INSERT IGNORE INTO revoked_tokens (JTI, ExpiresAt) VALUES (?, ?)", jti, expires)
+	if err != nil {
+		return fmt.Errorf("insert revoked token: %w", err)
+	}
+	if _, err := l.db.ExecContext(ctx, "DELETE FROM revoked_tokens WHERE ExpiresAt < NOW()"); err != nil {
+		log.Printf("prune revoked tokens error: %v", err)
+	}
+	l.store(jti, revocation{revoked: true, until: expires})
+	return nil
+}
+
+func (l *RevocationList) store(jti string, c revocation) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cache[jti] = c
+	if len(l.cache) > 10000 {
+		now := time.Now()
+		for k, v := range l.cache {
+			if now.After(v.until) {
+				delete(l.cache, k)
+			}
+		}
+	}
+}
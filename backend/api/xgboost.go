@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// xgbModel is a gradient-boosted tree model loaded from the JSON written by
+// XGBoost's Booster.save_model("model.json"). It predicts next_difficulty
+// from the columns of synthetic_user_data.csv.
+type xgbModel struct {
+	objective string
+	numClass  int
+	baseScore float64
+	features  []featureFunc
+	trees     []xgbTree
+	treeClass []int
+}
+
+type featureFunc func(f DifficultyFeatures) float64
+
+type xgbTree struct {
+	left, right []int
+	splitIndex  []int
+	splitCond   []float64
+	defaultLeft []bool
+}
+
+// xgbBools accepts default_left as either 0/1 or true/false, which differs
+// between XGBoost versions.
+type xgbBools []bool
+
+func (b *xgbBools) UnmarshalJSON(data []byte) error {
+	var raw []any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*b = make([]bool, len(raw))
+	for i, v := range raw {
+		switch v := v.(type) {
+		case bool:
+			(*b)[i] = v
+		case float64:
+			(*b)[i] = v != 0
+		default:
+			return fmt.Errorf("default_left[%d]: unexpected %T", i, v)
+		}
+	}
+	return nil
+}
+
+type xgbFile struct {
+	Learner struct {
+		FeatureNames    []string `json:"feature_names"`
+		GradientBooster struct {
+			Name  string `json:"name"`
+			Model struct {
+				TreeInfo []int `json:"tree_info"`
+				Trees    []struct {
+					LeftChildren    []int     `json:"left_children"`
+					RightChildren   []int     `json:"right_children"`
+					SplitIndices    []int     `json:"split_indices"`
+					SplitConditions []float64 `json:"split_conditions"`
+					DefaultLeft     xgbBools  `json:"default_left"`
+				} `json:"trees"`
+			} `json:"model"`
+		} `json:"gradient_booster"`
+		LearnerModelParam struct {
+			BaseScore string `json:"base_score"`
+			NumClass  string `json:"num_class"`
+		} `json:"learner_model_param"`
+		Objective struct {
+			Name string `json:"name"`
+		} `json:"objective"`
+	} `json:"learner"`
+}
+
+func loadXGBModel(path string) (*xgbModel, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file xgbFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse model: %w", err)
+	}
+	l := file.Learner
+	if l.GradientBooster.Name != "gbtree" {
+		return nil, fmt.Errorf("unsupported booster %q", l.GradientBooster.Name)
+	}
+
+	m := &xgbModel{objective: l.Objective.Name, treeClass: l.GradientBooster.Model.TreeInfo}
+	switch m.objective {
+	case "multi:softprob", "multi:softmax", "reg:squarederror":
+	default:
+		return nil, fmt.Errorf("unsupported objective %q", m.objective)
+	}
+	if m.numClass, err = strconv.Atoi(l.LearnerModelParam.NumClass); err != nil {
+		return nil, fmt.Errorf("num_class %q: %w", l.LearnerModelParam.NumClass, err)
+	}
+	classes := m.numClass
+	if m.objective == "reg:squarederror" {
+		classes = 1
+	} else if classes < 1 {
+		return nil, fmt.Errorf("num_class %d for %s", m.numClass, m.objective)
+	}
+	// base_score is "5E-1" in older files and "[5E-1]" in newer ones.
+	base := strings.Trim(l.LearnerModelParam.BaseScore, "[]")
+	if i := strings.IndexByte(base, ','); i >= 0 {
+		base = base[:i]
+	}
+	if m.baseScore, err = strconv.ParseFloat(base, 64); err != nil {
+		return nil, fmt.Errorf("base_score %q: %w", l.LearnerModelParam.BaseScore, err)
+	}
+
+	if len(l.FeatureNames) == 0 {
+		return nil, fmt.Errorf("model has no feature names; train it on a DataFrame")
+	}
+	for _, name := range l.FeatureNames {
+		fn, err := difficultyFeature(name)
+		if err != nil {
+			return nil, err
+		}
+		m.features = append(m.features, fn)
+	}
+
+	for i, t := range l.GradientBooster.Model.Trees {
+		n := len(t.LeftChildren)
+		if n == 0 {
+			return nil, fmt.Errorf("tree %d: no nodes", i)
+		}
+		if len(t.RightChildren) != n || len(t.SplitIndices) != n || len(t.SplitConditions) != n || len(t.DefaultLeft) != n {
+			return nil, fmt.Errorf("tree %d: node arrays differ in length", i)
+		}
+		for j := 0; j < n; j++ {
+			left, right := t.LeftChildren[j], t.RightChildren[j]
+			if left == -1 && right == -1 {
+				continue
+			}
+			// children always follow their parent, so walks end at a leaf
+			if left <= j || left >= n || right <= j || right >= n || t.SplitIndices[j] < 0 || t.SplitIndices[j] >= len(m.features) {
+				return nil, fmt.Errorf("tree %d: node %d out of range", i, j)
+			}
+		}
+		m.trees = append(m.trees, xgbTree{
+			left:        t.LeftChildren,
+			right:       t.RightChildren,
+			splitIndex:  t.SplitIndices,
+			splitCond:   t.SplitConditions,
+			defaultLeft: t.DefaultLeft,
+		})
+	}
+	if len(m.treeClass) != len(m.trees) {
+		return nil, fmt.Errorf("tree_info has %d entries for %d trees", len(m.treeClass), len(m.trees))
+	}
+	for i, k := range m.treeClass {
+		if k < 0 || k >= classes {
+			return nil, fmt.Errorf("tree %d: class %d out of range for %d classes", i, k, classes)
+		}
+	}
+	return m, nil
+}
+
+// difficultyFeature maps a model feature name to its value. Topic is either
+// one-hot ("topic_Algebra", as pd.get_dummies names it) or a category code
+// ("topic", in pandas' sorted category order).
+func difficultyFeature(name string) (featureFunc, error) {
+	switch name {
+	case "current_difficulty":
+		return func(f DifficultyFeatures) float64 { return float64(f.CurrentDifficulty) }, nil
+	case "accuracy_rate":
+		return func(f DifficultyFeatures) float64 { return f.AccuracyRate }, nil
+	case "streak":
+		return func(f DifficultyFeatures) float64 { return float64(f.Streak) }, nil
+	case "avg_time_per_question":
+		return func(f DifficultyFeatures) float64 { return f.AvgTimePerQuestion }, nil
+	case "questions_answered":
+		return func(f DifficultyFeatures) float64 { return float64(f.QuestionsAnswered) }, nil
+	case "topic":
+		codes := append([]string(nil), knownTopics...)
+		sort.Strings(codes)
+		return func(f DifficultyFeatures) float64 {
+			for i, t := range codes {
+				if t == f.Topic {
+					return float64(i)
+				}
+			}
+			return math.NaN()
+		}, nil
+	}
+	if topic, ok := strings.CutPrefix(name, "topic_"); ok {
+		return func(f DifficultyFeatures) float64 {
+			if strings.EqualFold(f.Topic, topic) {
+				return 1
+			}
+			return 0
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown feature %q", name)
+}
+
+// leaf walks the tree for x and returns the leaf value. NaN is missing.
+func (t *xgbTree) leaf(x []float64) float64 {
+	node := 0
+	for t.left[node] != -1 {
+		v := x[t.splitIndex[node]]
+		switch {
+		case math.IsNaN(v):
+			if t.defaultLeft[node] {
+				node = t.left[node]
+			} else {
+				node = t.right[node]
+			}
+		// XGBoost splits on float32 features and thresholds
+		case float32(v) < float32(t.splitCond[node]):
+			node = t.left[node]
+		default:
+			node = t.right[node]
+		}
+	}
+	// XGBoost stores leaf values in split_conditions.
+	return t.splitCond[node]
+}
+
+// predict returns the predicted next difficulty.
+func (m *xgbModel) predict(f DifficultyFeatures) int {
+	x := make([]float64, len(m.features))
+	for i, fn := range m.features {
+		x[i] = fn(f)
+	}
+
+	if m.objective == "reg:squarederror" {
+		sum := m.baseScore
+		for i := range m.trees {
+			sum += m.trees[i].leaf(x)
+		}
+		return clampDifficulty(int(math.Round(sum)))
+	}
+
+	// Multiclass: labels are next_difficulty-1. Softmax is unaffected by the
+	// shared base score, so argmax over summed leaves is enough.
+	margins := make([]float64, m.numClass)
+	for i := range m.trees {
+		margins[m.treeClass[i]] += m.trees[i].leaf(x)
+	}
+	best := 0
+	for k := range margins {
+		if margins[k] > margins[best] {
+			best = k
+		}
+	}
+	return clampDifficulty(best + 1)
+}
+
+// modelPolicy serves predictions from an XGBoost model file, reloading it
+// when the file changes, and defers to fallback while no model is loaded.
+type modelPolicy struct {
+	path     string
+	fallback DifficultyPolicy
+	model    atomic.Pointer[xgbModel]
+	modTime  time.Time
+	size     int64
+}
+
+func newModelPolicy(path string, fallback DifficultyPolicy) *modelPolicy {
+	p := &modelPolicy{path: path, fallback: fallback}
+	p.reload()
+	return p
+}
+
+func (p *modelPolicy) NextDifficulty(f DifficultyFeatures) int {
+	if m := p.model.Load(); m != nil {
+		return m.predict(f)
+	}
+	return p.fallback.NextDifficulty(f)
+}
+
+// reload loads the model file if it changed since the last check. A file
+// that fails to load leaves the previous model in place until it changes
+// again.
+func (p *modelPolicy) reload() {
+	info, err := os.Stat(p.path)
+	if err != nil {
+		if p.model.Load() != nil || !p.modTime.IsZero() {
+			log.Printf("difficulty model %s unavailable, using rules: %v", p.path, err)
+		}
+		p.model.Store(nil)
+		p.modTime, p.size = time.Time{}, 0
+		return
+	}
+	if info.ModTime().Equal(p.modTime) && info.Size() == p.size {
+		return
+	}
+	p.modTime, p.size = info.ModTime(), info.Size()
+	m, err := loadXGBModel(p.path)
+	if err != nil {
+		log.Printf("difficulty model %s not loaded: %v", p.path, err)
+		return
+	}
+	p.model.Store(m)
+	log.Printf("loaded difficulty model %s (%s, %d trees)", p.path, m.objective, len(m.trees))
+}
+
+// watch polls the model file until ctx is done.
+func (p *modelPolicy) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.reload()
+		}
+	}
+}
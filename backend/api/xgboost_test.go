@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testdata/next_difficulty.json is a three-tree multi:softprob model in the
+// format train_model.py saves. Class 0 (difficulty 1) wins below 0.5
+// accuracy, class 2 (difficulty 3) on a streak of 2 with accuracy at or
+// above 0.85, and class 1 otherwise.
+const xgbFixture = "testdata/next_difficulty.json"
+
+func TestXGBModelPredict(t *testing.T) {
+	m, err := loadXGBModel(xgbFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		accuracy float64
+		streak   int
+		want     int
+	}{
+		{"struggling", 0.3, 0, 1},
+		{"steady", 0.7, 0, 2},
+		{"accurate without a streak", 0.95, 1, 2},
+		{"accurate on a streak", 0.95, 3, 3},
+		// 0.85 rounds up to the float32 threshold, so it isn't below it
+		{"at the float32 threshold", 0.85, 2, 3},
+		{"just below the threshold", 0.84, 2, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := DifficultyFeatures{Topic: "Algebra", CurrentDifficulty: 2, AccuracyRate: tt.accuracy, Streak: tt.streak}
+			if got := m.predict(f); got != tt.want {
+				t.Errorf("predict = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadXGBModelRejectsBadModels(t *testing.T) {
+	data, err := os.ReadFile(xgbFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		old, new string
+	}{
+		{"num_class not a number", `"num_class":"3","num_feature"`, `"num_class":"three","num_feature"`},
+		{"tree class too high", `"tree_info":[0,1,2]`, `"tree_info":[0,1,3]`},
+		{"negative tree class", `"tree_info":[0,1,2]`, `"tree_info":[0,-1,2]`},
+		{"child past the end", `"left_children":[1,-1,-1]`, `"left_children":[3,-1,-1]`},
+		{"negative child", `"left_children":[1,-1,-1]`, `"left_children":[-2,-1,-1]`},
+		{"child loops back", `"left_children":[1,-1,-1]`, `"left_children":[0,-1,-1]`},
+		{"split on unknown feature", `"split_indices":[1,0,0]`, `"split_indices":[10,0,0]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !strings.Contains(string(data), tt.old) {
+				t.Fatalf("fixture has no %s", tt.old)
+			}
+			path := filepath.Join(t.TempDir(), "model.json")
+			if err := os.WriteFile(path, []byte(strings.Replace(string(data), tt.old, tt.new, 1)), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := loadXGBModel(path); err == nil {
+				t.Error("loadXGBModel succeeded, want an error")
+			}
+		})
+	}
+}
@@ -1,7 +1,59 @@
+import argparse
+import os
+import tempfile
+
 import pandas as pd
 import xgboost as xgb
 from sklearn.model_selection import train_test_split
 from sklearn.metrics import accuracy_score
 
+HERE = os.path.dirname(os.path.abspath(__file__))
+
+
+def load_data(path):
+    df = pd.read_csv(path)
+    # match headers case-insensitively, so a "User_id" column still loads
+    df.columns = df.columns.str.strip().str.lower()
+    return df
+
+
+def train(df, n_estimators=100):
+    # The Go API loads the saved JSON model (DIFFICULTY_MODEL_FILE) and maps
+    # features by name, so keep the CSV column names and one-hot topics.
+    X = pd.get_dummies(df.drop(columns=["user_id", "next_difficulty"]), columns=["topic"], dtype=float)
+    y = df["next_difficulty"] - 1
+
+    # split by user so the test set has students the model hasn't seen
+    users = df["user_id"].unique()
+    train_users, test_users = train_test_split(users, test_size=0.2, random_state=42)
+    in_train = df["user_id"].isin(train_users)
+
+    model = xgb.XGBClassifier(objective="multi:softprob", n_estimators=n_estimators, max_depth=4, learning_rate=0.1)
+    model.fit(X[in_train], y[in_train])
+
+    pred = model.predict(X[~in_train])
+    print("accuracy:", accuracy_score(y[~in_train], pred))
+    return model
+
 
+if __name__ == "__main__":
+    parser = argparse.ArgumentParser(description="Train the next-difficulty model.")
+    parser.add_argument("--data", default=os.path.join(HERE, "data", "synthetic_user_data.csv"))
+    parser.add_argument("--out", default="next_difficulty.json")
+    parser.add_argument("--smoke", action="store_true",
+                        help="train a few trees on the first 50 users and check the model saves")
+    args = parser.parse_args()
 
+    df = load_data(args.data)
+    if args.smoke:
+        df = df[df["user_id"].isin(df["user_id"].unique()[:50])]
+        model = train(df, n_estimators=3)
+        with tempfile.TemporaryDirectory() as tmp:
+            out = os.path.join(tmp, "next_difficulty.json")
+            model.get_booster().save_model(out)
+            saved = xgb.Booster(model_file=out)
+            assert saved.feature_names == list(model.get_booster().feature_names), "feature names not saved"
+        print("smoke run ok")
+    else:
+        model = train(df)
+        model.get_booster().save_model(args.out)